@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.sia.tech/renterd/api"
+	"lukechampine.com/blake3"
+	"lukechampine.com/frand"
+)
+
+// maxUserMetadata is the maximum number of random user metadata entries an
+// object is uploaded with.
+const maxUserMetadata = 5
+
+var mimeTypes = []string{
+	"application/octet-stream",
+	"application/json",
+	"application/x-renterd-integrity",
+	"image/png",
+	"text/plain; charset=utf-8",
+	"video/mp4",
+}
+
+// objectAttributes are the attributes an object is uploaded with besides its
+// content. They're derived from the content's seed, which is stored in the
+// object's metadata, so they can be verified without keeping track of them.
+type objectAttributes struct {
+	mimeType string
+	metadata api.ObjectUserMetadata
+}
+
+func newObjectAttributes(generator string, seed [32]byte) objectAttributes {
+	h := blake3.Sum256(append(seed[:], "attributes"...))
+	rng := frand.NewCustom(h[:], 1024, 12)
+
+	attrs := objectAttributes{
+		mimeType: mimeTypes[rng.Intn(len(mimeTypes))],
+		metadata: contentMetadata(generator, seed),
+	}
+	for i := rng.Intn(maxUserMetadata + 1); i > 0; i-- {
+		key := "integrity-" + hex.EncodeToString(rng.Bytes(4))
+		attrs.metadata[key] = hex.EncodeToString(rng.Bytes(1 + rng.Intn(32)))
+	}
+	return attrs
+}
+
+// attributesFromMetadata returns the attributes the object should have
+// according to its metadata, it returns false if the object wasn't uploaded
+// with a content seed.
+func attributesFromMetadata(md api.ObjectUserMetadata) (objectAttributes, bool) {
+	generator, seed, ok := contentSeed(md)
+	if !ok {
+		return objectAttributes{}, false
+	}
+	return newObjectAttributes(generator, seed), true
+}
+
+func (a objectAttributes) uploadOptions() api.UploadObjectOptions {
+	return api.UploadObjectOptions{
+		MimeType: a.mimeType,
+		Metadata: a.metadata,
+	}
+}
+
+// verifyAttributes checks that the object's attributes round-tripped through
+// both the bus and the transport. The ETag of objects that weren't uploaded
+// in multiple parts is the MD5 hash of their content.
+func (p *profile) verifyAttributes(bucket, key string, obj api.Object, want objectAttributes, size int64, contentMD5 string) error {
+	var problems []string
+	check := func(source, attr string, got, want any) {
+		if !reflect.DeepEqual(got, want) {
+			problems = append(problems, fmt.Sprintf("%s %s: expected '%v', got '%v'", source, attr, want, got))
+		}
+	}
+
+	var head *api.HeadObjectResponse
+	if err := withSaneTimeout(func(ctx context.Context) (err error) {
+		head, err = p.transport.HeadObject(ctx, bucket, key)
+		return
+	}, nil); err != nil {
+		return fmt.Errorf("failed to fetch head of '%v'; %w", key, err)
+	}
+
+	check("bus", "size", obj.Size, size)
+	check("bus", "content type", obj.MimeType, want.mimeType)
+	check("bus", "metadata", normalizeMetadata(obj.Metadata), want.metadata)
+
+	check("head", "size", head.Size, size)
+	check("head", "content type", head.ContentType, want.mimeType)
+	check("head", "metadata", normalizeMetadata(head.Metadata), want.metadata)
+	check("head", "etag", normalizeETag(head.Etag), normalizeETag(obj.ETag))
+
+	if etag := normalizeETag(obj.ETag); !strings.Contains(etag, "-") {
+		check("content", "etag", contentMD5, etag)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("attributes of '%v' didn't round-trip: %s; %w", key, strings.Join(problems, ", "), errIntegrity)
+	}
+	return nil
+}
+
+// normalizeMetadata lowercases the metadata's keys, S3 clients canonicalize
+// them.
+func normalizeMetadata(md api.ObjectUserMetadata) api.ObjectUserMetadata {
+	normalized := make(api.ObjectUserMetadata, len(md))
+	for k, v := range md {
+		normalized[strings.ToLower(k)] = v
+	}
+	return normalized
+}
+
+func normalizeETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.sia.tech/renterd/api"
+	"go.uber.org/zap"
+	"lukechampine.com/frand"
+)
+
+// headTransport is a transport that only serves the head of an object.
+type headTransport struct {
+	transport
+	head api.HeadObjectResponse
+}
+
+func (t headTransport) HeadObject(context.Context, string, string) (*api.HeadObjectResponse, error) {
+	return &t.head, nil
+}
+
+func TestObjectAttributes(t *testing.T) {
+	seed := frand.Entropy256()
+	attrs := newObjectAttributes(contentRandom, seed)
+	if !reflect.DeepEqual(attrs, newObjectAttributes(contentRandom, seed)) {
+		t.Fatal("expected attributes to be derived from the seed")
+	}
+
+	// the attributes are recovered from the metadata, regardless of how the
+	// transport canonicalized its keys
+	canonical := make(api.ObjectUserMetadata)
+	for k, v := range attrs.metadata {
+		canonical[http.CanonicalHeaderKey(k)] = v
+	}
+	if got, ok := attributesFromMetadata(canonical); !ok {
+		t.Fatal("expected attributes to be recovered")
+	} else if !reflect.DeepEqual(got, attrs) {
+		t.Fatalf("expected attributes %+v, got %+v", attrs, got)
+	}
+
+	// objects without a seed have no attributes to verify
+	if _, ok := attributesFromMetadata(api.ObjectUserMetadata{"foo": "bar"}); ok {
+		t.Fatal("expected no attributes")
+	}
+}
+
+func TestVerifyAttributes(t *testing.T) {
+	attrs := newObjectAttributes(contentRandom, frand.Entropy256())
+	const (
+		size = 1024
+		md5  = "0cc175b9c0f1b6a831c399e269772661"
+	)
+	obj := api.Object{ObjectMetadata: api.ObjectMetadata{
+		ETag:     md5,
+		MimeType: attrs.mimeType,
+		Size:     size,
+	}, Metadata: attrs.metadata}
+
+	// the head as the s3 api returns it, with canonicalized metadata keys and
+	// a quoted etag
+	s3Head := api.HeadObjectResponse{
+		ContentType: attrs.mimeType,
+		Etag:        `"` + md5 + `"`,
+		Size:        size,
+		Metadata:    make(api.ObjectUserMetadata),
+	}
+	for k, v := range attrs.metadata {
+		s3Head.Metadata[http.CanonicalHeaderKey(k)] = v
+	}
+	workerHead := api.HeadObjectResponse{
+		ContentType: attrs.mimeType,
+		Etag:        md5,
+		Size:        size,
+		Metadata:    attrs.metadata,
+	}
+
+	tests := []struct {
+		name   string
+		obj    func(api.Object) api.Object
+		head   api.HeadObjectResponse
+		update func(*api.HeadObjectResponse)
+		md5    string
+		err    string
+	}{
+		{name: "worker", head: workerHead},
+		{name: "s3", head: s3Head},
+		{
+			name:   "content type",
+			head:   workerHead,
+			update: func(h *api.HeadObjectResponse) { h.ContentType = "text/html" },
+			err:    "head content type",
+		},
+		{
+			name:   "size",
+			head:   s3Head,
+			update: func(h *api.HeadObjectResponse) { h.Size = size - 1 },
+			err:    "head size",
+		},
+		{
+			name:   "metadata",
+			head:   workerHead,
+			update: func(h *api.HeadObjectResponse) { h.Metadata = api.ObjectUserMetadata{} },
+			err:    "head metadata",
+		},
+		{
+			name:   "etag",
+			head:   s3Head,
+			update: func(h *api.HeadObjectResponse) { h.Etag = `"other"` },
+			err:    "head etag",
+		},
+		{
+			name: "bus content type",
+			head: workerHead,
+			obj: func(obj api.Object) api.Object {
+				obj.MimeType = "application/octet-stream; charset=binary"
+				return obj
+			},
+			err: "bus content type",
+		},
+		{
+			name: "content",
+			head: workerHead,
+			md5:  "92eb5ffee6ae2fec3ad71c777531578f",
+			err:  "content etag",
+		},
+		{
+			name: "multipart",
+			head: workerHead,
+			obj: func(obj api.Object) api.Object {
+				obj.ETag = md5 + "-2"
+				return obj
+			},
+			update: func(h *api.HeadObjectResponse) { h.Etag = md5 + "-2" },
+			md5:    "92eb5ffee6ae2fec3ad71c777531578f",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			head := test.head
+			head.Metadata = make(api.ObjectUserMetadata)
+			for k, v := range test.head.Metadata {
+				head.Metadata[k] = v
+			}
+			if test.update != nil {
+				test.update(&head)
+			}
+			o := obj
+			if test.obj != nil {
+				o = test.obj(obj)
+			}
+			contentMD5 := md5
+			if test.md5 != "" {
+				contentMD5 = test.md5
+			}
+
+			p := &profile{logger: zap.NewNop().Sugar(), transport: headTransport{head: head}}
+			err := p.verifyAttributes(defaultBucketName, "/data/key", o, attrs, size, contentMD5)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			} else if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			} else if !errors.Is(err, errIntegrity) {
+				t.Fatalf("expected an integrity error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.sia.tech/renterd/api"
+	"lukechampine.com/blake3"
+)
+
+// maxLifecycleBucketPrefix is the length of the profile's bucket name that is
+// kept in the name of an ephemeral bucket, bucket names are at most 63 chars.
+const maxLifecycleBucketPrefix = 40
+
+// bucketPolicy returns the policy the profile's buckets are created with.
+func (p *profile) bucketPolicy() api.BucketPolicy {
+	return api.BucketPolicy{PublicReadAccess: p.PublicReadAccess}
+}
+
+// ensureBucket creates the profile's bucket, if the bucket already exists its
+// policy is updated to match the config.
+func (p *profile) ensureBucket() error {
+	policy := p.bucketPolicy()
+	err := withSaneTimeout(func(ctx context.Context) error {
+		return bc.CreateBucket(ctx, p.Bucket, api.CreateBucketOptions{Policy: policy})
+	}, nil)
+	if err == nil {
+		return nil
+	} else if !strings.Contains(err.Error(), api.ErrBucketExists.Error()) {
+		return err
+	}
+
+	return withSaneTimeout(func(ctx context.Context) error {
+		b, err := bc.Bucket(ctx, p.Bucket)
+		if err != nil {
+			return fmt.Errorf("failed to fetch bucket '%s'; %w", p.Bucket, err)
+		} else if b.Policy == policy {
+			return nil
+		}
+
+		p.logger.Infof("updating policy of bucket '%s', public read access: %v -> %v", p.Bucket, b.Policy.PublicReadAccess, policy.PublicReadAccess)
+		if err := bc.UpdateBucketPolicy(ctx, p.Bucket, policy); err != nil {
+			return fmt.Errorf("failed to update policy of bucket '%s'; %w", p.Bucket, err)
+		}
+		return nil
+	}, nil)
+}
+
+// verifyBucketPolicy downloads a random object through the S3 API without
+// credentials, which must only succeed if the bucket allows public reads. The
+// check is skipped if no S3 address is configured.
+func (p *profile) verifyBucketPolicy() error {
+	if cfg.S3.Address == "" {
+		p.logger.Debug("skipping bucket policy check, no s3 address configured")
+		return nil
+	}
+
+	// other phases may remove the object after it was listed
+	wasRemoved, stop := p.locks.watchRemoved()
+	defer stop()
+	entries, err := p.calculateRandomBatch(1)
+	if err != nil {
+		return err
+	} else if len(entries) == 0 {
+		return nil
+	}
+	key := entries[0].Key
+	if !p.locks.lockObject(key) {
+		p.logger.Debugf("skipping bucket policy check, '%s' is used by another phase", key)
+		return nil
+	}
+	defer p.locks.unlockObject(key)
+	if wasRemoved(key) {
+		p.logger.Debugf("skipping bucket policy check, '%s' was removed by another phase", key)
+		return nil
+	}
+
+	p.logger.Debugf("verifying policy of bucket '%s' by anonymously downloading '%s'", p.Bucket, key)
+	return withSaneTimeout(func(ctx context.Context) error {
+		status, hash, err := anonymousDownload(ctx, p.Bucket, key)
+		if err != nil {
+			return fmt.Errorf("failed to download '%s' anonymously; %w", key, err)
+		}
+
+		switch {
+		case p.PublicReadAccess && status != http.StatusOK:
+			return fmt.Errorf("bucket '%s' allows public reads but anonymously downloading '%s' returned status %d", p.Bucket, key, status)
+		case !p.PublicReadAccess && status == http.StatusOK:
+			return fmt.Errorf("bucket '%s' doesn't allow public reads but anonymously downloading '%s' succeeded", p.Bucket, key)
+		case !p.PublicReadAccess && status != http.StatusForbidden:
+			return fmt.Errorf("bucket '%s' doesn't allow public reads, expected status %d when anonymously downloading '%s', got %d", p.Bucket, http.StatusForbidden, key, status)
+		}
+
+		if status == http.StatusOK {
+			if expected := expectedHash(key); hash != expected {
+				return fmt.Errorf("hash mismatch for anonymously downloaded file '%v', expected '%v', got '%v'; %w", key, expected, hash, errIntegrity)
+			}
+		}
+		return nil
+	}, &entries[0].Size)
+}
+
+// testBucketLifecycle creates an ephemeral bucket, populates it, verifies its
+// objects and deletes it again, checking that renterd enforces the bucket's
+// invariants along the way.
+func (p *profile) testBucketLifecycle() (err error) {
+	bucket := lifecycleBucketName(p.Bucket)
+	policy := p.bucketPolicy()
+	p.logger.Infof("testing the lifecycle of ephemeral bucket '%s' with %d objects", bucket, p.BucketLifecycleObjects)
+
+	// create the bucket
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		return bc.CreateBucket(ctx, bucket, api.CreateBucketOptions{Policy: policy})
+	}, nil); err != nil {
+		return fmt.Errorf("failed to create bucket '%s'; %w", bucket, err)
+	}
+
+	// make sure the bucket doesn't outlive the test
+	var deleted bool
+	defer func() {
+		if deleted {
+			return
+		}
+		if rmErr := withSaneTimeout(func(ctx context.Context) error {
+			if err := bc.RemoveObjects(ctx, bucket, p.remotePrefix()); err != nil && !strings.Contains(err.Error(), api.ErrObjectNotFound.Error()) {
+				return err
+			}
+			return bc.DeleteBucket(ctx, bucket)
+		}, nil); rmErr != nil {
+			p.logger.Errorf("failed to clean up bucket '%s', err: %v", bucket, rmErr)
+		}
+	}()
+
+	// the bucket must exist with the requested policy and be unique
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		b, err := bc.Bucket(ctx, bucket)
+		if err != nil {
+			return fmt.Errorf("failed to fetch bucket '%s'; %w", bucket, err)
+		} else if b.Policy != policy {
+			return fmt.Errorf("bucket '%s' was created with policy %+v, got %+v", bucket, policy, b.Policy)
+		}
+		if err := bc.CreateBucket(ctx, bucket, api.CreateBucketOptions{}); err == nil {
+			return fmt.Errorf("bucket '%s' was created twice", bucket)
+		} else if !strings.Contains(err.Error(), api.ErrBucketExists.Error()) {
+			return fmt.Errorf("unexpected error when creating bucket '%s' twice; %w", bucket, err)
+		}
+		return nil
+	}, nil); err != nil {
+		return err
+	}
+
+	// populate the bucket
+	sizes := make(map[string]int64)
+	for i := 0; i < p.BucketLifecycleObjects; i++ {
+		size := p.randomFileSize(p.MaxFilesize)
+		key, err := p.uploadFile(bucket, size)
+		if err != nil {
+			return fmt.Errorf("failed to populate bucket '%s'; %w", bucket, err)
+		}
+		sizes[key] = size
+	}
+
+	// verify the objects
+	for key, size := range sizes {
+		if err := p.verifyObject(bucket, key, size); err != nil {
+			return err
+		}
+	}
+
+	// a bucket that isn't empty must not be deleted
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		if len(sizes) == 0 {
+			return nil
+		}
+		if err := bc.DeleteBucket(ctx, bucket); err == nil {
+			deleted = true
+			return fmt.Errorf("bucket '%s' was deleted while it contained %d objects", bucket, len(sizes))
+		} else if !strings.Contains(err.Error(), api.ErrBucketNotEmpty.Error()) {
+			return fmt.Errorf("unexpected error when deleting non-empty bucket '%s'; %w", bucket, err)
+		}
+		return nil
+	}, nil); err != nil {
+		return err
+	}
+
+	// empty and delete the bucket
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		if len(sizes) > 0 {
+			if err := bc.RemoveObjects(ctx, bucket, p.remotePrefix()); err != nil {
+				return fmt.Errorf("failed to empty bucket '%s'; %w", bucket, err)
+			}
+		}
+		if err := bc.DeleteBucket(ctx, bucket); err != nil {
+			return fmt.Errorf("failed to delete bucket '%s'; %w", bucket, err)
+		}
+		deleted = true
+		return nil
+	}, nil); err != nil {
+		return err
+	}
+
+	// the bucket must be gone
+	return withSaneTimeout(func(ctx context.Context) error {
+		if _, err := bc.Bucket(ctx, bucket); err == nil {
+			return fmt.Errorf("bucket '%s' still exists after it was deleted", bucket)
+		} else if !strings.Contains(err.Error(), api.ErrBucketNotFound.Error()) {
+			return fmt.Errorf("unexpected error when fetching deleted bucket '%s'; %w", bucket, err)
+		}
+		return nil
+	}, nil)
+}
+
+// anonymousDownload downloads the object through the S3 API without any
+// credentials and returns the response's status code, as well as the hash of
+// the object if the download succeeded.
+func anonymousDownload(ctx context.Context, bucket, key string) (status int, hash string, _ error) {
+	url := fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(cfg.S3.Address, "/"), bucket, strings.TrimPrefix(key, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, "", nil
+	}
+
+	h := blake3.New(blake3HashDigestSize, nil)
+	n, err := io.Copy(h, resp.Body)
+	costs.downloaded.Add(n)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read response body; %w", err)
+	}
+	return resp.StatusCode, fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// lifecycleBucketName returns a unique name for an ephemeral bucket derived
+// from the given bucket.
+func lifecycleBucketName(bucket string) string {
+	if len(bucket) > maxLifecycleBucketPrefix {
+		bucket = bucket[:maxLifecycleBucketPrefix]
+	}
+	return fmt.Sprintf("%s-lifecycle-%s", bucket, randomString()[:8])
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.sia.tech/renterd/api"
+	"lukechampine.com/blake3"
+)
+
+// testBuckets is an in-memory bus that only knows about buckets.
+type testBuckets struct {
+	mu       sync.Mutex
+	policies map[string]api.BucketPolicy
+
+	// ignorePolicy creates buckets without their policy, allowDuplicates
+	// allows creating a bucket twice and keepDeleted doesn't delete buckets
+	ignorePolicy    bool
+	allowDuplicates bool
+	keepDeleted     bool
+
+	updates []api.BucketPolicy
+}
+
+func newTestBuckets() *testBuckets {
+	return &testBuckets{policies: make(map[string]api.BucketPolicy)}
+}
+
+func (tb *testBuckets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	name, isPolicy := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/bucket/"), "/policy")
+	_, exists := tb.policies[name]
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/buckets":
+		var req api.BucketCreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if _, exists := tb.policies[req.Name]; exists && !tb.allowDuplicates {
+			http.Error(w, api.ErrBucketExists.Error(), http.StatusConflict)
+		} else if tb.ignorePolicy {
+			tb.policies[req.Name] = api.BucketPolicy{}
+		} else {
+			tb.policies[req.Name] = req.Policy
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/objects/remove":
+	case !strings.HasPrefix(r.URL.Path, "/bucket/"):
+		http.NotFound(w, r)
+	case !exists:
+		http.Error(w, api.ErrBucketNotFound.Error(), http.StatusNotFound)
+	case r.Method == http.MethodPut && isPolicy:
+		var req api.BucketUpdatePolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tb.policies[name] = req.Policy
+		tb.updates = append(tb.updates, req.Policy)
+	case r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(api.Bucket{Name: name, Policy: tb.policies[name]})
+	case r.Method == http.MethodDelete:
+		if !tb.keepDeleted {
+			delete(tb.policies, name)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestEnsureBucket(t *testing.T) {
+	buckets := newTestBuckets()
+	p := newTestProfile(t, buckets.ServeHTTP)
+
+	// the bucket is created with its policy
+	p.PublicReadAccess = true
+	if err := p.ensureBucket(); err != nil {
+		t.Fatal(err)
+	} else if !buckets.policies[p.Bucket].PublicReadAccess {
+		t.Fatal("expected the bucket to allow public reads")
+	}
+
+	// an existing bucket with the same policy is left alone
+	if err := p.ensureBucket(); err != nil {
+		t.Fatal(err)
+	} else if len(buckets.updates) != 0 {
+		t.Fatalf("expected no policy updates, got %v", buckets.updates)
+	}
+
+	// an existing bucket's policy is updated to match the config
+	p.PublicReadAccess = false
+	if err := p.ensureBucket(); err != nil {
+		t.Fatal(err)
+	} else if len(buckets.updates) != 1 {
+		t.Fatalf("expected one policy update, got %v", buckets.updates)
+	} else if buckets.policies[p.Bucket].PublicReadAccess {
+		t.Fatal("expected the bucket to no longer allow public reads")
+	}
+}
+
+func TestVerifyBucketPolicy(t *testing.T) {
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+
+	content := []byte("integrity")
+	h := blake3.New(blake3HashDigestSize, nil)
+	h.Write(content)
+	key := fmt.Sprintf("/data/%x-abcdefgh%s", h.Sum(nil), dataExtension)
+
+	p := newTestProfile(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.ObjectsResponse{Objects: []api.ObjectMetadata{{Key: key, Size: int64(len(content))}}})
+	})
+
+	tests := []struct {
+		name    string
+		public  bool
+		status  int
+		content []byte
+		err     string
+	}{
+		{name: "public", public: true, status: http.StatusOK, content: content},
+		{name: "public corrupted", public: true, status: http.StatusOK, content: []byte("corrupted"), err: errIntegrity.Error()},
+		{name: "public denied", public: true, status: http.StatusForbidden, err: "allows public reads"},
+		{name: "private", status: http.StatusForbidden},
+		{name: "private served", status: http.StatusOK, content: content, err: "succeeded"},
+		{name: "private unexpected status", status: http.StatusNotFound, err: "expected status 403"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var path string
+			var authorized bool
+			s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path, authorized = r.URL.Path, r.Header.Get("Authorization") != ""
+				w.WriteHeader(test.status)
+				w.Write(test.content)
+			}))
+			defer s3.Close()
+			cfg.S3.Address = s3.URL
+
+			p.PublicReadAccess = test.public
+			err := p.verifyBucketPolicy()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if path != "/"+p.Bucket+key {
+				t.Fatalf("expected '%s' to be downloaded, got '%s'", "/"+p.Bucket+key, path)
+			} else if authorized {
+				t.Fatal("expected an anonymous download")
+			}
+		})
+	}
+
+	// without an s3 address the check is skipped
+	cfg.S3.Address = ""
+	if err := p.verifyBucketPolicy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBucketLifecycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(tb *testBuckets)
+		err   string
+	}{
+		{
+			name:  "ok",
+			setup: func(*testBuckets) {},
+		},
+		{
+			name:  "policy not applied",
+			setup: func(tb *testBuckets) { tb.ignorePolicy = true },
+			err:   "was created with policy",
+		},
+		{
+			name:  "duplicate bucket",
+			setup: func(tb *testBuckets) { tb.allowDuplicates = true },
+			err:   "was created twice",
+		},
+		{
+			name:  "bucket not deleted",
+			setup: func(tb *testBuckets) { tb.keepDeleted = true },
+			err:   "still exists after it was deleted",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buckets := newTestBuckets()
+			test.setup(buckets)
+			p := newTestProfile(t, buckets.ServeHTTP)
+			p.PublicReadAccess = true
+
+			err := p.testBucketLifecycle()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			// the ephemeral bucket never outlives the test
+			if !buckets.keepDeleted && len(buckets.policies) != 0 {
+				t.Fatalf("expected the ephemeral bucket to be deleted, got %v", buckets.policies)
+			}
+		})
+	}
+}
+
+func TestLifecycleBucketName(t *testing.T) {
+	for _, bucket := range []string{defaultBucketName, strings.Repeat("b", 63)} {
+		name := lifecycleBucketName(bucket)
+		if err := (api.BucketCreateRequest{Name: name}).Validate(); err != nil {
+			t.Fatalf("invalid bucket name '%s', err: %v", name, err)
+		} else if !strings.HasPrefix(name, bucket[:min(len(bucket), maxLifecycleBucketPrefix)]) {
+			t.Fatalf("expected '%s' to start with the bucket's name", name)
+		} else if lifecycleBucketName(bucket) == name {
+			t.Fatal("expected unique bucket names")
+		}
+	}
+}
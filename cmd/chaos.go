@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+	"lukechampine.com/frand"
+)
+
+const (
+	chaosScenarioContractExpiry   = "contractExpiry"
+	chaosScenarioHostOffline      = "hostOffline"
+	chaosScenarioRedundancy       = "redundancy"
+	chaosScenarioSectorCorruption = "sectorCorruption"
+	chaosScenarioSectorLoss       = "sectorLoss"
+
+	defaultChaosReportFile = "chaos.json"
+
+	// chaosExpiryBlocks is the number of blocks mined at a time while waiting
+	// for contracts to expire
+	chaosExpiryBlocks = 10
+
+	// chaosMinHosts is the smallest cluster the scenarios run against, the
+	// cluster stores data with 2-of-3 redundancy and needs a spare host to
+	// migrate to
+	chaosMinHosts = 4
+)
+
+var (
+	chaosScenarios = map[string]chaosScenario{
+		chaosScenarioContractExpiry:   expireContracts,
+		chaosScenarioHostOffline:      takeHostOffline,
+		chaosScenarioRedundancy:       changeRedundancy,
+		chaosScenarioSectorCorruption: corruptSectors,
+		chaosScenarioSectorLoss:       deleteSectors,
+	}
+)
+
+type (
+	// chaosScenario injects a fault into the cluster, it returns a description
+	// of what was done and a function that undoes the fault, if possible.
+	chaosScenario func(p *profile, c *chaosCluster) (desc string, restore func() error, err error)
+
+	chaosReport struct {
+		Scenario    string    `json:"scenario"`
+		Description string    `json:"description,omitempty"`
+		StartedAt   time.Time `json:"startedAt"`
+		EndedAt     time.Time `json:"endedAt"`
+
+		Passed         bool    `json:"passed"`
+		Recovered      bool    `json:"recovered"`
+		TimeToRecovery string  `json:"timeToRecovery,omitempty"`
+		MinHealth      float64 `json:"minHealth"`
+
+		Checks      int      `json:"checks"`
+		Corruptions []string `json:"corruptions,omitempty"`
+		Unavailable []string `json:"unavailable,omitempty"`
+
+		Err *resultErr `json:"error,omitempty"`
+	}
+)
+
+func runChaosScenarios(p *profile, c *chaosCluster) (reports []chaosReport, _ error) {
+	// refresh redundancy
+	if err := p.refreshRedundancy(); err != nil {
+		return nil, err
+	}
+
+	// ensure we have a dataset to break
+	if _, _, err := p.ensureDataset(cfg.Chaos.DatasetSize); err != nil {
+		return nil, fmt.Errorf("failed to ensure dataset; %w", err)
+	}
+
+	for _, name := range cfg.Chaos.Scenarios {
+		report := p.runChaosScenario(name, chaosScenarios[name], c)
+		if report.Passed {
+			p.logger.Infof("chaos scenario '%s' passed", name)
+		} else {
+			p.logger.Errorf("chaos scenario '%s' failed, report: %+v", name, report)
+		}
+		reports = append(reports, report)
+	}
+	return
+}
+
+func (p *profile) runChaosScenario(name string, scenario chaosScenario, c *chaosCluster) (report chaosReport) {
+	p.logger.Infof("running chaos scenario '%s'", name)
+	report = chaosReport{
+		Scenario:  name,
+		StartedAt: time.Now().UTC(),
+		MinHealth: 1,
+	}
+
+	var err error
+	defer func() {
+		report.EndedAt = time.Now().UTC()
+		report.Passed = err == nil && report.Recovered && len(report.Corruptions) == 0 && len(report.Unavailable) == 0
+		if err != nil {
+			report.Err = &resultErr{err}
+		}
+	}()
+
+	// inject the fault, and undo it when we're done, even if injecting it
+	// failed halfway
+	var restore func() error
+	report.Description, restore, err = scenario(p, c)
+	if restore != nil {
+		defer func() {
+			if rErr := restore(); rErr != nil {
+				p.logger.Errorf("failed to restore chaos scenario '%s', err: %v", name, rErr)
+				if err == nil {
+					err = fmt.Errorf("failed to restore; %w", rErr)
+				}
+			}
+		}()
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to inject fault; %w", err)
+		return
+	}
+	p.logger.Infof("injected fault: %s", report.Description)
+
+	// keep checking the dataset until renterd has restored its health
+	injected := time.Now()
+	deadline := injected.Add(cfg.Chaos.HealthTimeout)
+	for {
+		_, cErr := p.checkIntegrity(phaseVerify, cfg.Chaos.CheckSize)
+		report.Checks++
+		if errors.Is(cErr, errIntegrity) {
+			report.Corruptions = append(report.Corruptions, cErr.Error())
+		} else if cErr != nil {
+			report.Unavailable = append(report.Unavailable, cErr.Error())
+		}
+
+		health, hErr := p.datasetHealth()
+		if hErr != nil {
+			p.logger.Warnf("failed to fetch dataset health, err: %v", hErr)
+		} else {
+			if health < report.MinHealth {
+				report.MinHealth = health
+			}
+			if health >= 1 {
+				report.Recovered = true
+				report.TimeToRecovery = time.Since(injected).Round(time.Second).String()
+				return
+			}
+			p.logger.Debugf("dataset health is %.2f, waiting for migrations", health)
+		}
+
+		if time.Now().Add(cfg.Chaos.PollInterval).After(deadline) {
+			p.logger.Warnf("dataset did not recover within %v", cfg.Chaos.HealthTimeout)
+			return
+		}
+		time.Sleep(cfg.Chaos.PollInterval)
+	}
+}
+
+// datasetHealth returns the health of the least healthy object of the
+// profile's dataset.
+func (p *profile) datasetHealth() (health float64, err error) {
+	if err := withSaneTimeout(bc.RefreshHealth, nil); err != nil {
+		return 0, err
+	}
+	entries, err := p.fetchEntries()
+	if err != nil {
+		return 0, err
+	}
+
+	health = 1
+	for _, entry := range entries {
+		if entry.Health < health {
+			health = entry.Health
+		}
+	}
+	return
+}
+
+func expireContracts(p *profile, c *chaosCluster) (string, func() error, error) {
+	// fetch the contracts our dataset currently lives on
+	var contracts []api.ContractMetadata
+	if err := withSaneTimeout(func(ctx context.Context) (err error) {
+		contracts, err = bc.Contracts(ctx, api.ContractsOpts{})
+		return
+	}, nil); err != nil {
+		return "", nil, err
+	} else if len(contracts) == 0 {
+		return "", nil, errors.New("no contracts to expire")
+	}
+
+	// find the height at which all of them have expired
+	var expiry uint64
+	for _, c := range contracts {
+		if c.WindowEnd > expiry {
+			expiry = c.WindowEnd
+		}
+	}
+
+	// mine past that height, a few blocks at a time so the autopilot gets
+	// the chance to renew the contracts
+	deadline := time.Now().Add(cfg.Chaos.HealthTimeout)
+	for {
+		var height uint64
+		if err := withSaneTimeout(func(ctx context.Context) error {
+			cs, err := bc.ConsensusState(ctx)
+			height = cs.BlockHeight
+			return err
+		}, nil); err != nil {
+			return "", nil, err
+		} else if height > expiry {
+			break
+		} else if time.Now().After(deadline) {
+			return "", nil, fmt.Errorf("contracts did not expire within %v, height %d, expiry %d", cfg.Chaos.HealthTimeout, height, expiry)
+		}
+
+		p.logger.Debugf("mining towards the expiry of %d contracts at height %d, current height %d", len(contracts), expiry, height)
+		if err := c.mineBlocks(chaosExpiryBlocks); err != nil {
+			return "", nil, fmt.Errorf("failed to mine blocks; %w", err)
+		}
+		time.Sleep(cfg.Chaos.PollInterval)
+	}
+
+	return fmt.Sprintf("let %d contracts expire at height %d", len(contracts), expiry), nil, nil
+}
+
+func takeHostOffline(p *profile, c *chaosCluster) (string, func() error, error) {
+	hk, roots, err := randomChaosHost(p, c)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := c.removeHost(hk); err != nil {
+		return "", nil, fmt.Errorf("failed to remove host %v; %w", hk, err)
+	}
+
+	// replace the host once we're done so the next scenarios run against a
+	// cluster of the same size
+	restore := func() error { return c.addHosts(1) }
+
+	// the dataset only becomes unhealthy once renterd stops considering the
+	// host's contract good, wait for that before checking for recovery
+	if err := waitFor(cfg.Chaos.HealthTimeout, func(ctx context.Context) error {
+		contracts, err := bc.Contracts(ctx, api.ContractsOpts{FilterMode: api.ContractFilterModeGood})
+		if err != nil {
+			return err
+		}
+		for _, c := range contracts {
+			if c.HostKey == hk {
+				return fmt.Errorf("contract with host %v is still good", hk)
+			}
+		}
+		return nil
+	}); err != nil {
+		return "", restore, err
+	}
+
+	return fmt.Sprintf("took host %v storing %d sampled sectors offline", hk, len(roots)), restore, nil
+}
+
+func changeRedundancy(p *profile, c *chaosCluster) (string, func() error, error) {
+	// fetch the current settings
+	var us api.UploadSettings
+	if err := withSaneTimeout(func(ctx context.Context) (err error) {
+		us, err = bc.UploadSettings(ctx)
+		return
+	}, nil); err != nil {
+		return "", nil, err
+	}
+	prev := us.Redundancy
+
+	// default to adding a parity shard
+	us.Redundancy = api.RedundancySettings{MinShards: cfg.Chaos.MinShards, TotalShards: cfg.Chaos.TotalShards}
+	if us.Redundancy.MinShards == 0 {
+		us.Redundancy.MinShards = prev.MinShards
+	}
+	if us.Redundancy.TotalShards == 0 {
+		us.Redundancy.TotalShards = prev.TotalShards + 1
+	}
+
+	// update the settings
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		return bc.UpdateUploadSettings(ctx, us)
+	}, nil); err != nil {
+		return "", nil, err
+	}
+	restore := func() error {
+		us.Redundancy = prev
+		if err := withSaneTimeout(func(ctx context.Context) error {
+			return bc.UpdateUploadSettings(ctx, us)
+		}, nil); err != nil {
+			return err
+		}
+		return p.refreshRedundancy()
+	}
+
+	// upload a file with the new settings, the dataset now mixes both
+	if err := p.refreshRedundancy(); err != nil {
+		return "", restore, err
+	} else if _, err := p.uploadFile(p.Bucket, p.MaxFilesize); err != nil {
+		return "", restore, fmt.Errorf("failed to upload with the new redundancy; %w", err)
+	}
+
+	return fmt.Sprintf("changed redundancy from %d-of-%d to %d-of-%d", prev.MinShards, prev.TotalShards, us.Redundancy.MinShards, us.Redundancy.TotalShards), restore, nil
+}
+
+func corruptSectors(p *profile, c *chaosCluster) (string, func() error, error) {
+	hk, roots, err := randomChaosHost(p, c)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(roots) > cfg.Chaos.CorruptSectors {
+		roots = roots[:cfg.Chaos.CorruptSectors]
+	}
+	for _, root := range roots {
+		if err := c.corruptSector(hk, root); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return fmt.Sprintf("corrupted %d sectors on host %v", len(roots), hk), nil, nil
+}
+
+func deleteSectors(p *profile, c *chaosCluster) (string, func() error, error) {
+	hk, roots, err := randomChaosHost(p, c)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(roots) > cfg.Chaos.DeleteSectors {
+		roots = roots[:cfg.Chaos.DeleteSectors]
+	}
+	for _, root := range roots {
+		if err := c.deleteSector(hk, root); err != nil {
+			return "", nil, fmt.Errorf("failed to delete sector %v; %w", root, err)
+		}
+	}
+
+	return fmt.Sprintf("deleted %d sectors from host %v", len(roots), hk), nil, nil
+}
+
+// randomChaosHost picks a random host of the cluster that stores sectors of a
+// sample of the profile's dataset, it returns the roots of those sectors in
+// random order. Sectors renterd expects on a host but that an earlier
+// scenario removed are skipped.
+func randomChaosHost(p *profile, c *chaosCluster) (types.PublicKey, []types.Hash256, error) {
+	expected, err := sampledSectorRoots(p)
+	if err != nil {
+		return types.PublicKey{}, nil, err
+	}
+
+	hks := c.hostKeys()
+	frand.Shuffle(len(hks), func(i, j int) { hks[i], hks[j] = hks[j], hks[i] })
+	for _, hk := range hks {
+		var roots []types.Hash256
+		for _, root := range expected[hk] {
+			if c.storesSector(hk, root) {
+				roots = append(roots, root)
+			}
+		}
+		if len(roots) > 0 {
+			frand.Shuffle(len(roots), func(i, j int) { roots[i], roots[j] = roots[j], roots[i] })
+			return hk, roots, nil
+		}
+	}
+	return types.PublicKey{}, nil, errors.New("no host stores sectors of the sampled objects")
+}
+
+// sampledSectorRoots returns the roots of the sectors of a sample of the
+// profile's dataset, by the host that stores them.
+func sampledSectorRoots(p *profile) (map[types.PublicKey][]types.Hash256, error) {
+	entries, err := p.calculateRandomBatch(cfg.Chaos.CheckSize)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := make(map[types.PublicKey][]types.Hash256)
+	for _, entry := range entries {
+		var obj api.Object
+		if err := withSaneTimeout(func(ctx context.Context) (err error) {
+			obj, err = bc.Object(ctx, p.Bucket, entry.Key, api.GetObjectOptions{})
+			return
+		}, nil); err != nil {
+			return nil, err
+		} else if obj.Object == nil {
+			continue
+		}
+
+		for _, slab := range obj.Slabs {
+			for _, sector := range slab.Shards {
+				for hk := range sector.Contracts {
+					roots[hk] = append(roots[hk], sector.Root)
+				}
+			}
+		}
+	}
+	return roots, nil
+}
+
+func saveChaosReports(reports []chaosReport, path string) error {
+	// open the file
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to open chaos report file at '%s', err: %v", path, err)
+	}
+	defer f.Close()
+
+	// encode the reports
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(reports)
+}
@@ -0,0 +1,73 @@
+//go:build cgo
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	rhpv2 "go.sia.tech/core/rhp/v2"
+)
+
+func TestChaosScenarios(t *testing.T) {
+	c := newTestCluster(t, chaosMinHosts)
+	cfg.Chaos.DatasetSize = 1 << 24 // 16 MiB
+	cfg.Chaos.CheckSize = 1 << 24
+	cfg.Chaos.PollInterval = 100 * time.Millisecond
+	cfg.Chaos.HealthTimeout = 5 * time.Minute
+
+	p := newClusterProfile(t, transportWorker)
+	p.MaxFilesize = 1 << 22 // 4 MiB
+	if _, _, err := p.ensureDataset(cfg.Chaos.DatasetSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// every scenario breaks the cluster in a way renterd recovers from
+	// without the checks ever observing corruption or unavailable data
+	for _, name := range defaultConfig.Chaos.Scenarios {
+		t.Run(name, func(t *testing.T) {
+			report := p.runChaosScenario(name, chaosScenarios[name], c)
+			if report.Err != nil {
+				t.Fatal(report.Err)
+			} else if report.Description == "" {
+				t.Fatal("expected a description of the fault")
+			} else if !report.Passed {
+				t.Fatalf("expected scenario to pass, report: %+v", report)
+			} else if report.Checks == 0 {
+				t.Fatal("expected the dataset to be checked")
+			}
+
+			// losing a host degrades the dataset until it's migrated
+			if name == chaosScenarioHostOffline && report.MinHealth >= 1 {
+				t.Fatalf("expected the dataset to degrade, report: %+v", report)
+			}
+		})
+	}
+
+	// a corrupted sector is served as is by the host, the checks above only
+	// pass because the worker rejects it
+	hk, roots, err := randomChaosHost(p, c)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := c.corruptSector(hk, roots[0]); err != nil {
+		t.Fatal(err)
+	}
+	h, err := c.host(hk)
+	if err != nil {
+		t.Fatal(err)
+	} else if sector, err := h.storage.ReadSector(roots[0]); err != nil {
+		t.Fatal(err)
+	} else if rhpv2.SectorRoot(sector) == roots[0] {
+		t.Fatal("expected the sector to be corrupted")
+	}
+
+	// the cluster still has the same number of hosts and every object is
+	// healthy
+	if hosts := len(c.hostKeys()); hosts != chaosMinHosts {
+		t.Fatalf("expected %d hosts, got %d", chaosMinHosts, hosts)
+	} else if health, err := p.datasetHealth(); err != nil {
+		t.Fatal(err)
+	} else if health < 1 {
+		t.Fatalf("expected a healthy dataset, got %.2f", health)
+	}
+}
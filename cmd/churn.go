@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"go.sia.tech/renterd/api"
+	"lukechampine.com/frand"
+)
+
+const (
+	churnRename       = "rename"
+	churnPrefixRename = "prefixRename"
+	churnCopy         = "copy"
+	churnOverwrite    = "overwrite"
+)
+
+// churnOperations are the operations the churn phase picks from, every
+// operation verifies its outcome.
+var churnOperations = map[string]func(p *profile, entry api.ObjectMetadata) error{
+	churnRename:       (*profile).churnRename,
+	churnPrefixRename: (*profile).churnPrefixRename,
+	churnCopy:         (*profile).churnCopy,
+	churnOverwrite:    (*profile).churnOverwrite,
+}
+
+// churnDataset performs the configured number of random operations on random
+// objects of the dataset, it returns the number of operations performed.
+func (p *profile) churnDataset(n int) (churned int, _ error) {
+	entries, err := p.fetchEntries()
+	if err != nil {
+		return 0, err
+	} else if len(entries) == 0 {
+		return 0, nil
+	}
+
+	ops := sortedKeys(churnOperations)
+	frand.Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+	for i := 0; churned < n && i < len(entries); i++ {
+		// objects used by another phase are left alone, every operation but
+		// a copy moves the object away from its key
+		key := entries[i].Key
+		if !p.locks.lockObject(key) {
+			p.logger.Debugf("churn: skipping '%s', it's used by another phase", key)
+			continue
+		}
+		op := ops[frand.Intn(len(ops))]
+		p.logger.Debugf("churn: %s '%s'", op, key)
+		err := churnOperations[op](p, entries[i])
+		if op != churnCopy {
+			p.locks.objectRemoved(key)
+		}
+		p.locks.unlockObject(key)
+		if err != nil {
+			return churned, fmt.Errorf("churn %s of '%s' failed; %w", op, key, err)
+		}
+		churned++
+	}
+	return
+}
+
+// churnRename renames the object and verifies it moved.
+func (p *profile) churnRename(entry api.ObjectMetadata) error {
+	to := p.churnKey("renamed", entry.Key)
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		return bc.RenameObject(ctx, p.Bucket, entry.Key, to, false)
+	}, nil); err != nil {
+		return err
+	}
+	p.moveVerified(entry.Key, to)
+	return p.verifyMoved(entry.Key, to, entry.Size)
+}
+
+// churnPrefixRename moves the object into its own directory and renames that
+// directory, verifying the object moved along with it.
+func (p *profile) churnPrefixRename(entry api.ObjectMetadata) error {
+	from := p.churnKey("dir", entry.Key)
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		return bc.RenameObject(ctx, p.Bucket, entry.Key, from, false)
+	}, nil); err != nil {
+		return err
+	}
+
+	fromDir := path.Dir(from) + "/"
+	toDir := p.churnKey("dir", "") + "/"
+	to := toDir + path.Base(from)
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		return bc.RenameObjects(ctx, p.Bucket, fromDir, toDir, false)
+	}, nil); err != nil {
+		return err
+	}
+	p.moveVerified(entry.Key, to)
+	if err := p.verifyMoved(entry.Key, to, entry.Size); err != nil {
+		return err
+	}
+	return p.verifyGone(from)
+}
+
+// churnCopy copies the object server-side and verifies both the source and
+// the copy serve the original data.
+func (p *profile) churnCopy(entry api.ObjectMetadata) error {
+	to := p.churnKey("copied", entry.Key)
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		src, err := bc.Object(ctx, p.Bucket, entry.Key, api.GetObjectOptions{OnlyMetadata: true})
+		if err != nil {
+			return err
+		}
+		_, err = bc.CopyObject(ctx, p.Bucket, p.Bucket, entry.Key, to, api.CopyObjectOptions{
+			MimeType: src.MimeType,
+			Metadata: src.Metadata,
+		})
+		return err
+	}, nil); err != nil {
+		return err
+	}
+
+	if err := p.verifyObject(p.Bucket, entry.Key, entry.Size); err != nil {
+		return fmt.Errorf("source changed after copy; %w", err)
+	}
+	return p.verifyObject(p.Bucket, to, entry.Size)
+}
+
+// churnOverwrite uploads new content to the object's key and verifies the key
+// serves the new content rather than the stale one. The object is then
+// renamed to the key derived from its new content so it stays verifiable, if
+// that key is taken it's renamed to a key with a new suffix instead.
+func (p *profile) churnOverwrite(entry api.ObjectMetadata) error {
+	size := p.randomFileSize(p.MaxFilesize)
+	contentKey, err := p.uploadFileAs(p.Bucket, entry.Key, size)
+	if err != nil {
+		return err
+	}
+
+	// the new content can only be told apart from the stale content if they
+	// differ, e.g. the zeros generator yields the same content for the same
+	// size
+	hash, err := p.downloadFile(p.Bucket, entry.Key, size, nil)
+	expected := expectedHash(contentKey)
+	if err != nil {
+		return err
+	} else if stale := expectedHash(entry.Key); hash == stale && stale != expected {
+		return fmt.Errorf("overwritten file '%v' returned its stale content; %w", entry.Key, errIntegrity)
+	} else if hash != expected {
+		return fmt.Errorf("hash mismatch for overwritten file '%v', expected '%v', got '%v'; %w", entry.Key, expected, hash, errIntegrity)
+	}
+
+	to := "/" + strings.TrimPrefix(contentKey, "/")
+	for attempt := 1; ; attempt++ {
+		err := withSaneTimeout(func(ctx context.Context) error {
+			return bc.RenameObject(ctx, p.Bucket, entry.Key, to, false)
+		}, nil)
+		if err == nil {
+			break
+		} else if !strings.Contains(err.Error(), api.ErrObjectExists.Error()) || attempt == 3 {
+			return fmt.Errorf("failed to rename '%v' to '%v'; %w", entry.Key, to, err)
+		}
+		to = withNewSuffix(to)
+	}
+	p.moveVerified(entry.Key, to)
+	return p.verifyMoved(entry.Key, to, size)
+}
+
+// churnKey returns a new unique key under the given directory of the profile's
+// prefix, the key keeps the name of the given key so its content can still be
+// verified.
+func (p *profile) churnKey(dir, key string) string {
+	k := p.remotePrefix() + dir + "/" + randomString()[:8]
+	if key != "" {
+		k += "/" + path.Base(key)
+	}
+	return k
+}
+
+func (p *profile) verifyMoved(from, to string, size int64) error {
+	if err := p.verifyObject(p.Bucket, to, size); err != nil {
+		return err
+	}
+	return p.verifyGone(from)
+}
+
+func (p *profile) verifyGone(key string) error {
+	return withSaneTimeout(func(ctx context.Context) error {
+		_, err := bc.Object(ctx, p.Bucket, key, api.GetObjectOptions{OnlyMetadata: true})
+		if err == nil {
+			return fmt.Errorf("object '%v' still exists after it was moved; %w", key, errIntegrity)
+		} else if !strings.Contains(err.Error(), api.ErrObjectNotFound.Error()) {
+			return err
+		}
+		return nil
+	}, nil)
+}
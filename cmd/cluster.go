@@ -0,0 +1,800 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/gateway"
+	rhpv2 "go.sia.tech/core/rhp/v2"
+	"go.sia.tech/core/types"
+	"go.sia.tech/coreutils"
+	"go.sia.tech/coreutils/chain"
+	rhp4 "go.sia.tech/coreutils/rhp/v4"
+	"go.sia.tech/coreutils/syncer"
+	"go.sia.tech/coreutils/testutil"
+	"go.sia.tech/coreutils/wallet"
+	"go.sia.tech/hostd/host/accounts"
+	"go.sia.tech/hostd/host/contracts"
+	"go.sia.tech/hostd/host/registry"
+	"go.sia.tech/hostd/host/settings"
+	"go.sia.tech/hostd/host/storage"
+	"go.sia.tech/hostd/index"
+	hsqlite "go.sia.tech/hostd/persist/sqlite"
+	hrhp "go.sia.tech/hostd/rhp"
+	hrhpv2 "go.sia.tech/hostd/rhp/v2"
+	hrhpv3 "go.sia.tech/hostd/rhp/v3"
+	"go.sia.tech/jape"
+	"go.sia.tech/renterd/alerts"
+	"go.sia.tech/renterd/api"
+	"go.sia.tech/renterd/autopilot"
+	"go.sia.tech/renterd/bus"
+	"go.sia.tech/renterd/bus/client"
+	rconfig "go.sia.tech/renterd/config"
+	"go.sia.tech/renterd/stores"
+	"go.sia.tech/renterd/stores/sql/sqlite"
+	"go.sia.tech/renterd/webhooks"
+	"go.sia.tech/renterd/worker"
+	"go.sia.tech/renterd/worker/s3"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/frand"
+)
+
+const (
+	clusterBlocksPerDay   = 144
+	clusterBlocksPerMonth = 30 * clusterBlocksPerDay
+
+	// clusterVolumeSectors is the size of every host's volume, volumes are
+	// sparse files so they only take up the space of the stored sectors
+	clusterVolumeSectors = 1 << 10 // 4 GiB
+
+	clusterS3AccessKeyID = "CHAOSCHAOSCHAOSCHAOS"
+)
+
+type (
+	// chaosCluster is an in-process renterd cluster with hostd hosts, all
+	// running on a test network where blocks are mined on demand. It's the
+	// cluster the chaos scenarios break.
+	chaosCluster struct {
+		dir    string
+		logger *zap.Logger
+
+		network *consensus.Network
+		genesis types.Block
+		cm      *chain.Manager
+		wk      types.PrivateKey
+
+		busAddr        string
+		busPassword    string
+		workerAddr     string
+		workerPassword string
+		s3Addr         string
+		s3SecretKey    string
+
+		bus    *bus.Client
+		worker *worker.Client
+
+		mu     sync.Mutex
+		hosts  []*clusterHost
+		nextID int
+
+		shutdownFns []func(context.Context) error
+		wg          sync.WaitGroup
+	}
+
+	// clusterHost is a hostd host of the chaos cluster.
+	clusterHost struct {
+		dir     string
+		privKey types.PrivateKey
+
+		s            *syncer.Syncer
+		syncerCancel context.CancelFunc
+
+		store     *hsqlite.Store
+		wallet    *wallet.SingleAddressWallet
+		settings  *settings.ConfigManager
+		storage   *storage.VolumeManager
+		index     *index.Manager
+		contracts *contracts.Manager
+
+		rhpv2        *hrhpv2.SessionHandler
+		rhpv3        *hrhpv3.SessionHandler
+		rhp4Listener net.Listener
+	}
+)
+
+// clusterHostSettings are the settings every host of the chaos cluster starts
+// with, they're well within the cluster's gouging settings.
+var clusterHostSettings = settings.Settings{
+	AcceptingContracts:  true,
+	MaxContractDuration: 3 * clusterBlocksPerMonth,
+	MaxCollateral:       types.Siacoins(5000),
+
+	ContractPrice: types.Siacoins(1).Div64(4),
+
+	BaseRPCPrice:      types.NewCurrency64(100),
+	SectorAccessPrice: types.NewCurrency64(100),
+
+	CollateralMultiplier: 2,
+	StoragePrice:         types.Siacoins(100).Div64(1e12).Div64(clusterBlocksPerMonth),
+	EgressPrice:          types.Siacoins(100).Div64(1e12),
+	IngressPrice:         types.Siacoins(100).Div64(1e12),
+	WindowSize:           5,
+
+	PriceTableValidity: 5 * time.Minute,
+
+	AccountExpiry:     30 * 24 * time.Hour,
+	MaxAccountBalance: types.Siacoins(10),
+}
+
+// newChaosCluster starts a renterd bus, worker and autopilot in dir, funds the
+// bus and waits until it formed contracts with the given number of hosts.
+func newChaosCluster(dir string, hosts int, logger *zap.Logger) (_ *chaosCluster, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	network, genesis := clusterNetwork()
+	chainStore, tipState, err := chain.NewDBStore(chain.NewMemDB(), network, genesis)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chain store; %w", err)
+	}
+
+	c := &chaosCluster{
+		dir:    dir,
+		logger: logger,
+
+		network: network,
+		genesis: genesis,
+		cm:      chain.NewManager(chainStore, tipState),
+		wk:      types.GeneratePrivateKey(),
+
+		busPassword:    hex.EncodeToString(frand.Bytes(16)),
+		workerPassword: hex.EncodeToString(frand.Bytes(16)),
+		s3SecretKey:    hex.EncodeToString(frand.Bytes(20)),
+	}
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	listen := func() (net.Listener, string, error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, "", err
+		}
+		return l, "http://" + l.Addr().String(), nil
+	}
+	busListener, busAddr, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	workerListener, workerAddr, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	s3Listener, s3Addr, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	c.busAddr, c.workerAddr, c.s3Addr = busAddr, workerAddr, s3Addr
+	c.bus = bus.NewClient(busAddr, c.busPassword)
+	c.worker = worker.NewClient(workerAddr, c.workerPassword)
+
+	// the bus and the worker derive their keys from the wallet key like
+	// renterd does, so the autopilot can renew the bus' contracts
+	masterKey := blake2b.Sum256(append([]byte("worker"), c.wk...))
+
+	// bus
+	b, err := c.newBus(ctx, masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bus; %w", err)
+	}
+	c.serve(&http.Server{Handler: jape.BasicAuth(c.busPassword)(b.Handler())}, busListener)
+
+	// worker
+	w, err := worker.New(rconfig.Worker{
+		AccountsRefillInterval:   10 * time.Millisecond,
+		CacheExpiry:              100 * time.Millisecond,
+		ID:                       "worker",
+		BusFlushInterval:         100 * time.Millisecond,
+		DownloadOverdriveTimeout: 500 * time.Millisecond,
+		UploadOverdriveTimeout:   500 * time.Millisecond,
+		DownloadMaxMemory:        1 << 28, // 256 MiB
+		UploadMaxMemory:          1 << 28, // 256 MiB
+		DownloadMaxOverdrive:     5,
+		UploadMaxOverdrive:       5,
+	}, masterKey, c.bus, logger.Named("worker"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create worker; %w", err)
+	}
+	c.shutdownFns = append(c.shutdownFns, w.Shutdown)
+	c.serve(&http.Server{Handler: jape.BasicAuth(c.workerPassword)(w.Handler())}, workerListener)
+
+	// s3
+	s3Handler, err := s3.New(c.bus, w, logger.Named("s3"), s3.Opts{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 handler; %w", err)
+	}
+	c.serve(&http.Server{Handler: s3Handler}, s3Listener)
+
+	// autopilot
+	ap, err := autopilot.New(rconfig.Autopilot{
+		AllowRedundantHostIPs: true,
+		Heartbeat:             time.Second,
+
+		MigratorAccountsRefillInterval:   10 * time.Millisecond,
+		MigratorHealthCutoff:             0.99,
+		MigratorNumThreads:               1,
+		MigratorDownloadMaxOverdrive:     5,
+		MigratorDownloadOverdriveTimeout: 500 * time.Millisecond,
+		MigratorUploadOverdriveTimeout:   500 * time.Millisecond,
+		MigratorUploadMaxOverdrive:       5,
+
+		ScannerInterval:   10 * time.Millisecond,
+		ScannerBatchSize:  10,
+		ScannerNumThreads: 1,
+	}, masterKey, c.bus, logger.Named("autopilot"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create autopilot; %w", err)
+	}
+	c.shutdownFns = append(c.shutdownFns, ap.Shutdown)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ap.Run()
+	}()
+
+	// configure the cluster, the autopilot forms a contract with every host
+	if err := c.bus.UpdateAutopilotConfig(ctx,
+		client.WithContractsConfig(api.ContractsConfig{
+			Amount:      uint64(hosts),
+			Period:      clusterBlocksPerDay,
+			RenewWindow: clusterBlocksPerDay / 2,
+
+			Download: rhpv2.SectorSize * 500,
+			Upload:   rhpv2.SectorSize * 500,
+			Storage:  rhpv2.SectorSize * 5e3,
+		}),
+		client.WithHostsConfig(api.HostsConfig{
+			MaxDowntimeHours:           10,
+			MaxConsecutiveScanFailures: 10,
+		}),
+		client.WithAutopilotEnabled(true),
+	); err != nil {
+		return nil, fmt.Errorf("failed to update autopilot config; %w", err)
+	}
+	if err := c.bus.UpdateGougingSettings(ctx, api.GougingSettings{
+		MaxRPCPrice:      types.Siacoins(1).Div64(1000),
+		MaxContractPrice: types.Siacoins(10),
+		MaxDownloadPrice: types.Siacoins(1000).Div64(1e12),
+		MaxUploadPrice:   types.Siacoins(1000).Div64(1e12),
+		MaxStoragePrice:  types.Siacoins(1000).Div64(1e12).Div64(clusterBlocksPerMonth),
+
+		HostBlockHeightLeeway: 240,
+
+		MinPriceTableValidity:         api.DurationMS(10 * time.Second),
+		MinAccountExpiry:              api.DurationMS(time.Hour),
+		MinMaxEphemeralAccountBalance: types.Siacoins(1),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to update gouging settings; %w", err)
+	}
+	if err := c.bus.UpdateUploadSettings(ctx, api.UploadSettings{
+		Redundancy: api.RedundancySettings{MinShards: 2, TotalShards: 3},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to update upload settings; %w", err)
+	}
+	if err := c.bus.UpdateS3Settings(ctx, api.S3Settings{
+		Authentication: api.S3AuthenticationSettings{
+			V4Keypairs: map[string]string{clusterS3AccessKeyID: c.s3SecretKey},
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to update s3 settings; %w", err)
+	}
+
+	// mine until the first block reward matures
+	if err := c.mineBlocks(network.HardforkFoundation.Height + network.MaturityDelay + 10); err != nil {
+		return nil, fmt.Errorf("failed to fund the bus; %w", err)
+	}
+
+	// add the hosts and wait for contracts and funded accounts
+	if err := c.addHosts(hosts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyTo points the config at the cluster.
+func (c *chaosCluster) applyTo(cfg *config) {
+	cfg.BusAddr, cfg.BusPassw, cfg.BusPasswFile = c.busAddr, c.busPassword, ""
+	cfg.WorkerAddr, cfg.WorkerPassw, cfg.WorkerPasswFile = c.workerAddr, c.workerPassword, ""
+	cfg.S3.Address, cfg.S3.AccessKeyID, cfg.S3.SecretKey, cfg.S3.SecretKeyFile = c.s3Addr, clusterS3AccessKeyID, c.s3SecretKey, ""
+}
+
+// Close shuts down the cluster.
+func (c *chaosCluster) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var errs []error
+	for i := len(c.shutdownFns) - 1; i >= 0; i-- {
+		errs = append(errs, c.shutdownFns[i](ctx))
+	}
+	c.shutdownFns = nil
+
+	c.mu.Lock()
+	for _, h := range c.hosts {
+		errs = append(errs, h.Close())
+	}
+	c.hosts = nil
+	c.mu.Unlock()
+
+	c.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// hostKeys returns the public keys of the cluster's hosts.
+func (c *chaosCluster) hostKeys() (hks []types.PublicKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range c.hosts {
+		hks = append(hks, h.privKey.PublicKey())
+	}
+	return
+}
+
+// addHosts adds n hosts to the cluster and waits until the bus formed
+// contracts with them and funded their accounts.
+func (c *chaosCluster) addHosts(n int) error {
+	var added []types.PublicKey
+	for i := 0; i < n; i++ {
+		h, err := c.addHost()
+		if err != nil {
+			return fmt.Errorf("failed to add host; %w", err)
+		}
+		added = append(added, h.privKey.PublicKey())
+	}
+
+	return waitFor(3*time.Minute, func(ctx context.Context) error {
+		contracts, err := c.bus.Contracts(ctx, api.ContractsOpts{FilterMode: api.ContractFilterModeGood})
+		if err != nil {
+			return err
+		}
+		formed := make(map[types.PublicKey]struct{})
+		for _, c := range contracts {
+			formed[c.HostKey] = struct{}{}
+		}
+
+		accounts, err := c.worker.Accounts(ctx)
+		if err != nil {
+			return err
+		}
+		funded := make(map[types.PublicKey]struct{})
+		for _, a := range accounts {
+			if a.Balance.Sign() > 0 {
+				funded[a.HostKey] = struct{}{}
+			}
+		}
+
+		for _, hk := range added {
+			if _, ok := formed[hk]; !ok {
+				return fmt.Errorf("no contract with host %v", hk)
+			} else if _, ok := funded[hk]; !ok {
+				return fmt.Errorf("no funded account with host %v", hk)
+			}
+		}
+		return nil
+	})
+}
+
+// removeHost shuts down the host and removes it from the cluster, its data is
+// lost.
+func (c *chaosCluster) removeHost(hk types.PublicKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, h := range c.hosts {
+		if h.privKey.PublicKey() == hk {
+			c.hosts = append(c.hosts[:i], c.hosts[i+1:]...)
+			return h.Close()
+		}
+	}
+	return fmt.Errorf("host %v not found", hk)
+}
+
+// storesSector returns whether the host stores the sector.
+func (c *chaosCluster) storesSector(hk types.PublicKey, root types.Hash256) bool {
+	h, err := c.host(hk)
+	if err != nil {
+		return false
+	}
+	_, err = h.store.SectorLocation(root)
+	return err == nil
+}
+
+// corruptSector overwrites part of a sector in the host's volume, hosts don't
+// cache sectors so the host serves the corrupted data.
+func (c *chaosCluster) corruptSector(hk types.PublicKey, root types.Hash256) error {
+	h, err := c.host(hk)
+	if err != nil {
+		return err
+	}
+	loc, err := h.store.SectorLocation(root)
+	if err != nil {
+		return fmt.Errorf("failed to locate sector %v; %w", root, err)
+	}
+	vol, err := h.storage.Volume(loc.Volume)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(vol.LocalPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	garbage := frand.Bytes(1 << 12)
+	offset := int64(loc.Index)*rhpv2.SectorSize + int64(frand.Intn(rhpv2.SectorSize-len(garbage)))
+	if _, err := f.WriteAt(garbage, offset); err != nil {
+		return fmt.Errorf("failed to corrupt sector %v; %w", root, err)
+	}
+	return f.Sync()
+}
+
+// deleteSector removes a sector from the host's volume.
+func (c *chaosCluster) deleteSector(hk types.PublicKey, root types.Hash256) error {
+	h, err := c.host(hk)
+	if err != nil {
+		return err
+	}
+	return h.storage.RemoveSector(root)
+}
+
+// mineBlocks mines n blocks and waits for the bus to catch up.
+func (c *chaosCluster) mineBlocks(n uint64) error {
+	addr := types.StandardUnlockHash(c.wk.PublicKey())
+	for i := uint64(0); i < n; i++ {
+		block, found := coreutils.MineBlock(c.cm, addr, 5*time.Second)
+		if !found {
+			return errors.New("failed to mine block")
+		}
+		if err := withSaneTimeout(func(ctx context.Context) error {
+			return c.bus.AcceptBlock(ctx, block)
+		}, nil); err != nil {
+			return err
+		}
+	}
+
+	tip := c.cm.Tip()
+	return waitFor(time.Minute, func(ctx context.Context) error {
+		cs, err := c.bus.ConsensusState(ctx)
+		if err != nil {
+			return err
+		} else if !cs.Synced || cs.BlockHeight < tip.Height {
+			return fmt.Errorf("bus is at height %d, tip is %d", cs.BlockHeight, tip.Height)
+		}
+		w, err := c.bus.Wallet(ctx)
+		if err != nil {
+			return err
+		} else if w.ScanHeight < tip.Height {
+			return fmt.Errorf("wallet is at height %d, tip is %d", w.ScanHeight, tip.Height)
+		}
+		return nil
+	})
+}
+
+func (c *chaosCluster) host(hk types.PublicKey) (*clusterHost, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range c.hosts {
+		if h.privKey.PublicKey() == hk {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("host %v not found", hk)
+}
+
+// addHost starts a host, funds it and announces it.
+func (c *chaosCluster) addHost() (*clusterHost, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c.mu.Lock()
+	c.nextID++
+	dir := filepath.Join(c.dir, "hosts", fmt.Sprint(c.nextID))
+	c.mu.Unlock()
+
+	h, err := newClusterHost(types.GeneratePrivateKey(), c.cm, dir, c.genesis)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.hosts = append(c.hosts, h)
+	c.mu.Unlock()
+
+	// connect to the bus
+	if err := c.bus.SyncerConnect(ctx, string(h.s.Addr())); err != nil {
+		return nil, err
+	}
+
+	// fund the host
+	for i := 0; i < 5; i++ {
+		if _, err := c.bus.SendSiacoins(ctx, h.wallet.Address(), types.Siacoins(5e3), true); err != nil {
+			return nil, fmt.Errorf("failed to fund host; %w", err)
+		}
+	}
+	if err := c.mineBlocks(1); err != nil {
+		return nil, err
+	} else if err := waitFor(time.Minute, func(context.Context) error {
+		if balance, err := h.wallet.Balance(); err != nil {
+			return err
+		} else if balance.Confirmed.IsZero() {
+			return errors.New("host wallet not funded")
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// add a volume and announce the host
+	volumeDir := filepath.Join(dir, "volumes")
+	if err := os.MkdirAll(volumeDir, 0700); err != nil {
+		return nil, err
+	}
+	result := make(chan error, 1)
+	if _, err := h.storage.AddVolume(ctx, filepath.Join(volumeDir, "volume.dat"), clusterVolumeSectors, result); err != nil {
+		return nil, err
+	} else if err := <-result; err != nil {
+		return nil, err
+	}
+	hs := h.settings.Settings()
+	hs.NetAddress = h.rhp4Listener.Addr().(*net.TCPAddr).IP.String()
+	if err := h.settings.UpdateSettings(hs); err != nil {
+		return nil, err
+	} else if err := h.settings.Announce(); err != nil {
+		return nil, err
+	}
+
+	// wait for the bus to see the announcement
+	if err := c.mineBlocks(1); err != nil {
+		return nil, err
+	}
+	return h, waitFor(time.Minute, func(ctx context.Context) error {
+		_, err := c.bus.Host(ctx, h.privKey.PublicKey())
+		return err
+	})
+}
+
+func (c *chaosCluster) newBus(ctx context.Context, masterKey [32]byte) (*bus.Bus, error) {
+	busDir := filepath.Join(c.dir, "bus")
+	dbDir := filepath.Join(busDir, "db")
+	if err := os.MkdirAll(dbDir, 0700); err != nil {
+		return nil, err
+	}
+	partialSlabDir := filepath.Join(busDir, "partial_slabs")
+
+	// databases
+	conn, err := sqlite.Open(filepath.Join(dbDir, "db.sqlite"))
+	if err != nil {
+		return nil, err
+	}
+	dbMain, err := sqlite.NewMainDatabase(conn, c.logger, time.Second, time.Second, partialSlabDir)
+	if err != nil {
+		return nil, err
+	}
+	connMetrics, err := sqlite.Open(filepath.Join(dbDir, "metrics.sqlite"))
+	if err != nil {
+		return nil, err
+	}
+	dbMetrics, err := sqlite.NewMetricsDatabase(connMetrics, c.logger, time.Second, time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	alertsMgr := alerts.NewManager()
+	sqlStore, err := stores.NewSQLStore(stores.Config{
+		Alerts:            alerts.WithOrigin(alertsMgr, "bus"),
+		DB:                dbMain,
+		DBMetrics:         dbMetrics,
+		PartialSlabDir:    partialSlabDir,
+		Migrate:           true,
+		Logger:            c.logger,
+		WalletAddress:     types.StandardUnlockHash(c.wk.PublicKey()),
+		LongQueryDuration: time.Second,
+		LongTxDuration:    time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.shutdownFns = append(c.shutdownFns, func(context.Context) error { return sqlStore.Close() })
+
+	wh, err := webhooks.NewManager(sqlStore, c.logger)
+	if err != nil {
+		return nil, err
+	}
+	alertsMgr.RegisterWebhookBroadcaster(wh)
+
+	w, err := wallet.NewSingleAddressWallet(c.wk, c.cm, sqlStore, wallet.WithReservationDuration(time.Minute))
+	if err != nil {
+		return nil, err
+	}
+	c.shutdownFns = append(c.shutdownFns, func(context.Context) error { return w.Close() })
+
+	// syncer
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := syncer.New(l, c.cm, sqlStore, gateway.Header{
+		GenesisID:  c.genesis.ID(),
+		UniqueID:   gateway.GenerateUniqueID(),
+		NetAddress: l.Addr().String(),
+	}, syncer.WithLogger(c.logger.Named("syncer")), syncer.WithSendBlocksTimeout(time.Minute))
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		_ = s.Run(context.Background())
+	}()
+	c.shutdownFns = append(c.shutdownFns, func(context.Context) error { return s.Close() })
+
+	b, err := bus.New(ctx, rconfig.Bus{
+		AllowPrivateIPs:         true,
+		AnnouncementMaxAgeHours: 24 * 7 * 52,
+		GatewayAddr:             l.Addr().String(),
+		UsedUTXOExpiry:          time.Minute,
+	}, masterKey, alertsMgr, wh, c.cm, s, w, sqlStore, "", c.logger.Named("bus"))
+	if err != nil {
+		return nil, err
+	}
+	c.shutdownFns = append(c.shutdownFns, b.Shutdown)
+	return b, nil
+}
+
+// serve serves the handler on the listener until the cluster is closed.
+func (c *chaosCluster) serve(srv *http.Server, l net.Listener) {
+	c.shutdownFns = append(c.shutdownFns, srv.Shutdown)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		_ = srv.Serve(l)
+	}()
+}
+
+// newClusterHost starts a host in dir, the host doesn't cache sectors so the
+// data it serves always comes from its volume.
+func newClusterHost(privKey types.PrivateKey, cm *chain.Manager, dir string, genesis types.Block) (_ *clusterHost, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	h := &clusterHost{dir: dir, privKey: privKey}
+	var closers []func() error
+	defer func() {
+		if err != nil {
+			for i := len(closers) - 1; i >= 0; i-- {
+				closers[i]()
+			}
+		}
+	}()
+	listen := func() (net.Listener, error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			closers = append(closers, l.Close)
+		}
+		return l, err
+	}
+
+	// syncer
+	l, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	h.s = syncer.New(l, cm, testutil.NewEphemeralPeerStore(), gateway.Header{
+		GenesisID:  genesis.ID(),
+		UniqueID:   gateway.GenerateUniqueID(),
+		NetAddress: l.Addr().String(),
+	}, syncer.WithPeerDiscoveryInterval(100*time.Millisecond), syncer.WithSyncInterval(100*time.Millisecond))
+	var syncerCtx context.Context
+	syncerCtx, h.syncerCancel = context.WithCancel(context.Background())
+	closers = append(closers, func() error { h.syncerCancel(); return nil })
+	go h.s.Run(syncerCtx)
+
+	log := zap.NewNop()
+	if h.store, err = hsqlite.OpenDatabase(filepath.Join(dir, "hostd.db"), log); err != nil {
+		return nil, err
+	}
+	closers = append(closers, h.store.Close)
+	if h.wallet, err = wallet.NewSingleAddressWallet(privKey, cm, h.store); err != nil {
+		return nil, err
+	}
+	closers = append(closers, h.wallet.Close)
+	if h.storage, err = storage.NewVolumeManager(h.store, storage.WithCacheSize(0)); err != nil {
+		return nil, err
+	}
+	closers = append(closers, h.storage.Close)
+	if h.contracts, err = contracts.NewManager(h.store, h.storage, cm, h.s, h.wallet, contracts.WithRejectAfter(10), contracts.WithRevisionSubmissionBuffer(5)); err != nil {
+		return nil, err
+	}
+	closers = append(closers, h.contracts.Close)
+
+	rhp2Listener, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	rhp3Listener, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	if h.rhp4Listener, err = listen(); err != nil {
+		return nil, err
+	}
+	port := func(l net.Listener) uint16 { return uint16(l.Addr().(*net.TCPAddr).Port) }
+	if h.settings, err = settings.NewConfigManager(privKey, h.store, cm, h.s, h.storage, h.wallet,
+		settings.WithValidateNetAddress(false),
+		settings.WithRHP2Port(port(rhp2Listener)),
+		settings.WithRHP3Port(port(rhp3Listener)),
+		settings.WithRHP4Port(port(h.rhp4Listener)),
+		settings.WithInitialSettings(clusterHostSettings),
+	); err != nil {
+		return nil, err
+	}
+	closers = append(closers, h.settings.Close)
+	if h.index, err = index.NewManager(h.store, cm, h.contracts, h.wallet, h.settings, h.storage, index.WithLog(log), index.WithBatchSize(0)); err != nil {
+		return nil, err
+	}
+
+	registry := registry.NewManager(privKey, h.store, log)
+	accounts := accounts.NewManager(h.store, h.settings)
+
+	h.rhpv2 = hrhpv2.NewSessionHandler(rhp2Listener, privKey, cm, h.s, h.wallet, h.contracts, h.settings, h.storage, log)
+	go h.rhpv2.Serve()
+	h.rhpv3 = hrhpv3.NewSessionHandler(rhp3Listener, privKey, cm, h.s, h.wallet, accounts, h.contracts, registry, h.storage, h.settings, log)
+	go h.rhpv3.Serve()
+	rhpv4 := rhp4.NewServer(privKey, cm, h.s, testutil.NewEphemeralContractor(cm), h.wallet, h.settings, h.storage, rhp4.WithPriceTableValidity(30*time.Minute))
+	go hrhp.ServeRHP4SiaMux(h.rhp4Listener, rhpv4, log)
+	return h, nil
+}
+
+// Close shuts down the host.
+func (h *clusterHost) Close() error {
+	h.rhpv2.Close()
+	h.rhpv3.Close()
+	h.rhp4Listener.Close()
+	h.settings.Close()
+	h.index.Close()
+	h.wallet.Close()
+	h.contracts.Close()
+	h.storage.Close()
+	h.store.Close()
+	h.syncerCancel()
+	return h.s.Close()
+}
+
+// clusterNetwork returns a test network based on Zen where blocks can be mined
+// quickly.
+func clusterNetwork() (*consensus.Network, types.Block) {
+	n, genesis := chain.TestnetZen()
+	n.InitialTarget = types.BlockID{0x80}
+	n.MinimumCoinbase = types.Siacoins(299990)
+	n.HardforkDevAddr.Height = 1
+	n.HardforkTax.Height = 1
+	n.HardforkStorageProof.Height = 1
+	n.HardforkOak.Height = 1
+	n.HardforkASIC.Height = 1
+	n.HardforkFoundation.Height = 1
+	n.HardforkV2.AllowHeight = 10000
+	n.HardforkV2.RequireHeight = 20000
+	n.MaturityDelay = 1
+	n.BlockInterval = 10 * time.Millisecond
+	return n, genesis
+}
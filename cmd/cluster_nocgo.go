@@ -0,0 +1,31 @@
+//go:build !cgo
+
+package main
+
+import (
+	"errors"
+
+	"go.sia.tech/core/types"
+	"go.uber.org/zap"
+)
+
+// errNoCluster is returned when the chaos cluster isn't available, renterd's
+// and hostd's databases need cgo.
+var errNoCluster = errors.New("chaos scenarios need a build with cgo enabled")
+
+// chaosCluster is only available in builds with cgo enabled.
+type chaosCluster struct{}
+
+func newChaosCluster(string, int, *zap.Logger) (*chaosCluster, error) {
+	return nil, errNoCluster
+}
+
+func (c *chaosCluster) applyTo(*config)                                    {}
+func (c *chaosCluster) Close() error                                       { return nil }
+func (c *chaosCluster) hostKeys() []types.PublicKey                        { return nil }
+func (c *chaosCluster) addHosts(int) error                                 { return errNoCluster }
+func (c *chaosCluster) removeHost(types.PublicKey) error                   { return errNoCluster }
+func (c *chaosCluster) storesSector(types.PublicKey, types.Hash256) bool   { return false }
+func (c *chaosCluster) corruptSector(types.PublicKey, types.Hash256) error { return errNoCluster }
+func (c *chaosCluster) deleteSector(types.PublicKey, types.Hash256) error  { return errNoCluster }
+func (c *chaosCluster) mineBlocks(uint64) error                            { return errNoCluster }
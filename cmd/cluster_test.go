@@ -0,0 +1,127 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.sia.tech/renterd/bus"
+	"go.sia.tech/renterd/worker"
+	"go.uber.org/zap"
+)
+
+// newTestCluster starts an in-process cluster with the given number of hosts
+// and points the config and the clients at it, they're restored when the test
+// finishes.
+func newTestCluster(t *testing.T, hosts int) *chaosCluster {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("the test runs against an in-process cluster")
+	}
+
+	prevStore, prevBus, prevWorker := store, bc, wc
+	t.Cleanup(func() { store, bc, wc = prevStore, prevBus, prevWorker })
+	store = newTestStore(t)
+
+	c, err := newChaosCluster(t.TempDir(), hosts, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := c.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	c.applyTo(&cfg)
+	cfg.WorkDir = t.TempDir()
+	bc = bus.NewClient(cfg.BusAddr, cfg.BusPassw)
+	wc = worker.NewClient(cfg.WorkerAddr, cfg.WorkerPassw)
+	return c
+}
+
+// newClusterProfile returns the default profile, prepared to upload to the
+// cluster through the given transport.
+func newClusterProfile(t *testing.T, transport string) *profile {
+	t.Helper()
+	cfg.Transport = transport
+	profiles, err := newProfiles("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := profiles[0]
+	p.logger = zap.NewNop().Sugar()
+	p.MaxFilesize = 1 << 20 // 1 MiB
+	if err := p.prepare(); err != nil {
+		t.Fatal(err)
+	} else if err := p.refreshRedundancy(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestClusterBuckets(t *testing.T) {
+	newTestCluster(t, 3)
+	p := newClusterProfile(t, transportWorker)
+	if _, err := p.uploadFile(p.Bucket, 1<<16); err != nil {
+		t.Fatal(err)
+	}
+
+	// a private bucket can't be read anonymously
+	if err := p.verifyBucketPolicy(); err != nil {
+		t.Fatal(err)
+	}
+
+	// once its policy is updated, it can
+	p.PublicReadAccess = true
+	if err := p.ensureBucket(); err != nil {
+		t.Fatal(err)
+	} else if b, err := bc.Bucket(context.Background(), p.Bucket); err != nil {
+		t.Fatal(err)
+	} else if !b.Policy.PublicReadAccess {
+		t.Fatal("expected the bucket to allow public reads")
+	} else if err := p.verifyBucketPolicy(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ephemeral bucket is populated, verified and deleted
+	p.BucketLifecycleObjects = 2
+	if err := p.testBucketLifecycle(); err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := bc.ListBuckets(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range buckets {
+		if strings.Contains(b.Name, "-lifecycle-") {
+			t.Fatalf("expected ephemeral bucket '%s' to be deleted", b.Name)
+		}
+	}
+}
+
+func TestClusterAttributes(t *testing.T) {
+	newTestCluster(t, 3)
+
+	// objects uploaded through either transport keep their content type and
+	// metadata, and their head matches the bus through both transports
+	for _, upload := range []string{transportWorker, transportS3} {
+		for _, head := range []string{transportWorker, transportS3} {
+			t.Run(upload+" to "+head, func(t *testing.T) {
+				p := newClusterProfile(t, upload)
+				key, err := p.uploadFile(p.Bucket, 1<<16)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				p.transport, err = newTransport(head)
+				if err != nil {
+					t.Fatal(err)
+				} else if err := p.verifyObject(p.Bucket, key, 1<<16); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.sia.tech/renterd/api"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+type command struct {
+	usage string
+	desc  string
+	run   func(args []string) int
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"run":    {"run", "periodically run the integrity checks (default)", runCmd},
+		"once":   {"once", "run a single integrity check and exit", onceCmd},
+		"verify": {"verify <key>", "download and check a single object", verifyCmd},
+		"status": {"status", "print the state", statusCmd},
+		"reset":  {"reset", "remove the dataset and reset the state", resetCmd},
+		"report": {"report", "print a summary of the results", reportCmd},
+		"chaos":  {"chaos", "run the configured chaos scenarios", chaosCmd},
+		"config": {"config print|validate", "print the effective config with secrets redacted, or validate it", configCmd},
+	}
+}
+
+func runCmd(args []string) int {
+	if len(args) != 0 {
+		return usageErr("run takes no arguments")
+	}
+	defer initialize(os.Stdout)()
+	profiles := initProfiles()
+
+	// load the states
+	states := make([]*state, len(profiles))
+	for i, p := range profiles {
+		s, err := store.loadState(p.Name)
+		if err != nil {
+			p.logger.Fatal(err)
+		}
+		p.reconcileInterruptedCycles(s)
+		states[i] = s
+	}
+
+	// remove all files
+	if cfg.CleanStart {
+		for i, p := range profiles {
+			if err := p.resetDataset(); err != nil {
+				p.logger.Fatal(err)
+			}
+			p.logger.Infof("resetting state")
+			if err := store.resetState(p.Name); err != nil {
+				p.logger.Fatal(err)
+			}
+			states[i] = &state{}
+		}
+	}
+
+	// spending is attributed from the most recent snapshot of any profile
+	for _, s := range states {
+		costs.seed(s)
+	}
+
+	// run the integrity checks
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	reloadChans := watchConfig(configPath, overrides, profiles, stopChan)
+	for i, p := range profiles {
+		go p.run(states[i], reloadChans[p.Name], stopChan)
+	}
+
+	// listen for interrupt signal
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	<-signalCh
+
+	logger.Info("Shutting down...")
+	return exitOK
+}
+
+func onceCmd(args []string) int {
+	if len(args) != 0 {
+		return usageErr("once takes no arguments")
+	}
+
+	// log to stderr, stdout is reserved for the summary, failures to
+	// initialize are reported as a failed summary for every profile
+	profiles, err := newProfiles(profileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	summaries := make([]onceSummary, len(profiles))
+	closeFn, err := setup(os.Stderr)
+	if closeFn != nil {
+		defer closeFn()
+	}
+	if err != nil {
+		if logger != nil {
+			logger.Error(err)
+		}
+		for i, p := range profiles {
+			summaries[i] = failedOnceSummary(p.Name, err)
+		}
+		return printOnceSummaries(os.Stdout, summaries)
+	}
+
+	// run the integrity checks of every profile concurrently
+	var wg sync.WaitGroup
+	for i, p := range profiles {
+		p.logger = logger.Named(p.Name)
+		wg.Add(1)
+		go func(i int, p *profile) {
+			defer wg.Done()
+
+			// prepare the profile and load its state
+			if err := p.prepare(); err != nil {
+				p.logger.Error(err)
+				summaries[i] = failedOnceSummary(p.Name, err)
+				return
+			}
+			s, err := store.loadState(p.Name)
+			if err != nil {
+				p.logger.Error(err)
+				summaries[i] = failedOnceSummary(p.Name, err)
+				return
+			}
+			p.reconcileInterruptedCycles(s)
+			costs.seed(s)
+
+			// run the integrity checks, phases with their own schedule run
+			// in the cycle if they're due
+			res := p.runCycle(s)
+			summaries[i] = newOnceSummary(p.Name, res)
+		}(i, p)
+	}
+	wg.Wait()
+	return printOnceSummaries(os.Stdout, summaries)
+}
+
+// printOnceSummaries prints the summaries to w and returns the exit code of
+// the once command.
+func printOnceSummaries(w io.Writer, summaries []onceSummary) int {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summaries); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode summary, err: %v\n", err)
+	}
+
+	// corruption takes precedence over other failures
+	code := exitOK
+	for _, summary := range summaries {
+		if summary.ExitCode == exitIntegrity || code == exitOK {
+			code = summary.ExitCode
+		}
+	}
+	return code
+}
+
+func verifyCmd(args []string) int {
+	if len(args) != 1 {
+		return usageErr("verify takes exactly one object key")
+	}
+	key := args[0]
+	defer initialize(os.Stdout)()
+
+	profiles := initProfiles()
+	if len(profiles) > 1 {
+		return usageErr("verify requires a single profile, use -profile to select one")
+	}
+	p := profiles[0]
+
+	// refresh redundancy
+	if err := p.refreshRedundancy(); err != nil {
+		p.logger.Fatal(err)
+	}
+
+	// fetch the object's size
+	var obj api.Object
+	if err := withSaneTimeout(func(ctx context.Context) (err error) {
+		obj, err = bc.Object(ctx, p.Bucket, key, api.GetObjectOptions{OnlyMetadata: true})
+		return
+	}, nil); err != nil {
+		p.logger.Errorf("failed to fetch object '%v', err: %v", key, err)
+		return exitFailure
+	}
+
+	// download and check the object
+	if err := p.verifyObject(p.Bucket, key, obj.Size); errors.Is(err, errIntegrity) {
+		p.logger.Error(err)
+		return exitIntegrity
+	} else if err != nil {
+		p.logger.Error(err)
+		return exitFailure
+	}
+	p.logger.Infof("object '%v' verified successfully", key)
+	return exitOK
+}
+
+func statusCmd(args []string) int {
+	if len(args) != 0 {
+		return usageErr("status takes no arguments")
+	}
+
+	profiles, err := newProfiles(profileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	closeFn, err := initStateStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer closeFn()
+
+	states := make(map[string]*state)
+	for _, p := range profiles {
+		s, err := store.loadState(p.Name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		states[p.Name] = s
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(states); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func resetCmd(args []string) int {
+	if len(args) != 0 {
+		return usageErr("reset takes no arguments")
+	}
+	defer initialize(os.Stdout)()
+
+	code := exitOK
+	for _, p := range initProfiles() {
+		if err := p.resetDataset(); err != nil {
+			p.logger.Error(err)
+			code = exitFailure
+			continue
+		}
+
+		p.logger.Infof("resetting state")
+		if err := store.resetState(p.Name); err != nil {
+			p.logger.Errorf("failed to reset state, err: %v", err)
+			code = exitFailure
+		}
+	}
+	return code
+}
+
+func reportCmd(args []string) int {
+	if len(args) != 0 {
+		return usageErr("report takes no arguments")
+	}
+
+	profiles, err := newProfiles(profileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	closeFn, err := initStateStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer closeFn()
+
+	for i, p := range profiles {
+		s, err := store.loadState(p.Name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+
+		// the report covers the full history
+		s.Results, err = store.results(p.Name, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("profile:            %s\n", p.Name)
+		fmt.Print(newReport(s.Results))
+		fmt.Print(s.Hosts)
+		fmt.Print(s.Phases)
+	}
+	return exitOK
+}
+
+func chaosCmd(args []string) int {
+	if len(args) != 0 {
+		return usageErr("chaos takes no arguments")
+	} else if profileName == "" && len(cfg.resolveProfiles()) > 1 {
+		return usageErr("chaos requires a single profile, use -profile to select one")
+	}
+
+	// start the in-process cluster and point the checker at it, the state of
+	// the run is kept with the cluster and removed along with it
+	dir, err := os.MkdirTemp("", "renterd-integrity-chaos")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer os.RemoveAll(dir)
+	c, err := newChaosCluster(dir, cfg.Chaos.Hosts, zap.NewNop())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start the chaos cluster, err: %v\n", err)
+		return exitFailure
+	}
+	defer c.Close()
+	c.applyTo(&cfg)
+	statePath = filepath.Join(dir, defaultStateFile)
+	defer initialize(os.Stdout)()
+	profiles := initProfiles()
+
+	reports, err := runChaosScenarios(profiles[0], c)
+	if err != nil {
+		logger.Error(err)
+		return exitFailure
+	}
+	if err := saveChaosReports(reports, defaultChaosReportFile); err != nil {
+		logger.Error(err)
+		return exitFailure
+	}
+
+	for _, report := range reports {
+		if !report.Passed {
+			return exitFailure
+		}
+	}
+	return exitOK
+}
+
+func configCmd(args []string) int {
+	if len(args) != 1 || (args[0] != "print" && args[0] != "validate") {
+		return usageErr("config expects the 'print' or 'validate' subcommand")
+	}
+
+	// the config was validated when it was loaded, what's left is checking
+	// that renterd is reachable
+	if args[0] == "validate" {
+		if problems := checkReachability(cfg, reachabilityTimeout); len(problems) > 0 {
+			fmt.Fprintf(os.Stderr, "invalid config:\n  - %s\n", strings.Join(problems, "\n  - "))
+			return exitFailure
+		}
+		fmt.Println("config is valid")
+		return exitOK
+	}
+
+	// print the profiles with their inherited settings
+	c := redactedConfig(cfg)
+	if len(c.Profiles) > 0 {
+		c.Profiles = c.resolveProfiles()
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	defer enc.Close()
+	if err := enc.Encode(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// onceSummary is printed to stdout by the once command, the status and exit
+// code distinguish data corruption from infrastructure failures.
+type onceSummary struct {
+	Profile  string `json:"profile"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exitCode"`
+	Result   result `json:"result"`
+}
+
+func newOnceSummary(profile string, res result) onceSummary {
+	summary := onceSummary{Profile: profile, Status: "ok", ExitCode: exitOK, Result: res}
+	if err := res.Error(); errors.Is(err, errIntegrity) {
+		summary.Status = "corrupted"
+		summary.ExitCode = exitIntegrity
+	} else if err != nil {
+		summary.Status = "failed"
+		summary.ExitCode = exitFailure
+	}
+	return summary
+}
+
+// failedOnceSummary returns the summary of a profile whose checks couldn't run.
+func failedOnceSummary(profile string, err error) onceSummary {
+	now := time.Now().UTC()
+	return newOnceSummary(profile, result{StartedAt: now, EndedAt: now, Err: &resultErr{err}})
+}
+
+func usageErr(msg string) int {
+	fmt.Fprintf(os.Stderr, "%s\n\n", msg)
+	usage()
+	return exitUsage
+}
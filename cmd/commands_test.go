@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		args     []string
+		usage    string
+		wantArgs []string
+		err      string
+	}{
+		{args: nil, usage: "run", wantArgs: []string{}},
+		{args: []string{"once"}, usage: "once", wantArgs: []string{}},
+		{args: []string{"verify", "data/key"}, usage: "verify <key>", wantArgs: []string{"data/key"}},
+		{args: []string{"config", "print"}, usage: "config print|validate", wantArgs: []string{"print"}},
+		{args: []string{"fsck"}, err: "unknown command 'fsck'"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.args), func(t *testing.T) {
+			cmd, args, err := findCommand(test.args)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if cmd.usage != test.usage {
+				t.Fatalf("expected command '%s', got '%s'", test.usage, cmd.usage)
+			} else if !reflect.DeepEqual(args, test.wantArgs) {
+				t.Fatalf("expected args %v, got %v", test.wantArgs, args)
+			}
+		})
+	}
+}
+
+func TestNewOnceSummary(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status string
+		code   int
+	}{
+		{"ok", nil, "ok", exitOK},
+		{"corrupted", fmt.Errorf("object 'data/key' has hash 'a', expected 'b'; %w", errIntegrity), "corrupted", exitIntegrity},
+		{"failed", errors.New("failed to fetch bus state"), "failed", exitFailure},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var res result
+			if test.err != nil {
+				res.Err = &resultErr{test.err}
+			}
+			if s := newOnceSummary("default", res); s.Status != test.status || s.ExitCode != test.code {
+				t.Fatalf("expected status '%s' and exit code %d, got '%s' and %d", test.status, test.code, s.Status, s.ExitCode)
+			} else if s.Profile != "default" {
+				t.Fatalf("expected profile 'default', got '%s'", s.Profile)
+			}
+		})
+	}
+
+	// a profile that couldn't run failed
+	if s := failedOnceSummary("default", errors.New("bucket not found")); s.ExitCode != exitFailure || s.Result.Err == nil {
+		t.Fatalf("expected a failed summary, got %+v", s)
+	}
+}
+
+func TestPrintOnceSummaries(t *testing.T) {
+	ok := newOnceSummary("ok", result{})
+	failed := failedOnceSummary("failed", errors.New("bus unreachable"))
+	corrupted := newOnceSummary("corrupted", result{Err: &resultErr{fmt.Errorf("mismatch; %w", errIntegrity)}})
+
+	tests := []struct {
+		name      string
+		summaries []onceSummary
+		code      int
+	}{
+		{"ok", []onceSummary{ok, ok}, exitOK},
+		{"failed", []onceSummary{ok, failed}, exitFailure},
+		{"corrupted", []onceSummary{corrupted, ok}, exitIntegrity},
+		{"corruption takes precedence", []onceSummary{failed, corrupted, ok}, exitIntegrity},
+		{"corruption is not overridden", []onceSummary{corrupted, failed}, exitIntegrity},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if code := printOnceSummaries(&buf, test.summaries); code != test.code {
+				t.Fatalf("expected exit code %d, got %d", test.code, code)
+			}
+
+			var printed []onceSummary
+			if err := json.Unmarshal(buf.Bytes(), &printed); err != nil {
+				t.Fatal(err)
+			} else if len(printed) != len(test.summaries) {
+				t.Fatalf("expected %d summaries, got %d", len(test.summaries), len(printed))
+			}
+			for i, s := range printed {
+				if s.Profile != test.summaries[i].Profile || s.ExitCode != test.summaries[i].ExitCode {
+					t.Fatalf("expected summary %+v, got %+v", test.summaries[i], s)
+				}
+			}
+		})
+	}
+}
+
+func TestOnceCmd(t *testing.T) {
+	prevCfg, prevLogPath, prevStatePath, prevLogger, prevStdout := cfg, logPath, statePath, logger, os.Stdout
+	t.Cleanup(func() {
+		cfg, logPath, statePath, logger, os.Stdout = prevCfg, prevLogPath, prevStatePath, prevLogger, prevStdout
+	})
+
+	// arguments are a usage error
+	flag.CommandLine.SetOutput(io.Discard)
+	t.Cleanup(func() { flag.CommandLine.SetOutput(nil) })
+	if code := onceCmd([]string{"now"}); code != exitUsage {
+		t.Fatalf("expected exit code %d, got %d", exitUsage, code)
+	}
+
+	// an unreachable bus is an infrastructure failure of every profile
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg = defaultConfig
+	cfg.BusAddr = srv.URL
+	cfg.Profiles = []profileConfig{{Name: "a"}, {Name: "b"}}
+	logPath = filepath.Join(dir, "checker.log")
+	statePath = filepath.Join(dir, "integrity.db")
+
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	os.Stdout = stdout
+	code := onceCmd(nil)
+	os.Stdout = prevStdout
+	if code != exitFailure {
+		t.Fatalf("expected exit code %d, got %d", exitFailure, code)
+	}
+
+	var summaries []onceSummary
+	if b, err := os.ReadFile(stdout.Name()); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(b, &summaries); err != nil {
+		t.Fatal(err)
+	} else if len(summaries) != 2 {
+		t.Fatalf("expected 2 summaries, got %d", len(summaries))
+	}
+	for _, s := range summaries {
+		if s.Status != "failed" || s.Result.Err == nil || !strings.Contains(s.Result.Err.Err.Error(), "failed to fetch bus state") {
+			t.Fatalf("expected a failed summary, got %+v", s)
+		}
+	}
+}
@@ -3,43 +3,131 @@ package main
 import (
 	"fmt"
 	"hash"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"time"
 
+	"go.sia.tech/renterd/bus"
+	"go.sia.tech/renterd/worker"
 	"gopkg.in/yaml.v3"
 )
 
 var (
-	cfg = config{
+	defaultConfig = config{
 		BusAddr:  "http://localhost:9880/api/bus",
 		BusPassw: "test",
 
 		WorkerAddr:  "http://localhost:9880/api/worker",
 		WorkerPassw: "test",
 
-		IntegrityCheckInterval:    time.Hour,
-		IntegrityCheckDownloadPct: 1, // 1% every hour
-		IntegrityCheckDeletePct:   1, // 1% every hour
+		profileConfig: profileConfig{
+			Name:      "default",
+			Bucket:    defaultBucketName,
+			Prefix:    "data",
+			Transport: transportWorker,
 
-		DatasetSize: 10 << 30, // 10 GiB
-		MinFilesize: 1 << 20,  // 1 MiB
-		MaxFilesize: 1 << 23,  // 8 MiB
+			IntegrityCheckInterval:    time.Hour,
+			IntegrityCheckDownloadPct: 1, // 1% every hour
+			IntegrityCheckDeletePct:   1, // 1% every hour
+
+			DatasetSize: 10 << 30, // 10 GiB
+			MinFilesize: 1 << 20,  // 1 MiB
+			MaxFilesize: 1 << 23,  // 8 MiB
+
+			FileSizeDistribution: sizeDistributionConfig{Type: distributionUniform},
+			ContentGenerators:    []string{contentRandom},
+
+			UploadConcurrency: 4,
+
+			PackedMaxFilesize: 1 << 12, // 4 KiB
+
+			PruneTimeout:   5 * time.Minute,
+			PruneVerifyPct: 1,
+
+			CoverageWindow: 7 * 24 * time.Hour,
+		},
 
 		CleanStart: false,
 		WorkDir:    "data",
+
+		CycleResumeTimeout: 24 * time.Hour,
+
+		Chaos: chaosConfig{
+			Scenarios: []string{
+				chaosScenarioHostOffline,
+				chaosScenarioSectorLoss,
+				chaosScenarioSectorCorruption,
+				chaosScenarioContractExpiry,
+				chaosScenarioRedundancy,
+			},
+
+			Hosts:          5,
+			DatasetSize:    1 << 26, // 64 MiB
+			CheckSize:      1 << 24, // 16 MiB
+			CorruptSectors: 5,
+			DeleteSectors:  5,
+			HealthTimeout:  10 * time.Minute,
+			PollInterval:   2 * time.Second,
+		},
 	}
+
+	cfg = defaultConfig
 )
 
 type (
 	config struct {
-		BusAddr  string `yaml:"busAddress"`
-		BusPassw string `yaml:"busPassword"`
+		BusAddr      string `yaml:"busAddress"`
+		BusPassw     string `yaml:"busPassword"`
+		BusPasswFile string `yaml:"busPasswordFile"`
+
+		WorkerAddr      string `yaml:"workerAddress"`
+		WorkerPassw     string `yaml:"workerPassword"`
+		WorkerPasswFile string `yaml:"workerPasswordFile"`
 
-		WorkerAddr  string `yaml:"workerAddress"`
-		WorkerPassw string `yaml:"workerPassword"`
+		S3 s3Config `yaml:"s3"`
+
+		HealthCheckInterval time.Duration `yaml:"healthCheckInterval"`
+
+		// the top-level profile settings are used when no profiles are
+		// configured, otherwise they serve as defaults for every profile
+		profileConfig `yaml:",inline"`
+		Profiles      profileConfigs `yaml:"profiles"`
+
+		CleanStart bool   `yaml:"cleanStart"`
+		WorkDir    string `yaml:"workDir"`
+
+		// history kept in the state database, zero keeps everything
+		StateRetention  time.Duration `yaml:"stateRetention"`
+		StateMaxResults int           `yaml:"stateMaxResults"`
+
+		// the database is backed up before every stored result, a non-zero
+		// interval turns the backup into a periodic snapshot instead
+		StateBackupInterval time.Duration `yaml:"stateBackupInterval"`
+
+		// interrupted cycles younger than this are resumed on startup, zero
+		// disables resuming
+		CycleResumeTimeout time.Duration `yaml:"cycleResumeTimeout"`
+
+		Chaos chaosConfig `yaml:"chaos"`
+	}
+
+	profileConfig struct {
+		Name        string `yaml:"name"`
+		Bucket      string `yaml:"bucket"`
+		Prefix      string `yaml:"prefix"`
+		AdoptPrefix string `yaml:"adoptPrefix"`
+		Transport   string `yaml:"transport"`
+
+		PublicReadAccess       bool `yaml:"publicReadAccess"`
+		BucketLifecycleObjects int  `yaml:"bucketLifecycleObjects"`
+
+		Schedule       scheduleConfig       `yaml:"schedule"`
+		PhaseSchedules phaseSchedulesConfig `yaml:"phaseSchedules"`
+		CatchUp        bool                 `yaml:"catchUp"`
 
-		HealthCheckInterval       time.Duration `yaml:"healthCheckInterval"`
 		IntegrityCheckInterval    time.Duration `yaml:"integrityCheckInterval"`
 		IntegrityCheckDeletePct   float64       `yaml:"integrityCheckDeletePct"`
 		IntegrityCheckDownloadPct float64       `yaml:"integrityCheckDownloadPct"`
@@ -48,22 +136,209 @@ type (
 		MinFilesize int64 `yaml:"minFilesize"`
 		MaxFilesize int64 `yaml:"maxFilesize"`
 
-		CleanStart bool   `yaml:"cleanStart"`
-		WorkDir    string `yaml:"workDir"`
+		FileSizeDistribution sizeDistributionConfig `yaml:"fileSizeDistribution"`
+		SlabBoundaryPct      float64                `yaml:"slabBoundaryPct"`
+		ContentGenerators    []string               `yaml:"contentGenerators"`
+
+		UploadConcurrency int `yaml:"uploadConcurrency"`
+		ChurnOperations   int `yaml:"churnOperations"`
+
+		ListingCheck bool `yaml:"listingCheck"`
+
+		ContractPruning bool          `yaml:"contractPruning"`
+		PruneTimeout    time.Duration `yaml:"pruneTimeout"`
+		PruneVerifyPct  float64       `yaml:"pruneVerifyPct"`
+
+		SweepPeriod    time.Duration `yaml:"sweepPeriod"`
+		CoverageWindow time.Duration `yaml:"coverageWindow"`
+
+		MaxUploadSCPerTB   float64 `yaml:"maxUploadSCPerTB"`
+		MaxDownloadSCPerTB float64 `yaml:"maxDownloadSCPerTB"`
+
+		PackedFiles        int           `yaml:"packedFiles"`
+		PackedMaxFilesize  int64         `yaml:"packedMaxFilesize"`
+		PackedFlushTimeout time.Duration `yaml:"packedFlushTimeout"`
+
+		// set holds the keys a profile decoded from the config file sets, so
+		// it can override the top-level settings with zero values
+		set map[string]bool
+	}
+
+	// profileConfigs are the configured profiles, they record which keys
+	// every profile sets when they're decoded.
+	profileConfigs []profileConfig
+
+	// sizeDistributionConfig configures how file sizes are picked between the
+	// min and max file size, 'median' and 'sigma' configure the log-normal
+	// distribution and 'alpha' the shape of the Pareto distribution.
+	sizeDistributionConfig struct {
+		Type      string             `yaml:"type"`
+		Median    int64              `yaml:"median"`
+		Sigma     float64            `yaml:"sigma"`
+		Alpha     float64            `yaml:"alpha"`
+		Histogram []sizeBucketConfig `yaml:"histogram"`
+	}
+
+	sizeBucketConfig struct {
+		Min    int64   `yaml:"min"`
+		Max    int64   `yaml:"max"`
+		Weight float64 `yaml:"weight"`
+	}
+
+	s3Config struct {
+		Address       string `yaml:"address"`
+		AccessKeyID   string `yaml:"accessKeyID"`
+		SecretKey     string `yaml:"secretKey"`
+		SecretKeyFile string `yaml:"secretKeyFile"`
+	}
+
+	chaosConfig struct {
+		Scenarios []string `yaml:"scenarios"`
+
+		// Hosts is the number of hosts in the in-process cluster
+		Hosts       int   `yaml:"hosts"`
+		DatasetSize int64 `yaml:"datasetSize"`
+
+		CheckSize      int64 `yaml:"checkSize"`
+		CorruptSectors int   `yaml:"corruptSectors"`
+		DeleteSectors  int   `yaml:"deleteSectors"`
+
+		HealthTimeout time.Duration `yaml:"healthTimeout"`
+		PollInterval  time.Duration `yaml:"pollInterval"`
+
+		MinShards   int `yaml:"minShards"`
+		TotalShards int `yaml:"totalShards"`
 	}
 )
 
+// resolveProfiles returns the configured profiles, every setting a profile
+// doesn't set is taken from the top-level config. Profiles that weren't decoded
+// from the config file only override the top-level settings with non-zero
+// values.
+func (c config) resolveProfiles() []profileConfig {
+	if len(c.Profiles) == 0 {
+		return []profileConfig{c.profileConfig}
+	}
+
+	profiles := make([]profileConfig, len(c.Profiles))
+	for i, p := range c.Profiles {
+		profiles[i] = c.profileConfig
+		base := reflect.ValueOf(&profiles[i]).Elem()
+		override := reflect.ValueOf(p)
+		for j := 0; j < override.NumField(); j++ {
+			key, _, _ := strings.Cut(override.Type().Field(j).Tag.Get("yaml"), ",")
+			if key == "" {
+				continue
+			}
+			if (p.set == nil && !override.Field(j).IsZero()) || p.set[key] {
+				base.Field(j).Set(override.Field(j))
+			}
+		}
+	}
+	return profiles
+}
+
+// UnmarshalYAML decodes the profiles and records the keys every profile sets.
+// Nodes are decoded without the decoder's options, so unknown keys are
+// rejected here.
+func (pcs *profileConfigs) UnmarshalYAML(node *yaml.Node) error {
+	var nodes []yaml.Node
+	if err := node.Decode(&nodes); err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	t := reflect.TypeOf(profileConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		if key, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); key != "" {
+			known[key] = true
+		}
+	}
+
+	profiles := make(profileConfigs, len(nodes))
+	for i, n := range nodes {
+		if err := n.Decode(&profiles[i]); err != nil {
+			return err
+		}
+		profiles[i].set = make(map[string]bool)
+		for j := 0; j+1 < len(n.Content); j += 2 {
+			key := n.Content[j]
+			if !known[key.Value] {
+				return fmt.Errorf("line %d: field %s not found in type main.profileConfig", key.Line, key.Value)
+			}
+			profiles[i].set[key.Value] = true
+		}
+	}
+	*pcs = profiles
+	return nil
+}
+
 func (c config) buildTmpFilepath() string {
 	_ = os.MkdirAll(filepath.Join(cfg.WorkDir, "tmp"), 0700)
 	return filepath.Join(cfg.WorkDir, "tmp", randomString())
 }
 
+// buildHashFilepath returns a path that contains the hash, followed by a
+// random suffix so files with the same content don't collide.
 func (c config) buildHashFilepath(h hash.Hash) string {
 	_ = os.MkdirAll(cfg.WorkDir, 0700)
-	return filepath.Join(cfg.WorkDir, fmt.Sprintf("%x%s", h.Sum(nil), dataExtension))
+	return filepath.Join(cfg.WorkDir, fmt.Sprintf("%x-%s%s", h.Sum(nil), randomString()[:8], dataExtension))
 }
 
-func loadConfig(path string) error {
+// loadConfig loads the config into cfg and initializes the work directory.
+func loadConfig(path string, overrides []string) error {
+	c, err := buildConfig(path, overrides)
+	if err != nil {
+		return err
+	}
+	cfg = c
+
+	// initialize directory
+	err = os.MkdirAll(cfg.WorkDir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create directory '%v', err: %v", cfg.WorkDir, err)
+	}
+	return nil
+}
+
+// buildConfig builds and validates the config, values are taken from the
+// defaults, the config file, environment variables and the given overrides, in
+// increasing order of precedence. Passwords are read from their files if those
+// are set, a file takes precedence over a password set at the same level.
+func buildConfig(path string, overrides []string) (config, error) {
+	c := defaultConfig
+
+	// decode the config file
+	if err := decodeConfigFile(path, &c); err != nil {
+		return config{}, err
+	} else if err := loadSecretFiles(&c, nil); err != nil {
+		return config{}, err
+	}
+
+	// apply the environment variables
+	prev := c
+	if err := applyEnvOverrides(&c); err != nil {
+		return config{}, err
+	} else if err := loadSecretFiles(&c, &prev); err != nil {
+		return config{}, err
+	}
+
+	// apply the overrides
+	prev = c
+	if err := applyOverrides(&c, overrides); err != nil {
+		return config{}, err
+	} else if err := loadSecretFiles(&c, &prev); err != nil {
+		return config{}, err
+	}
+
+	// verify config
+	if err := validateConfig(c); err != nil {
+		return config{}, err
+	}
+	return c, nil
+}
+
+func decodeConfigFile(path string, c *config) error {
 	// check whether the config file exists
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil
@@ -79,16 +354,276 @@ func loadConfig(path string) error {
 	// decode the config
 	dec := yaml.NewDecoder(f)
 	dec.KnownFields(true)
-	if err := dec.Decode(&cfg); err != nil {
+	if err := dec.Decode(c); err != nil {
 		return fmt.Errorf("failed to decode config file, err: %v", err)
 	}
+	return nil
+}
 
-	// initialize directory
-	err = os.MkdirAll(cfg.WorkDir, 0700)
-	if err != nil {
-		return fmt.Errorf("failed to create directory '%v', err: %v", cfg.WorkDir, err)
+// validateConfig checks the given config and returns an error listing every
+// problem it found.
+func validateConfig(c config) error {
+	var problems []string
+	addProblem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
 	}
 
-	// TODO: verify config
+	// addresses
+	if err := validateURL(c.BusAddr); err != nil {
+		addProblem("busAddress: %v", err)
+	}
+	if err := validateURL(c.WorkerAddr); err != nil {
+		addProblem("workerAddress: %v", err)
+	}
+
+	// intervals
+	if c.HealthCheckInterval < 0 {
+		addProblem("healthCheckInterval: must not be negative, got %v", c.HealthCheckInterval)
+	}
+
+	// profiles
+	names := make(map[string]bool)
+	var usesS3 bool
+	profiles := c.resolveProfiles()
+	for i, p := range profiles {
+		prefix := ""
+		if len(c.Profiles) > 0 {
+			prefix = fmt.Sprintf("profiles[%d].", i)
+		}
+		validateProfile(p, func(format string, args ...any) {
+			addProblem(prefix+format, args...)
+		})
+
+		if names[p.Name] {
+			addProblem("%sname: duplicate profile name '%s'", prefix, p.Name)
+		}
+		for _, other := range profiles[:i] {
+			if p.Bucket == other.Bucket && prefixesOverlap(p.Prefix, other.Prefix) {
+				addProblem("%sprefix: '%s/%s' overlaps with the dataset of profile '%s'", prefix, p.Bucket, p.Prefix, other.Name)
+			}
+		}
+		names[p.Name] = true
+		usesS3 = usesS3 || p.Transport == transportS3
+	}
+
+	// s3
+	if usesS3 {
+		if err := validateURL(c.S3.Address); err != nil {
+			addProblem("s3.address: %v", err)
+		}
+		if c.S3.AccessKeyID == "" || c.S3.SecretKey == "" {
+			addProblem("s3: accessKeyID and secretKey are required by the s3 transport")
+		}
+	}
+
+	// work dir
+	if c.WorkDir == "" {
+		addProblem("workDir: must not be empty")
+	}
+
+	// state
+	if c.StateRetention < 0 {
+		addProblem("stateRetention: must not be negative, got %v", c.StateRetention)
+	}
+	if c.StateBackupInterval < 0 {
+		addProblem("stateBackupInterval: must not be negative, got %v", c.StateBackupInterval)
+	}
+	if c.StateMaxResults < 0 {
+		addProblem("stateMaxResults: must not be negative, got %d", c.StateMaxResults)
+	}
+	if c.CycleResumeTimeout < 0 {
+		addProblem("cycleResumeTimeout: must not be negative, got %v", c.CycleResumeTimeout)
+	}
+
+	// chaos
+	for _, name := range c.Chaos.Scenarios {
+		if _, ok := chaosScenarios[name]; !ok {
+			addProblem("chaos.scenarios: unknown scenario '%s'", name)
+		}
+	}
+	if c.Chaos.Hosts < chaosMinHosts {
+		addProblem("chaos.hosts: must be at least %d, got %d", chaosMinHosts, c.Chaos.Hosts)
+	}
+	if c.Chaos.DatasetSize <= 0 {
+		addProblem("chaos.datasetSize: must be positive, got %d", c.Chaos.DatasetSize)
+	}
+	if c.Chaos.CheckSize <= 0 {
+		addProblem("chaos.checkSize: must be positive, got %d", c.Chaos.CheckSize)
+	}
+	if c.Chaos.HealthTimeout <= 0 {
+		addProblem("chaos.healthTimeout: must be positive, got %v", c.Chaos.HealthTimeout)
+	}
+	if c.Chaos.PollInterval <= 0 {
+		addProblem("chaos.pollInterval: must be positive, got %v", c.Chaos.PollInterval)
+	}
+	if c.Chaos.MinShards < 0 || c.Chaos.TotalShards < 0 {
+		addProblem("chaos: minShards and totalShards must not be negative")
+	} else if c.Chaos.MinShards > 0 && c.Chaos.TotalShards > 0 && c.Chaos.MinShards > c.Chaos.TotalShards {
+		addProblem("chaos.minShards: must not exceed totalShards, got %d > %d", c.Chaos.MinShards, c.Chaos.TotalShards)
+	} else if c.Chaos.TotalShards > c.Chaos.Hosts {
+		addProblem("chaos.totalShards: must not exceed hosts, got %d > %d", c.Chaos.TotalShards, c.Chaos.Hosts)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config:\n  - %s", strings.Join(problems, "\n  - "))
+}
+
+func validateProfile(p profileConfig, addProblem func(format string, args ...any)) {
+	// identity
+	if p.Name == "" {
+		addProblem("name: must not be empty")
+	}
+	if p.Bucket == "" {
+		addProblem("bucket: must not be empty")
+	}
+	if p.Prefix == "" || strings.HasPrefix(p.Prefix, "/") || strings.HasSuffix(p.Prefix, "/") {
+		addProblem("prefix: must not be empty or start or end with a slash, got '%s'", p.Prefix)
+	}
+	if strings.HasPrefix(p.AdoptPrefix, "/") || strings.HasSuffix(p.AdoptPrefix, "/") {
+		addProblem("adoptPrefix: must not start or end with a slash, got '%s'", p.AdoptPrefix)
+	} else if p.AdoptPrefix != "" && p.AdoptPrefix != p.Prefix && prefixesOverlap(p.AdoptPrefix, p.Prefix) {
+		addProblem("adoptPrefix: must not overlap with prefix '%s', got '%s'", p.Prefix, p.AdoptPrefix)
+	}
+	if p.Transport != transportWorker && p.Transport != transportS3 {
+		addProblem("transport: must be '%s' or '%s', got '%s'", transportWorker, transportS3, p.Transport)
+	}
+
+	// intervals
+	if p.IntegrityCheckInterval <= 0 {
+		addProblem("integrityCheckInterval: must be positive, got %v", p.IntegrityCheckInterval)
+	}
+
+	// percentages
+	if p.IntegrityCheckDownloadPct < 0 || p.IntegrityCheckDownloadPct > 100 {
+		addProblem("integrityCheckDownloadPct: must be a percentage between 0 and 100, got %v", p.IntegrityCheckDownloadPct)
+	}
+	if p.IntegrityCheckDeletePct < 0 || p.IntegrityCheckDeletePct > 100 {
+		addProblem("integrityCheckDeletePct: must be a percentage between 0 and 100, got %v", p.IntegrityCheckDeletePct)
+	}
+
+	// sizes
+	if p.DatasetSize <= 0 {
+		addProblem("datasetSize: must be positive, got %d", p.DatasetSize)
+	}
+	if p.MinFilesize <= 0 {
+		addProblem("minFilesize: must be positive, got %d", p.MinFilesize)
+	}
+	if p.MinFilesize > p.MaxFilesize {
+		addProblem("minFilesize: must not exceed maxFilesize, got %d > %d", p.MinFilesize, p.MaxFilesize)
+	}
+
+	p.FileSizeDistribution.validate(addProblem)
+	p.Schedule.validate("schedule", addProblem)
+	p.PhaseSchedules.Fill.validate("phaseSchedules.fill", addProblem)
+	p.PhaseSchedules.Verify.validate("phaseSchedules.verify", addProblem)
+	p.PhaseSchedules.Churn.validate("phaseSchedules.churn", addProblem)
+	p.PhaseSchedules.Prune.validate("phaseSchedules.prune", addProblem)
+	if p.SlabBoundaryPct < 0 || p.SlabBoundaryPct > 100 {
+		addProblem("slabBoundaryPct: must be a percentage between 0 and 100, got %v", p.SlabBoundaryPct)
+	}
+
+	// concurrency
+	if p.UploadConcurrency <= 0 {
+		addProblem("uploadConcurrency: must be positive, got %d", p.UploadConcurrency)
+	}
+
+	// churn
+	if p.ChurnOperations < 0 {
+		addProblem("churnOperations: must not be negative, got %d", p.ChurnOperations)
+	}
+
+	// pruning
+	if p.PruneTimeout <= 0 {
+		addProblem("pruneTimeout: must be positive, got %v", p.PruneTimeout)
+	}
+	if p.PruneVerifyPct < 0 || p.PruneVerifyPct > 100 {
+		addProblem("pruneVerifyPct: must be a percentage between 0 and 100, got %v", p.PruneVerifyPct)
+	}
+	if p.SweepPeriod < 0 {
+		addProblem("sweepPeriod: must not be negative, got %v", p.SweepPeriod)
+	}
+	if p.CoverageWindow <= 0 {
+		addProblem("coverageWindow: must be positive, got %v", p.CoverageWindow)
+	}
+
+	// budget
+	if p.MaxUploadSCPerTB < 0 {
+		addProblem("maxUploadSCPerTB: must not be negative, got %v", p.MaxUploadSCPerTB)
+	}
+	if p.MaxDownloadSCPerTB < 0 {
+		addProblem("maxDownloadSCPerTB: must not be negative, got %v", p.MaxDownloadSCPerTB)
+	}
+
+	// content
+	if len(p.ContentGenerators) == 0 {
+		addProblem("contentGenerators: must not be empty")
+	}
+	for _, name := range p.ContentGenerators {
+		if _, ok := contentGenerators[name]; !ok {
+			addProblem("contentGenerators: unknown generator '%s', must be one of %v", name, sortedKeys(contentGenerators))
+		}
+	}
+
+	// packing
+	if p.PackedFiles < 0 {
+		addProblem("packedFiles: must not be negative, got %d", p.PackedFiles)
+	}
+	if p.PackedMaxFilesize <= 0 {
+		addProblem("packedMaxFilesize: must be positive, got %d", p.PackedMaxFilesize)
+	}
+	if p.PackedFlushTimeout < 0 {
+		addProblem("packedFlushTimeout: must not be negative, got %v", p.PackedFlushTimeout)
+	}
+
+	// buckets
+	if p.BucketLifecycleObjects < 0 {
+		addProblem("bucketLifecycleObjects: must not be negative, got %d", p.BucketLifecycleObjects)
+	}
+}
+
+// prefixesOverlap returns true if listing either prefix would include objects
+// under the other one.
+func prefixesOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// checkReachability probes the bus and worker of the given config and returns
+// a problem for every one that can't be reached within the timeout.
+func checkReachability(c config, timeout time.Duration) (problems []string) {
+	probe := func(key, addr string, fn func() error) {
+		errCh := make(chan error, 1)
+		go func() { errCh <- fn() }()
+		select {
+		case err := <-errCh:
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: '%s' is unreachable, err: %v", key, addr, err))
+			}
+		case <-time.After(timeout):
+			problems = append(problems, fmt.Sprintf("%s: '%s' didn't respond within %v", key, addr, timeout))
+		}
+	}
+
+	probe("busAddress", c.BusAddr, func() error {
+		_, err := bus.NewClient(c.BusAddr, c.BusPassw).State()
+		return err
+	})
+	probe("workerAddress", c.WorkerAddr, func() error {
+		_, err := worker.NewClient(c.WorkerAddr, c.WorkerPassw).State()
+		return err
+	})
+	return
+}
+
+func validateURL(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("invalid URL '%s', err: %v", addr, err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid URL '%s', scheme must be http or https", addr)
+	} else if u.Host == "" {
+		return fmt.Errorf("invalid URL '%s', missing host", addr)
+	}
 	return nil
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveProfiles(t *testing.T) {
+	c := defaultConfig
+	c.Prefix = "shared"
+	c.DatasetSize = 1 << 30
+
+	// without profiles the top-level settings are the only profile
+	profiles := c.resolveProfiles()
+	if len(profiles) != 1 || profiles[0].Name != "default" || profiles[0].Prefix != "shared" {
+		t.Fatalf("unexpected profiles %+v", profiles)
+	}
+
+	// profiles inherit what they don't set
+	c.Profiles = []profileConfig{
+		{Name: "small", Prefix: "small", DatasetSize: 1 << 20},
+		{Name: "s3", Prefix: "s3", Transport: transportS3},
+	}
+	profiles = c.resolveProfiles()
+	if len(profiles) != 2 {
+		t.Fatalf("expected 2 profiles, got %d", len(profiles))
+	}
+
+	tests := []struct {
+		got, want any
+	}{
+		{profiles[0].Name, "small"},
+		{profiles[0].Prefix, "small"},
+		{profiles[0].DatasetSize, int64(1 << 20)},
+		{profiles[0].Transport, transportWorker},
+		{profiles[0].IntegrityCheckInterval, time.Hour},
+		{profiles[1].Name, "s3"},
+		{profiles[1].Transport, transportS3},
+		{profiles[1].DatasetSize, int64(1 << 30)},
+		{profiles[1].Bucket, defaultBucketName},
+	}
+	for i, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%d: got %v, want %v", i, test.got, test.want)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *config)
+		err    string
+	}{
+		{
+			name:   "default",
+			modify: func(c *config) {},
+		},
+		{
+			name:   "bus address",
+			modify: func(c *config) { c.BusAddr = "localhost:9880" },
+			err:    "busAddress",
+		},
+		{
+			name:   "work dir",
+			modify: func(c *config) { c.WorkDir = "" },
+			err:    "workDir: must not be empty",
+		},
+		{
+			name:   "prefix",
+			modify: func(c *config) { c.Prefix = "/data" },
+			err:    "prefix: must not be empty or start or end with a slash",
+		},
+		{
+			name: "duplicate profile",
+			modify: func(c *config) {
+				c.Profiles = []profileConfig{{Name: "a", Prefix: "a"}, {Name: "a", Prefix: "b"}}
+			},
+			err: "profiles[1].name: duplicate profile name 'a'",
+		},
+		{
+			name: "overlapping profiles",
+			modify: func(c *config) {
+				c.Profiles = []profileConfig{{Name: "a", Prefix: "data"}, {Name: "b", Prefix: "data/b"}}
+			},
+			err: "profiles[1].prefix: 'integrity/data/b' overlaps with the dataset of profile 'a'",
+		},
+		{
+			name: "s3 credentials",
+			modify: func(c *config) {
+				c.Transport = transportS3
+				c.S3.Address = "http://localhost:8080"
+			},
+			err: "s3: accessKeyID and secretKey are required",
+		},
+		{
+			name:   "unknown scenario",
+			modify: func(c *config) { c.Chaos.Scenarios = []string{"meteor"} },
+			err:    "chaos.scenarios: unknown scenario 'meteor'",
+		},
+		{
+			name: "shards",
+			modify: func(c *config) {
+				c.Chaos.MinShards = 3
+				c.Chaos.TotalShards = 2
+			},
+			err: "chaos.minShards: must not exceed totalShards",
+		},
+		{
+			name:   "state retention",
+			modify: func(c *config) { c.StateRetention = -time.Hour },
+			err:    "stateRetention: must not be negative",
+		},
+		{
+			name:   "state backup interval",
+			modify: func(c *config) { c.StateBackupInterval = -time.Hour },
+			err:    "stateBackupInterval: must not be negative",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaultConfig
+			test.modify(&c)
+			err := validateConfig(c)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestCheckReachability(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer ok.Close()
+	block := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer hanging.Close()
+	defer close(block)
+
+	c := defaultConfig
+	c.BusAddr = ok.URL + "/api/bus"
+	c.WorkerAddr = ok.URL + "/api/worker"
+	if problems := checkReachability(c, time.Second); len(problems) != 0 {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+
+	c.BusAddr = "http://127.0.0.1:1/api/bus"
+	c.WorkerAddr = hanging.URL + "/api/worker"
+	problems := checkReachability(c, 100*time.Millisecond)
+	if len(problems) != 2 {
+		t.Fatalf("expected 2 problems, got %v", problems)
+	} else if !strings.HasPrefix(problems[0], "busAddress:") || !strings.Contains(problems[0], "unreachable") {
+		t.Fatalf("unexpected bus problem %q", problems[0])
+	} else if !strings.HasPrefix(problems[1], "workerAddress:") || !strings.Contains(problems[1], "didn't respond") {
+		t.Fatalf("unexpected worker problem %q", problems[1])
+	}
+}
+
+func TestDecodeProfiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		check func(profiles []profileConfig) bool
+		err   string
+	}{
+		{
+			name: "zero values override",
+			yaml: `
+listingCheck: true
+uploadConcurrency: 8
+prefix: shared
+profiles:
+  - name: a
+    prefix: a
+    listingCheck: false
+    uploadConcurrency: 0
+  - name: b
+    prefix: b
+`,
+			check: func(profiles []profileConfig) bool {
+				return !profiles[0].ListingCheck && profiles[0].UploadConcurrency == 0 &&
+					profiles[1].ListingCheck && profiles[1].UploadConcurrency == 8
+			},
+		},
+		{
+			name: "empty string overrides",
+			yaml: `
+adoptPrefix: old
+profiles:
+  - name: a
+    adoptPrefix: ""
+`,
+			check: func(profiles []profileConfig) bool {
+				return profiles[0].AdoptPrefix == "" && profiles[0].Prefix == "data"
+			},
+		},
+		{
+			name: "unknown key",
+			yaml: `
+profiles:
+  - name: a
+    unknown: 1
+`,
+			err: "field unknown not found",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yml")
+			if err := os.WriteFile(path, []byte(test.yaml), 0600); err != nil {
+				t.Fatal(err)
+			}
+			c := defaultConfig
+			err := decodeConfigFile(path, &c)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if profiles := c.resolveProfiles(); !test.check(profiles) {
+				t.Fatalf("unexpected profiles %+v", profiles)
+			}
+		})
+	}
+}
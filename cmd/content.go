@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.sia.tech/renterd/api"
+	"lukechampine.com/frand"
+)
+
+const (
+	contentRandom  = "random"
+	contentZeros   = "zeros"
+	contentPattern = "pattern"
+	contentText    = "text"
+	contentSparse  = "sparse"
+	contentMarkers = "markers"
+
+	// metadataContent and metadataSeed are the user metadata keys under which
+	// an object's generator and seed are stored
+	metadataContent = "content"
+	metadataSeed    = "seed"
+
+	// contentBlockSize is the size of the blocks content is generated in, it
+	// is fixed so the same seed always yields the same content
+	contentBlockSize = 1 << 12 // 4 KiB
+
+	// markerInterval is the distance between the markers of the markers
+	// generator
+	markerInterval = 1 << 16 // 64 KiB
+
+	// sparseDataPct is the percentage of the blocks written by the sparse
+	// generator that contain data
+	sparseDataPct = 5
+)
+
+var (
+	// contentGenerators return a function that fills the block at the given
+	// offset of a file, generators only draw from the RNG they're given so
+	// that content can be regenerated from its seed
+	contentGenerators = map[string]func(rng *frand.RNG) func(block []byte, offset int64){
+		contentRandom:  generateRandom,
+		contentZeros:   generateZeros,
+		contentPattern: generatePattern,
+		contentText:    generateText,
+		contentSparse:  generateSparse,
+		contentMarkers: generateMarkers,
+	}
+
+	textWords = strings.Fields("the quick brown fox jumps over lazy dog sia renterd host contract sector slab object bucket upload download integrity lorem ipsum dolor sit amet")
+)
+
+// contentReader generates the content of a file from a generator and a seed.
+type contentReader struct {
+	generate func(block []byte, offset int64)
+
+	block     []byte
+	buf       []byte
+	offset    int64
+	remaining int64
+}
+
+func newContentReader(name string, seed [32]byte, size int64) (*contentReader, error) {
+	newGenerator, ok := contentGenerators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown content generator '%s'", name)
+	}
+	return &contentReader{
+		generate:  newGenerator(frand.NewCustom(seed[:], 1024, 12)),
+		block:     make([]byte, contentBlockSize),
+		remaining: size,
+	}, nil
+}
+
+func (r *contentReader) Read(b []byte) (n int, _ error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if len(r.buf) == 0 {
+		for i := range r.block {
+			r.block[i] = 0
+		}
+		r.generate(r.block, r.offset)
+		r.buf = r.block
+		r.offset += int64(len(r.block))
+	}
+
+	if int64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n = copy(b, r.buf)
+	r.buf = r.buf[n:]
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+// contentChecker compares the data written to it with the expected content
+// and remembers the offset of the first mismatch.
+type contentChecker struct {
+	expected io.Reader
+	offset   int64
+	mismatch int64
+	buf      []byte
+}
+
+func newContentChecker(expected io.Reader) *contentChecker {
+	return &contentChecker{expected: expected, mismatch: -1}
+}
+
+func (c *contentChecker) Write(b []byte) (int, error) {
+	if c.mismatch == -1 {
+		if cap(c.buf) < len(b) {
+			c.buf = make([]byte, len(b))
+		}
+		buf := c.buf[:len(b)]
+		n, _ := io.ReadFull(c.expected, buf)
+		for i := range b {
+			if i >= n || b[i] != buf[i] {
+				c.mismatch = c.offset + int64(i)
+				break
+			}
+		}
+	}
+	c.offset += int64(len(b))
+	return len(b), nil
+}
+
+// contentMetadata returns the user metadata that records how an object's
+// content was generated.
+func contentMetadata(name string, seed [32]byte) api.ObjectUserMetadata {
+	return api.ObjectUserMetadata{
+		metadataContent: name,
+		metadataSeed:    hex.EncodeToString(seed[:]),
+	}
+}
+
+// contentFromMetadata regenerates the content of an object from its user
+// metadata, it returns false if the object's content wasn't generated by a
+// known generator.
+func contentFromMetadata(md api.ObjectUserMetadata, size int64) (io.Reader, string, bool) {
+	name, seed, ok := contentSeed(md)
+	if !ok {
+		return nil, "", false
+	}
+	r, err := newContentReader(name, seed, size)
+	if err != nil {
+		return nil, "", false
+	}
+	return r, name, true
+}
+
+// contentSeed returns the generator and seed recorded in the metadata.
+func contentSeed(md api.ObjectUserMetadata) (name string, seed [32]byte, _ bool) {
+	md = normalizeMetadata(md)
+	name, ok := md[metadataContent]
+	if !ok {
+		return "", seed, false
+	}
+	b, err := hex.DecodeString(md[metadataSeed])
+	if err != nil || len(b) != len(seed) {
+		return "", seed, false
+	}
+	copy(seed[:], b)
+	return name, seed, true
+}
+
+func generateRandom(rng *frand.RNG) func([]byte, int64) {
+	return func(block []byte, _ int64) {
+		_, _ = rng.Read(block)
+	}
+}
+
+func generateZeros(*frand.RNG) func([]byte, int64) {
+	return func([]byte, int64) {}
+}
+
+// generatePattern repeats a short random pattern throughout the file.
+func generatePattern(rng *frand.RNG) func([]byte, int64) {
+	pattern := rng.Bytes(1 + rng.Intn(64))
+	return func(block []byte, offset int64) {
+		for i := range block {
+			block[i] = pattern[(offset+int64(i))%int64(len(pattern))]
+		}
+	}
+}
+
+// generateText writes random words from a small vocabulary, separated by
+// spaces and newlines.
+func generateText(rng *frand.RNG) func([]byte, int64) {
+	var buf bytes.Buffer
+	return func(block []byte, _ int64) {
+		for buf.Len() < len(block) {
+			buf.WriteString(textWords[rng.Intn(len(textWords))])
+			if rng.Intn(12) == 0 {
+				buf.WriteByte('\n')
+			} else {
+				buf.WriteByte(' ')
+			}
+		}
+		_, _ = buf.Read(block)
+	}
+}
+
+// generateSparse writes mostly zeros with the occasional block of random data.
+func generateSparse(rng *frand.RNG) func([]byte, int64) {
+	return func(block []byte, _ int64) {
+		if rng.Intn(100) < sparseDataPct {
+			_, _ = rng.Read(block)
+		}
+	}
+}
+
+// generateMarkers writes random data with a marker containing the offset at
+// every marker interval, which makes it easy to tell where misplaced data
+// originated.
+func generateMarkers(rng *frand.RNG) func([]byte, int64) {
+	return func(block []byte, offset int64) {
+		_, _ = rng.Read(block)
+		if offset%markerInterval == 0 {
+			copy(block, fmt.Sprintf("RENTERD-INTEGRITY-MARKER:%016x;", offset))
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestContentReader(t *testing.T) {
+	seed := frand.Entropy256()
+	for name := range contentGenerators {
+		for _, size := range []int64{0, 1, contentBlockSize - 1, contentBlockSize, 3*contentBlockSize + 7, markerInterval + 64} {
+			r, err := newContentReader(name, seed, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			} else if int64(len(b)) != size {
+				t.Fatalf("%s: expected %d bytes, got %d", name, size, len(b))
+			}
+
+			// the same seed yields the same content, regardless of how it's
+			// read
+			r, _ = newContentReader(name, seed, size)
+			var buf bytes.Buffer
+			if _, err := io.CopyBuffer(&buf, r, make([]byte, 1000)); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(b, buf.Bytes()) {
+				t.Fatalf("%s: content of size %d differs between reads", name, size)
+			}
+
+			if name == contentMarkers && size > markerInterval {
+				if !bytes.HasPrefix(b[markerInterval:], []byte("RENTERD-INTEGRITY-MARKER:0000000000010000;")) {
+					t.Fatalf("missing marker at offset %d", markerInterval)
+				}
+			}
+		}
+	}
+
+	if _, err := newContentReader("unknown", seed, 1); err == nil {
+		t.Fatal("expected unknown generator to fail")
+	}
+}
+
+func TestContentChecker(t *testing.T) {
+	const size = 3*contentBlockSize + 100
+	seed := frand.Entropy256()
+	expected := func() io.Reader {
+		r, _ := newContentReader(contentRandom, seed, size)
+		return r
+	}
+	content, _ := io.ReadAll(expected())
+
+	tests := []struct {
+		name     string
+		data     func() []byte
+		mismatch int64
+	}{
+		{
+			name:     "match",
+			data:     func() []byte { return content },
+			mismatch: -1,
+		},
+		{
+			name: "flipped byte",
+			data: func() []byte {
+				b := bytes.Clone(content)
+				b[contentBlockSize+5] ^= 0xff
+				return b
+			},
+			mismatch: contentBlockSize + 5,
+		},
+		{
+			name: "flipped first byte",
+			data: func() []byte {
+				b := bytes.Clone(content)
+				b[0] ^= 0xff
+				return b
+			},
+			mismatch: 0,
+		},
+		{
+			name:     "too long",
+			data:     func() []byte { return append(bytes.Clone(content), 0) },
+			mismatch: size,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newContentChecker(expected())
+			if _, err := io.CopyBuffer(c, bytes.NewReader(test.data()), make([]byte, 999)); err != nil {
+				t.Fatal(err)
+			} else if c.mismatch != test.mismatch {
+				t.Fatalf("expected mismatch at %d, got %d", test.mismatch, c.mismatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/alerts"
+)
+
+// bytesPerTB is used to compute cost per TB rates.
+const bytesPerTB = 1e12
+
+// costs attributes the spending of the process's contracts to the cycles of
+// all profiles.
+var costs costTracker
+
+// costTracker tracks the spending since the last cycle of any profile that
+// computed its cost, along with the bytes every profile transferred since
+// then. Spending is tracked per contract, not per profile, so every cycle is
+// attributed the spending since the previous cycle of any profile, which
+// attributes all spending exactly once.
+type costTracker struct {
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+
+	mu           sync.Mutex
+	last         *contractSnapshot
+	lastAt       time.Time
+	runningTotal types.Currency
+}
+
+// seed initializes the tracker from a profile's state after a restart, the
+// most recent snapshot of any profile is where the spending of the next cycle
+// is computed from.
+func (ct *costTracker) seed(s *state) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	for _, res := range s.Results {
+		if res.ContractSnapshot == nil {
+			continue
+		} else if res.EndedAt.After(ct.lastAt) {
+			ct.last, ct.lastAt = res.ContractSnapshot, res.EndedAt
+		}
+		break
+	}
+	if total := s.lastRunningTotal(); total.Cmp(ct.runningTotal) > 0 {
+		ct.runningTotal = total
+	}
+}
+
+// cycleCost computes the cost of a cycle that ended with the given snapshot,
+// it's nil if there's no previous snapshot to compare it to.
+func (ct *costTracker) cycleCost(snapshot *contractSnapshot) *cycleCost {
+	if snapshot == nil {
+		return nil
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	uploaded, downloaded := ct.uploaded.Swap(0), ct.downloaded.Swap(0)
+	prev := ct.last
+	ct.last, ct.lastAt = snapshot, time.Now()
+	if prev == nil {
+		return nil
+	}
+
+	c := newCycleCost(snapshot.diff(prev), uploaded, downloaded, ct.runningTotal)
+	ct.runningTotal = c.RunningTotal
+	return c
+}
+
+// cycleCost is what a cycle cost, derived from the spending since the previous
+// cycle of any profile. Upload costs include the cost of storing the data
+// until the contracts end, renterd doesn't track storage spending separately,
+// and download costs are the funds that were added to accounts. The cost per
+// TB is relative to the bytes all profiles transferred in that time, in every
+// phase.
+type cycleCost struct {
+	Uploads      types.Currency `json:"uploads"`
+	Downloads    types.Currency `json:"downloads"`
+	Deletions    types.Currency `json:"deletions"`
+	Total        types.Currency `json:"total"`
+	RunningTotal types.Currency `json:"runningTotal"`
+
+	UploadSCPerTB   float64 `json:"uploadSCPerTB,omitempty"`
+	DownloadSCPerTB float64 `json:"downloadSCPerTB,omitempty"`
+}
+
+// newCycleCost computes the cost of the cycle from the snapshot's delta and
+// the number of bytes uploaded and downloaded, without redundancy.
+func newCycleCost(d *snapshotDelta, uploaded, downloaded int64, runningTotal types.Currency) *cycleCost {
+	c := &cycleCost{
+		Uploads:   d.Spending.Uploads.Add(d.Spending.SectorRoots),
+		Downloads: d.Spending.FundAccount,
+		Deletions: d.Spending.Deletions,
+		Total:     d.Spending.Total,
+	}
+	c.RunningTotal = runningTotal.Add(c.Total)
+	if uploaded > 0 {
+		c.UploadSCPerTB = c.Uploads.Siacoins() / (float64(uploaded) / bytesPerTB)
+	}
+	if downloaded > 0 {
+		c.DownloadSCPerTB = c.Downloads.Siacoins() / (float64(downloaded) / bytesPerTB)
+	}
+	return c
+}
+
+// lastRunningTotal returns the running total of the most recent cycle with a
+// known cost.
+func (s *state) lastRunningTotal() types.Currency {
+	for _, res := range s.Results {
+		if res.Cost != nil {
+			return res.Cost.RunningTotal
+		}
+	}
+	return types.ZeroCurrency
+}
+
+// registerBudgetAlert registers a warning if the cycle's cost per TB uploaded
+// or downloaded exceeds the configured budget.
+func (p *profile) registerBudgetAlert(res result) error {
+	if res.Cost == nil {
+		return nil
+	}
+
+	var exceeded []string
+	if p.MaxUploadSCPerTB > 0 && res.Cost.UploadSCPerTB > p.MaxUploadSCPerTB {
+		exceeded = append(exceeded, fmt.Sprintf("uploads cost %.2f SC/TB, budget is %.2f SC/TB", res.Cost.UploadSCPerTB, p.MaxUploadSCPerTB))
+	}
+	if p.MaxDownloadSCPerTB > 0 && res.Cost.DownloadSCPerTB > p.MaxDownloadSCPerTB {
+		exceeded = append(exceeded, fmt.Sprintf("downloads cost %.2f SC/TB, budget is %.2f SC/TB", res.Cost.DownloadSCPerTB, p.MaxDownloadSCPerTB))
+	}
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	alert := alerts.Alert{
+		ID:       randomID(),
+		Severity: alerts.SeverityWarning,
+		Message:  fmt.Sprintf("integrity check of profile '%s' exceeded its budget: %s", p.Name, strings.Join(exceeded, ", ")),
+		Data: map[string]any{
+			"source":  "renterd-integrity",
+			"profile": p.Name,
+			"cost":    res.Cost,
+		},
+		Timestamp: time.Now(),
+	}
+
+	p.logger.Warn(alert.Message)
+	return withSaneTimeout(func(ctx context.Context) error {
+		return bc.RegisterAlert(ctx, alert)
+	}, nil)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+)
+
+func TestNewCycleCost(t *testing.T) {
+	sc := types.Siacoins
+
+	tests := []struct {
+		name                 string
+		spending             spendingSnapshot
+		uploaded, downloaded int64
+		runningTotal         types.Currency
+		want                 cycleCost
+	}{
+		{
+			name: "idle",
+			want: cycleCost{},
+		},
+		{
+			name:         "uploads include sector roots",
+			spending:     spendingSnapshot{Uploads: sc(8), SectorRoots: sc(2), Total: sc(10)},
+			uploaded:     1e12,
+			runningTotal: sc(5),
+			want:         cycleCost{Uploads: sc(10), Total: sc(10), RunningTotal: sc(15), UploadSCPerTB: 10},
+		},
+		{
+			name:       "downloads are account funding",
+			spending:   spendingSnapshot{FundAccount: sc(3), Deletions: sc(1), Total: sc(4)},
+			downloaded: 5e11,
+			want:       cycleCost{Downloads: sc(3), Deletions: sc(1), Total: sc(4), RunningTotal: sc(4), DownloadSCPerTB: 6},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := newCycleCost(&snapshotDelta{Spending: test.spending}, test.uploaded, test.downloaded, test.runningTotal)
+			if !got.Uploads.Equals(test.want.Uploads) ||
+				!got.Downloads.Equals(test.want.Downloads) ||
+				!got.Deletions.Equals(test.want.Deletions) ||
+				!got.Total.Equals(test.want.Total) ||
+				!got.RunningTotal.Equals(test.want.RunningTotal) {
+				t.Fatalf("expected %+v, got %+v", test.want, *got)
+			}
+			if math.Abs(got.UploadSCPerTB-test.want.UploadSCPerTB) > 1e-9 || math.Abs(got.DownloadSCPerTB-test.want.DownloadSCPerTB) > 1e-9 {
+				t.Fatalf("expected rates %v and %v, got %v and %v", test.want.UploadSCPerTB, test.want.DownloadSCPerTB, got.UploadSCPerTB, got.DownloadSCPerTB)
+			}
+		})
+	}
+}
+
+func TestCostTracker(t *testing.T) {
+	sc := types.Siacoins
+	snapshot := func(uploads uint32) *contractSnapshot {
+		return &contractSnapshot{PerContract: []contractSnapshotEntry{{
+			ID:       types.FileContractID{1},
+			Spending: spendingSnapshot{Uploads: sc(uploads), Total: sc(uploads)},
+		}}}
+	}
+
+	// the most recent snapshot of any profile is the starting point, along
+	// with the highest running total
+	now := time.Now()
+	var ct costTracker
+	ct.seed(&state{Results: []result{{EndedAt: now, ContractSnapshot: snapshot(2), Cost: &cycleCost{RunningTotal: sc(7)}}}})
+	ct.seed(&state{Results: []result{{EndedAt: now.Add(-time.Hour), ContractSnapshot: snapshot(1), Cost: &cycleCost{RunningTotal: sc(5)}}}})
+	ct.seed(&state{})
+	if !ct.lastAt.Equal(now) {
+		t.Fatalf("expected the most recent snapshot, got one from %v", ct.lastAt)
+	} else if !ct.runningTotal.Equals(sc(7)) {
+		t.Fatalf("expected running total %v, got %v", sc(7), ct.runningTotal)
+	}
+
+	// the first cycle is attributed the spending since the seeded snapshot
+	// and the bytes of every profile
+	ct.uploaded.Add(5e11)
+	ct.uploaded.Add(5e11)
+	c := ct.cycleCost(snapshot(5))
+	if c == nil {
+		t.Fatal("expected a cost")
+	} else if !c.Total.Equals(sc(3)) || !c.RunningTotal.Equals(sc(10)) {
+		t.Fatalf("expected total %v and running total %v, got %+v", sc(3), sc(10), *c)
+	} else if c.UploadSCPerTB != 3 {
+		t.Fatalf("expected 3 SC/TB, got %v", c.UploadSCPerTB)
+	}
+
+	// the next cycle, of any profile, is only attributed the spending since
+	// then, so nothing is counted twice
+	if c := ct.cycleCost(snapshot(5)); c == nil {
+		t.Fatal("expected a cost")
+	} else if !c.Total.IsZero() || !c.RunningTotal.Equals(sc(10)) || c.UploadSCPerTB != 0 {
+		t.Fatalf("expected no spending, got %+v", *c)
+	}
+
+	// without a previous snapshot there's no cost, the bytes are discarded
+	var fresh costTracker
+	fresh.downloaded.Add(1e12)
+	if c := fresh.cycleCost(snapshot(1)); c != nil {
+		t.Fatalf("expected no cost, got %+v", *c)
+	} else if fresh.downloaded.Load() != 0 {
+		t.Fatal("expected the downloaded bytes to be reset")
+	} else if c := fresh.cycleCost(nil); c != nil {
+		t.Fatalf("expected no cost, got %+v", *c)
+	}
+}
+
+// memTransport stores uploaded objects in memory.
+type memTransport struct {
+	transport
+	objects map[string][]byte
+}
+
+func (t memTransport) UploadObject(_ context.Context, r io.Reader, _, key string, _ api.UploadObjectOptions) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	} else if len(b) == 0 {
+		return errors.New("empty object")
+	}
+	t.objects[key] = b
+	return nil
+}
+
+func (t memTransport) DownloadObject(_ context.Context, w io.Writer, _, key string, _ api.DownloadObjectOptions) error {
+	b, ok := t.objects[key]
+	if !ok {
+		return api.ErrObjectNotFound
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func TestCountingTransport(t *testing.T) {
+	t.Cleanup(func() {
+		costs.uploaded.Store(0)
+		costs.downloaded.Store(0)
+	})
+	costs.uploaded.Store(0)
+	costs.downloaded.Store(0)
+
+	tp := countingTransport{memTransport{objects: make(map[string][]byte)}}
+	ctx := context.Background()
+
+	// only the bytes from the reader's offset are uploaded
+	r := bytes.NewReader(make([]byte, 10))
+	r.Seek(4, io.SeekStart)
+	if err := tp.UploadObject(ctx, r, defaultBucketName, "a", api.UploadObjectOptions{}); err != nil {
+		t.Fatal(err)
+	} else if n := costs.uploaded.Load(); n != 6 {
+		t.Fatalf("expected 6 bytes uploaded, got %d", n)
+	}
+
+	// failed uploads aren't counted
+	if err := tp.UploadObject(ctx, bytes.NewReader(nil), defaultBucketName, "b", api.UploadObjectOptions{}); err == nil {
+		t.Fatal("expected the upload to fail")
+	} else if n := costs.uploaded.Load(); n != 6 {
+		t.Fatalf("expected 6 bytes uploaded, got %d", n)
+	}
+
+	// downloads are counted as they're written
+	if err := tp.DownloadObject(ctx, io.Discard, defaultBucketName, "a", api.DownloadObjectOptions{}); err != nil {
+		t.Fatal(err)
+	} else if n := costs.downloaded.Load(); n != 6 {
+		t.Fatalf("expected 6 bytes downloaded, got %d", n)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronDescriptors are the supported shorthands for common expressions.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSchedule is a parsed cron expression, every field is a bitset of the
+// values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// a restricted day of month and day of week match if either matches
+	domStar, dowStar bool
+}
+
+// parseCron parses a standard five field cron expression: minute, hour, day of
+// month, month and day of week. Fields support '*', values, ranges, steps and
+// lists, e.g. "*/15 22-23,0-5 * * 1-5".
+func parseCron(expr string) (c cronSchedule, err error) {
+	if d, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = d
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return cronSchedule{}, fmt.Errorf("minute: %v", err)
+	} else if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return cronSchedule{}, fmt.Errorf("hour: %v", err)
+	} else if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return cronSchedule{}, fmt.Errorf("day of month: %v", err)
+	} else if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return cronSchedule{}, fmt.Errorf("month: %v", err)
+	} else if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return cronSchedule{}, fmt.Errorf("day of week: %v", err)
+	}
+
+	// both 0 and 7 are Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (bits uint64, _ error) {
+	for _, part := range strings.Split(field, ",") {
+		// split off the step
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step '%s'", stepStr)
+			}
+		}
+
+		// parse the range
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", loStr)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return 0, fmt.Errorf("invalid value '%s'", hiStr)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time after the given time that matches the
+// schedule, or the zero time if there is none within five years.
+func (c cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -25,33 +28,43 @@ const (
 	defaultChunkSize = int64(1 << 26) // 64 MiB
 )
 
-func ensureDataset(want int64) (added, removed int64, _ error) {
-	logger.Infof("ensuring data set size matches %s", humanReadableSize(want))
+func (p *profile) ensureDataset(want int64) (added, removed int64, _ error) {
+	p.logger.Infof("ensuring data set size matches %s", humanReadableSize(want))
 
 	// calculate size of the current set
-	got, err := calculateDatasetSize()
+	got, err := p.calculateDatasetSize()
 	if err != nil {
 		return 0, 0, err
 	}
-	logger.Infof("current data set size: %s", humanReadableSize(got))
+	p.logger.Infof("current data set size: %s", humanReadableSize(got))
 
 	// remove excess data if necessary
 	if got > want {
-		logger.Infof("removing %s", humanReadableSize(got-want))
-		toRemove, err := calculateRandomBatch(got - want)
+		p.logger.Infof("removing %s", humanReadableSize(got-want))
+		toRemove, err := p.plannedBatch(phaseTrim, got-want)
 		if err != nil {
 			return 0, 0, err
 		}
-		for _, entry := range toRemove {
-			if err = withSaneTimeout(func(ctx context.Context) error {
-				return bc.DeleteObject(ctx, defaultBucketName, entry.Key)
-			}, nil); err != nil {
+		// objects of a resumed cycle that are gone were removed before the
+		// restart, objects used by another phase are left for the next cycle
+		for _, task := range toRemove {
+			if !p.locks.lockObject(task.Key) {
+				p.logger.Debugf("skipping '%s', it's used by another phase", task.Key)
+				continue
+			}
+			err = withSaneTimeout(func(ctx context.Context) error {
+				return bc.DeleteObject(ctx, p.Bucket, task.Key)
+			}, nil)
+			p.locks.objectRemoved(task.Key)
+			p.locks.unlockObject(task.Key)
+			if err != nil && !(p.resumedPlan() && strings.Contains(err.Error(), api.ErrObjectNotFound.Error())) {
 				return
-			} else {
-				removed += entry.Size
 			}
+			err = nil
+			removed += task.Size
+			p.taskDone(phaseTrim, task)
 		}
-		got, err = calculateDatasetSize()
+		got, err = p.calculateDatasetSize()
 		if err != nil {
 			return 0, removed, err
 		}
@@ -59,83 +72,64 @@ func ensureDataset(want int64) (added, removed int64, _ error) {
 
 	// add missing data if necessary
 	if removed == 0 && got < want {
-		logger.Infof("ensuring data set size matches %s - adding %s", humanReadableSize(want), humanReadableSize(want-got))
-
-		// fetch the redundancy settings
-		var rs api.RedundancySettings
-		if err := withSaneTimeout(func(ctx context.Context) error {
-			us, err := bc.UploadSettings(ctx)
-			if err != nil {
-				return err
-			}
-			rs = us.Redundancy
-			return nil
-		}, nil); err != nil {
-			return 0, removed, err
-		}
+		p.logger.Infof("ensuring data set size matches %s - adding %s", humanReadableSize(want), humanReadableSize(want-got))
 
 		// take into account redundancy in the return value
-		defer func() { added = int64(float64(added) * rs.Redundancy()) }()
+		defer func() { added = int64(float64(added) * p.rs.Redundancy()) }()
 
 		// find out how much data we are missing
 		missing := want - got
-		if missing < cfg.MinFilesize {
-			missing = cfg.MinFilesize
+		if missing < p.MinFilesize {
+			missing = p.MinFilesize
 		}
 
-		// calculate random file sizes to upload
-		var randomSizes []int64
-		for {
-			// calculate a random file size between our min and max
-			max := int64(math.Min(float64(missing), float64(cfg.MaxFilesize)))
-			min := int64(cfg.MinFilesize)
-
-			// round to the nearest chunk size
-			size := max
-			if max > min {
-				size = int64(frand.Intn(int(max-min))) + min
-			}
-
-			// add to the list
-			randomSizes = append(randomSizes, size)
-
-			// break if necessary
-			missing -= size
-			if missing <= 0 {
-				break
+		// calculate random file sizes to upload, a resumed cycle uploads the
+		// remaining sizes of its plan
+		randomSizes, err := p.plannedTasks(phaseUpload, func() (tasks []cycleTask, _ error) {
+			for {
+				// calculate a random file size between our min and max
+				max := int64(math.Min(float64(missing), float64(p.MaxFilesize)))
+				size := p.randomFileSize(max)
+
+				// add to the list
+				tasks = append(tasks, cycleTask{Size: size})
+
+				// break if necessary
+				missing -= size
+				if missing <= 0 {
+					return
+				}
 			}
+		})
+		if err != nil {
+			return 0, removed, err
 		}
 
-		var ulDone bool
+		// upload the planned sizes in batches of the upload concurrency
 		var ulMu sync.Mutex
-		var fI int
-		for {
-			var wg sync.WaitGroup
-			for i := 0; i < 4; i++ {
-				if fI == len(randomSizes)-1 {
-					ulDone = true
-					break
-				}
+		for len(randomSizes) > 0 {
+			batch := randomSizes[:min(len(randomSizes), p.UploadConcurrency)]
+			randomSizes = randomSizes[len(batch):]
 
+			var wg sync.WaitGroup
+			for _, task := range batch {
 				wg.Add(1)
-				go func(fileSize int64) {
+				go func(task cycleTask) {
 					defer wg.Done()
-					_, ulErr := uploadFile(fileSize)
+					_, ulErr := p.uploadFile(p.Bucket, task.Size)
 					ulMu.Lock()
 					if ulErr != nil && err == nil {
 						err = ulErr
 					} else if ulErr == nil {
-						added += fileSize
+						added += task.Size
 					}
 					ulMu.Unlock()
-				}(randomSizes[fI])
-				fI++
+					if ulErr == nil {
+						p.taskDone(phaseUpload, task)
+					}
+				}(task)
 			}
 			wg.Wait()
-
-			if ulDone {
-				break
-			}
 		}
 		if err != nil {
 			return added, removed, err
@@ -145,27 +139,36 @@ func ensureDataset(want int64) (added, removed int64, _ error) {
 	return
 }
 
-func pruneDataset(size int64) (removed int64, _ error) {
-	entries, err := calculateRandomBatch(size)
+func (p *profile) pruneDataset(size int64) (removed int64, _ error) {
+	tasks, err := p.plannedBatch(phaseDelete, size)
 	if err != nil {
 		return 0, err
 	}
 
-	// remove the data
-	for _, entry := range entries {
+	// remove the data, objects of a resumed cycle that are gone were removed
+	// before the restart and objects used by another phase are left for the
+	// next cycle
+	for _, task := range tasks {
+		if !p.locks.lockObject(task.Key) {
+			p.logger.Debugf("skipping '%s', it's used by another phase", task.Key)
+			continue
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-		if err := bc.DeleteObject(ctx, defaultBucketName, entry.Key); err != nil {
-			cancel()
+		err := bc.DeleteObject(ctx, p.Bucket, task.Key)
+		cancel()
+		p.locks.objectRemoved(task.Key)
+		p.locks.unlockObject(task.Key)
+		if err != nil && !(p.resumedPlan() && strings.Contains(err.Error(), api.ErrObjectNotFound.Error())) {
 			return removed, err
 		}
-		cancel()
-		removed += entry.Size
+		removed += task.Size
+		p.taskDone(phaseDelete, task)
 	}
 	return
 }
 
-func calculateDatasetSize() (size int64, _ error) {
-	entries, err := fetchEntries()
+func (p *profile) calculateDatasetSize() (size int64, _ error) {
+	entries, err := p.fetchEntries()
 	if err != nil {
 		return 0, err
 	}
@@ -176,8 +179,8 @@ func calculateDatasetSize() (size int64, _ error) {
 	return
 }
 
-func calculateRandomBatch(size int64) (batch []api.ObjectMetadata, _ error) {
-	entries, err := fetchEntries()
+func (p *profile) calculateRandomBatch(size int64) (batch []api.ObjectMetadata, _ error) {
+	entries, err := p.fetchEntries()
 	if err != nil {
 		return nil, err
 	}
@@ -196,9 +199,9 @@ func calculateRandomBatch(size int64) (batch []api.ObjectMetadata, _ error) {
 }
 
 // TODO: this fetches all entries, which is not ideal
-func fetchEntries() (entries []api.ObjectMetadata, err error) {
+func (p *profile) fetchEntries() (entries []api.ObjectMetadata, err error) {
 	err = withSaneTimeout(func(ctx context.Context) error {
-		res, err := bc.Objects(ctx, cfg.WorkDir, api.ListObjectOptions{Bucket: defaultBucketName})
+		res, err := bc.Objects(ctx, p.remotePrefix(), api.ListObjectOptions{Bucket: p.Bucket})
 		if err != nil {
 			return err
 		}
@@ -208,7 +211,9 @@ func fetchEntries() (entries []api.ObjectMetadata, err error) {
 	return
 }
 
-func createRandomFile(size int64) (_ string, err error) {
+// createFile writes the content to a temporary file and moves it to a unique
+// path that contains the content's hash.
+func createFile(content io.Reader) (_ string, err error) {
 	tmp := cfg.buildTmpFilepath()
 
 	var f *os.File
@@ -218,6 +223,7 @@ func createRandomFile(size int64) (_ string, err error) {
 	}
 	defer func() {
 		if err != nil {
+			_ = f.Close()
 			_ = os.Remove(tmp)
 			return
 		}
@@ -227,31 +233,9 @@ func createRandomFile(size int64) (_ string, err error) {
 	}()
 
 	h := blake3.New(blake3HashDigestSize, nil)
-
-	chunkSize := defaultChunkSize
-	remainging := size
-	if remainging < chunkSize {
-		chunkSize = remainging
-	}
-
-	chunk := make([]byte, chunkSize)
-	for remainging > 0 {
-		_, err = frand.Read(chunk)
-		if err != nil {
-			return
-		}
-
-		_, err = h.Write(chunk)
-		if err != nil {
-			return
-		}
-
-		_, err = f.Write(chunk)
-		if err != nil {
-			return
-		}
-
-		remainging -= int64(len(chunk))
+	_, err = io.CopyBuffer(io.MultiWriter(f, h), content, make([]byte, defaultChunkSize))
+	if err != nil {
+		return
 	}
 
 	dst := cfg.buildHashFilepath(h)
@@ -263,19 +247,34 @@ func createRandomFile(size int64) (_ string, err error) {
 	return dst, nil
 }
 
-func uploadFile(size int64) (path string, err error) {
-	totalSize := int64(float64(size) * rs.Redundancy())
-	logger.Debugf("uploading %v", humanReadableSize(size))
+func (p *profile) uploadFile(bucket string, size int64) (key string, err error) {
+	return p.uploadFileAs(bucket, "", size)
+}
+
+// uploadFileAs uploads a random file under the given key, or under the key
+// derived from the file's content if key is empty. It returns the key derived
+// from the file's content.
+func (p *profile) uploadFileAs(bucket, key string, size int64) (contentKey string, err error) {
+	totalSize := int64(float64(size) * p.rs.Redundancy())
+	p.logger.Debugf("uploading %v", humanReadableSize(size))
 	start := time.Now()
 	defer func() {
 		if err == nil {
 			elapsed := time.Since(start)
-			logger.Debugf("uploaded file to %v in %v (%v mbps)", path, elapsed, mbps(totalSize, elapsed.Milliseconds()))
+			p.logger.Debugf("uploaded file to %v in %v (%v mbps)", key, elapsed, mbps(totalSize, elapsed.Milliseconds()))
 		}
 	}()
 
-	// create random file
-	path, err = createRandomFile(size)
+	// generate the file's content
+	generator := p.ContentGenerators[frand.Intn(len(p.ContentGenerators))]
+	seed := frand.Entropy256()
+	content, err := newContentReader(generator, seed, size)
+	if err != nil {
+		return "", err
+	}
+
+	// create the file
+	path, err := createFile(content)
 	if err != nil {
 		return "", err
 	}
@@ -283,7 +282,7 @@ func uploadFile(size int64) (path string, err error) {
 	// defer the removal
 	defer func() {
 		if err := os.Remove(path); err != nil {
-			logger.Errorf("failed to remove file at path '%v', err: %v", path, err)
+			p.logger.Errorf("failed to remove file at path '%v', err: %v", path, err)
 		}
 	}()
 
@@ -297,43 +296,50 @@ func uploadFile(size int64) (path string, err error) {
 	// defer a close
 	defer f.Close()
 
-	// upload the file
+	// upload the file, its key is derived from its contents
+	contentKey = p.objectKey(filepath.Base(path))
+	if key == "" {
+		key = contentKey
+	}
+	uploadStart := time.Now()
 	err = withSaneTimeout(func(ctx context.Context) error {
-		_, err := wc.UploadObject(ctx, f, defaultBucketName, path, api.UploadObjectOptions{})
-		return err
+		return p.transport.UploadObject(ctx, f, bucket, key, newObjectAttributes(generator, seed).uploadOptions())
 	}, &totalSize)
+	p.recordUpload(bucket, key, time.Since(uploadStart), err)
 	return
 }
 
-func downloadFile(path string, size int64) (_ string, err error) {
-	logger.Debugf("downloading file %v (%v)", path, humanReadableSize(size))
+// downloadFile downloads the file and returns its hash, the file's content is
+// also written to check if it's not nil.
+func (p *profile) downloadFile(bucket, path string, size int64, check io.Writer) (_ string, err error) {
+	p.logger.Debugf("downloading file %v (%v)", path, humanReadableSize(size))
 	start := time.Now()
 	defer func() {
 		if err == nil {
 			elapsed := time.Since(start)
-			logger.Debugf("downloaded file %v in %v (%v mbps)", path, elapsed, mbps(int64(float64(size)*rs.Redundancy()), elapsed.Milliseconds()))
+			p.logger.Debugf("downloaded file %v in %v (%v mbps)", path, elapsed, mbps(int64(float64(size)*p.rs.Redundancy()), elapsed.Milliseconds()))
 		} else {
 			err = fmt.Errorf("download failed %v, err: %w", path, err)
 		}
 	}()
 
 	// create a tmp file to download to
-	tmpfile := filepath.Join(os.TempDir(), filepath.Base(path))
-	f, err := os.Create(tmpfile)
+	f, err := os.CreateTemp("", "*-"+filepath.Base(path))
 	if err != nil {
 		return "", err
 	}
+	tmpfile := f.Name()
 
 	// cleanup the file when we're done
 	defer func() {
 		if err := os.Remove(tmpfile); err != nil {
-			logger.Errorf("failed to remove tmp download file, err %v", err)
+			p.logger.Errorf("failed to remove tmp download file, err %v", err)
 		}
 	}()
 
 	// download the file
 	err = withSaneTimeout(func(ctx context.Context) error {
-		return wc.DownloadObject(ctx, f, defaultBucketName, path, api.DownloadObjectOptions{})
+		return p.transport.DownloadObject(ctx, f, bucket, path, api.DownloadObjectOptions{})
 	}, &size)
 	if err != nil {
 		return "", err
@@ -347,6 +353,10 @@ func downloadFile(path string, size int64) (_ string, err error) {
 
 	// hash the file
 	h := blake3.New(blake3HashDigestSize, nil)
+	var w io.Writer = h
+	if check != nil {
+		w = io.MultiWriter(h, check)
+	}
 	for {
 		chunk := make([]byte, defaultChunkSize)
 		n, err := f.Read(chunk)
@@ -357,7 +367,7 @@ func downloadFile(path string, size int64) (_ string, err error) {
 		}
 
 		chunk = chunk[:n]
-		_, err = h.Write(chunk)
+		_, err = w.Write(chunk)
 		if err != nil {
 			return "", err
 		}
@@ -366,28 +376,119 @@ func downloadFile(path string, size int64) (_ string, err error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
-func checkIntegrity(size int64) (downloaded int64, err error) {
-	logger.Debugf("checking integrity of %v files", humanReadableSize(size))
-	toDownload, err := calculateRandomBatch(size)
+func (p *profile) checkIntegrity(phase string, size int64) (downloaded int64, err error) {
+	p.logger.Debugf("checking integrity of %v files", humanReadableSize(size))
+
+	// objects other phases remove while the batch is verified are skipped,
+	// watching starts before the batch is picked so no removal is missed
+	wasRemoved, stop := p.locks.watchRemoved()
+	defer stop()
+
+	var toDownload []cycleTask
+	if p.SweepPeriod > 0 && phase == phaseVerify {
+		toDownload, err = p.plannedTasks(phase, func() ([]cycleTask, error) { return p.sweepBatch(size) })
+	} else {
+		toDownload, err = p.plannedBatch(phase, size)
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	for _, entry := range toDownload {
-		var hash string
-		hash, err = downloadFile(entry.Key, entry.Size)
-		if err != nil {
-			return
+	for _, task := range toDownload {
+		if !p.locks.lockObject(task.Key) {
+			p.logger.Debugf("skipping '%s', it's used by another phase", task.Key)
+			p.taskDone(phase, task)
+			continue
+		} else if wasRemoved(task.Key) {
+			p.locks.unlockObject(task.Key)
+			p.logger.Debugf("skipping '%s', it was removed by another phase", task.Key)
+			p.taskDone(phase, task)
+			continue
 		}
-
-		downloaded += entry.Size
-		expected := strings.TrimSuffix(filepath.Base(entry.Key), dataExtension)
-		if hash != expected {
-			err = fmt.Errorf("hash mismatch for file '%v', expected '%v', got '%v'; %w", entry.Key, expected, hash, errIntegrity)
-			logger.Error(err)
+		err = p.verifyObject(p.Bucket, task.Key, task.Size)
+		p.locks.unlockObject(task.Key)
+		if err != nil && p.resumedPlan() && strings.Contains(err.Error(), api.ErrObjectNotFound.Error()) {
+			// the object was removed before the cycle was resumed, e.g. by
+			// churn
+			p.logger.Debugf("skipping '%s', it was removed before the cycle was resumed", task.Key)
+			err = nil
+			p.taskDone(phase, task)
+			continue
+		} else if errors.Is(err, errIntegrity) {
+			p.logger.Error(err)
+			return
+		} else if err != nil {
 			return
 		}
+		downloaded += task.Size
+		p.taskDone(phase, task)
+		p.recordVerified(task.Key)
 	}
 
 	return
 }
+
+// verifyObject downloads the object and compares its hash to the one in its
+// key. Objects whose content was generated by a known generator are compared
+// to the regenerated content as well, which pinpoints where they differ, and
+// their attributes are checked to have round-tripped.
+func (p *profile) verifyObject(bucket, key string, size int64) error {
+	// fetch the object's metadata
+	var obj api.Object
+	if err := withSaneTimeout(func(ctx context.Context) (err error) {
+		obj, err = bc.Object(ctx, bucket, key, api.GetObjectOptions{})
+		return
+	}, nil); err != nil {
+		return fmt.Errorf("failed to fetch metadata of '%v'; %w", key, err)
+	}
+
+	// download the object, comparing it to its regenerated content
+	contentMD5 := md5.New()
+	check := []io.Writer{contentMD5}
+	var checker *contentChecker
+	expectedContent, generator, ok := contentFromMetadata(obj.Metadata, size)
+	if ok {
+		checker = newContentChecker(expectedContent)
+		check = append(check, checker)
+	}
+	start := time.Now()
+	hash, err := p.downloadFile(bucket, key, size, io.MultiWriter(check...))
+	if err == nil && hash != expectedHash(key) {
+		p.hosts.recordDownload(obj, time.Since(start), errIntegrity)
+	} else {
+		p.hosts.recordDownload(obj, time.Since(start), err)
+	}
+	if err != nil {
+		return err
+	}
+
+	expected := expectedHash(key)
+	if hash != expected {
+		if checker != nil && checker.mismatch != -1 {
+			return fmt.Errorf("hash mismatch for file '%v', expected '%v', got '%v', %s content differs starting at offset %d; %w", key, expected, hash, generator, checker.mismatch, errIntegrity)
+		}
+		return fmt.Errorf("hash mismatch for file '%v', expected '%v', got '%v'; %w", key, expected, hash, errIntegrity)
+	} else if checker != nil && checker.mismatch != -1 {
+		return fmt.Errorf("file '%v' doesn't match its recorded %s content, differs starting at offset %d; %w", key, generator, checker.mismatch, errIntegrity)
+	}
+
+	// check the object's attributes
+	if attrs, ok := attributesFromMetadata(obj.Metadata); ok {
+		return p.verifyAttributes(bucket, key, obj, attrs, size, hex.EncodeToString(contentMD5.Sum(nil)))
+	}
+	return nil
+}
+
+// withNewSuffix returns the key with its random suffix replaced, the new key
+// still contains the hash of the object's contents.
+func withNewSuffix(key string) string {
+	return path.Join(path.Dir(key), fmt.Sprintf("%s-%s%s", expectedHash(key), randomString()[:8], dataExtension))
+}
+
+// expectedHash returns the hash of the object's contents, which is part of its
+// key. Keys end with a random suffix, except for those of objects uploaded by
+// older versions.
+func expectedHash(key string) string {
+	hash, _, _ := strings.Cut(strings.TrimSuffix(filepath.Base(key), dataExtension), "-")
+	return hash
+}
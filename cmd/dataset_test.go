@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.sia.tech/renterd/api"
+)
+
+func TestExpectedHash(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"/data/abcdef.data", "abcdef"},
+		{"/data/abcdef-0123abcd.data", "abcdef"},
+		{"data/sub/abcdef-0123abcd.data", "abcdef"},
+		{"abcdef", "abcdef"},
+	}
+	for _, test := range tests {
+		if got := expectedHash(test.key); got != test.want {
+			t.Errorf("expectedHash(%q) = %q, want %q", test.key, got, test.want)
+		}
+	}
+}
+
+func TestCreateFileUnique(t *testing.T) {
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+	cfg.WorkDir = t.TempDir()
+
+	// files with the same content get different paths with the same hash
+	content := bytes.Repeat([]byte{0}, 1<<10)
+	a, err := createFile(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := createFile(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatalf("expected unique paths, got '%s' twice", a)
+	} else if expectedHash(a) != expectedHash(b) {
+		t.Fatalf("expected the same hash, got '%s' and '%s'", expectedHash(a), expectedHash(b))
+	}
+	for _, path := range []string{a, b} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		} else if filepath.Dir(path) != cfg.WorkDir {
+			t.Fatalf("expected '%s' to be in the work dir", path)
+		}
+	}
+}
+
+func TestWithNewSuffix(t *testing.T) {
+	for _, key := range []string{"/data/abcdef.data", "/data/abcdef-0123abcd.data"} {
+		got := withNewSuffix(key)
+		if got == key {
+			t.Fatalf("expected a new key for '%s'", key)
+		} else if filepath.Dir(got) != "/data" || filepath.Ext(got) != dataExtension {
+			t.Fatalf("expected '%s' to stay in the same directory with the same extension", got)
+		} else if expectedHash(got) != "abcdef" {
+			t.Fatalf("expected '%s' to keep the hash", got)
+		}
+	}
+}
+
+func TestPruneDatasetResumed(t *testing.T) {
+	prevStore := store
+	t.Cleanup(func() { store = prevStore })
+	store = newTestStore(t)
+
+	// every object is gone
+	p := newTestProfile(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, api.ErrObjectNotFound.Error(), http.StatusNotFound)
+	})
+
+	// plan the deletion of two objects
+	plan, err := store.beginCycle(p.Name, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := plan.tasks(phaseDelete, func() ([]cycleTask, error) {
+		return []cycleTask{{Key: "/data/a.data", Size: 1}, {Key: "/data/b.data", Size: 2}}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a missing object fails a cycle that wasn't resumed
+	p.plan = plan
+	if _, err := p.pruneDataset(3); err == nil || !strings.Contains(err.Error(), api.ErrObjectNotFound.Error()) {
+		t.Fatalf("expected object not found error, got %v", err)
+	}
+
+	// a resumed cycle counts missing objects as deleted
+	p.plan, err = store.beginCycle(p.Name, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if !p.plan.resumed {
+		t.Fatal("expected cycle to be resumed")
+	} else if removed, err := p.pruneDataset(3); err != nil {
+		t.Fatal(err)
+	} else if removed != 3 {
+		t.Fatalf("expected 3 bytes removed, got %d", removed)
+	}
+}
+
+func TestEnsureDatasetResumed(t *testing.T) {
+	prevStore := store
+	t.Cleanup(func() { store = prevStore })
+	store = newTestStore(t)
+	cfg.WorkDir = t.TempDir()
+
+	// the data set is empty
+	p := newTestProfile(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.ObjectsResponse{})
+	})
+	uploads := memTransport{objects: make(map[string][]byte)}
+	p.transport = uploads
+	p.rs = api.RedundancySettings{MinShards: 1, TotalShards: 1}
+	p.ContentGenerators = []string{contentRandom}
+	p.MinFilesize, p.MaxFilesize = 1<<10, 1<<20
+	p.UploadConcurrency = 4
+
+	// plan a single upload, smaller than the max file size, and restart before
+	// it's uploaded
+	plan, err := store.beginCycle(p.Name, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := plan.tasks(phaseUpload, func() ([]cycleTask, error) {
+		return []cycleTask{{Size: 1 << 10}}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the resumed cycle uploads the planned size
+	p.plan, err = store.beginCycle(p.Name, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if !p.plan.resumed {
+		t.Fatal("expected cycle to be resumed")
+	} else if added, _, err := p.ensureDataset(1 << 10); err != nil {
+		t.Fatal(err)
+	} else if added != 1<<10 {
+		t.Fatalf("expected %d bytes added, got %d", 1<<10, added)
+	} else if len(uploads.objects) != 1 {
+		t.Fatalf("expected 1 upload, got %d", len(uploads.objects))
+	}
+
+	// the task is done, so resuming again doesn't upload it again
+	p.plan, err = store.beginCycle(p.Name, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if remaining, err := p.plan.tasks(phaseUpload, func() ([]cycleTask, error) {
+		t.Fatal("expected the upload to stay planned")
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if len(remaining) != 0 {
+		t.Fatalf("expected no remaining uploads, got %v", remaining)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	rhpv2 "go.sia.tech/core/rhp/v2"
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+)
+
+// maxReportedHosts is the number of hosts the report lists.
+const maxReportedHosts = 10
+
+// scoreboardMu guards the host scoreboards, concurrent uploads and phases
+// attribute their transfers while the scoreboard is being stored.
+var scoreboardMu sync.Mutex
+
+type (
+	// hostScoreboard tracks every host that stored part of the dataset, keyed
+	// by host key.
+	hostScoreboard map[string]*hostScore
+
+	// hostScore attributes transfers to the hosts that store the object's
+	// sectors, a failed or slow transfer counts against all of them since
+	// renterd doesn't expose which host caused it. Failed uploads count
+	// against every host the renter has an active contract with, since the
+	// object's hosts aren't known.
+	hostScore struct {
+		// ContractSectors is the number of sectors in the host's contracts,
+		// derived from their size. It's contract data, so it includes the
+		// data of other profiles and sectors that are prunable.
+		ContractSectors uint64 `json:"contractSectors"`
+
+		Downloads     int       `json:"downloads"`
+		Failures      int       `json:"failures"`
+		AvgMSPerMiB   float64   `json:"avgMSPerMiB"`
+		LastFailure   string    `json:"lastFailure,omitempty"`
+		LastFailureAt time.Time `json:"lastFailureAt,omitempty"`
+
+		Uploads           int     `json:"uploads"`
+		UploadFailures    int     `json:"uploadFailures"`
+		AvgUploadMSPerMiB float64 `json:"avgUploadMSPerMiB"`
+
+		// interactions as tracked by renterd
+		SuccessfulInteractions float64       `json:"successfulInteractions"`
+		FailedInteractions     float64       `json:"failedInteractions"`
+		LostSectors            uint64        `json:"lostSectors"`
+		Uptime                 time.Duration `json:"uptime"`
+		Downtime               time.Duration `json:"downtime"`
+
+		LastSeen time.Time `json:"lastSeen"`
+	}
+)
+
+// recordDownload attributes the download of the object to the hosts storing
+// its sectors.
+func (sb hostScoreboard) recordDownload(obj api.Object, elapsed time.Duration, err error) {
+	if sb == nil || obj.Object == nil {
+		return
+	}
+
+	scoreboardMu.Lock()
+	defer scoreboardMu.Unlock()
+	for _, hk := range objectHosts(obj) {
+		hs := sb.host(hk)
+		if err != nil {
+			hs.Failures++
+			hs.recordFailure(err)
+			continue
+		}
+		hs.AvgMSPerMiB = avgMSPerMiB(hs.AvgMSPerMiB, hs.Downloads, obj.Size, elapsed)
+		hs.Downloads++
+	}
+}
+
+// recordUpload attributes the upload of the object to the hosts storing its
+// sectors.
+func (sb hostScoreboard) recordUpload(obj api.Object, elapsed time.Duration) {
+	if sb == nil || obj.Object == nil {
+		return
+	}
+
+	scoreboardMu.Lock()
+	defer scoreboardMu.Unlock()
+	for _, hk := range objectHosts(obj) {
+		hs := sb.host(hk)
+		hs.AvgUploadMSPerMiB = avgMSPerMiB(hs.AvgUploadMSPerMiB, hs.Uploads, obj.Size, elapsed)
+		hs.Uploads++
+	}
+}
+
+// recordUploadFailure attributes a failed upload to the given hosts, the
+// hosts the renter could have uploaded to.
+func (sb hostScoreboard) recordUploadFailure(hosts []types.PublicKey, err error) {
+	if sb == nil {
+		return
+	}
+
+	scoreboardMu.Lock()
+	defer scoreboardMu.Unlock()
+	for _, hk := range hosts {
+		hs := sb.host(hk)
+		hs.UploadFailures++
+		hs.recordFailure(err)
+	}
+}
+
+func (hs *hostScore) recordFailure(err error) {
+	hs.LastFailure = err.Error()
+	hs.LastFailureAt = time.Now()
+}
+
+// avgMSPerMiB adds the transfer of size bytes in elapsed to the average of n
+// previous transfers.
+func avgMSPerMiB(avg float64, n int, size int64, elapsed time.Duration) float64 {
+	mib := float64(size) / (1 << 20)
+	if mib <= 0 {
+		return avg
+	}
+	msPerMiB := float64(elapsed.Milliseconds()) / mib
+	return (avg*float64(n) + msPerMiB) / float64(n+1)
+}
+
+// recordUpload attributes the upload of the object to the hosts in the
+// profile's scoreboard, a failed upload counts against every host the renter
+// has an active contract with.
+func (p *profile) recordUpload(bucket, key string, elapsed time.Duration, err error) {
+	if p.hosts == nil {
+		return
+	}
+
+	if err != nil {
+		hosts, hErr := contractHosts()
+		if hErr != nil {
+			p.logger.Warnf("failed to attribute failed upload of '%v' to hosts, err: %v", key, hErr)
+			return
+		}
+		p.hosts.recordUploadFailure(hosts, err)
+		return
+	}
+
+	var obj api.Object
+	if err := withSaneTimeout(func(ctx context.Context) (err error) {
+		obj, err = bc.Object(ctx, bucket, key, api.GetObjectOptions{})
+		return
+	}, nil); err != nil {
+		p.logger.Warnf("failed to attribute upload of '%v' to hosts, err: %v", key, err)
+		return
+	}
+	p.hosts.recordUpload(obj, elapsed)
+}
+
+// refresh updates the number of sectors in every host's contracts according
+// to the contract snapshot, along with renterd's view of its interactions. A
+// host that fails to be fetched doesn't stop the others from being refreshed.
+func (sb hostScoreboard) refresh(snapshot *contractSnapshot) error {
+	if sb == nil || snapshot == nil {
+		return nil
+	}
+
+	sectors := make(map[types.PublicKey]uint64)
+	for _, c := range snapshot.PerContract {
+		sectors[c.HostKey] += c.Size / rhpv2.SectorSize
+	}
+
+	var failed []string
+	for hk, n := range sectors {
+		var h api.Host
+		err := withSaneTimeout(func(ctx context.Context) (err error) {
+			h, err = bc.Host(ctx, hk)
+			return
+		}, nil)
+
+		scoreboardMu.Lock()
+		hs := sb.host(hk)
+		hs.ContractSectors = n
+		if err == nil {
+			hs.SuccessfulInteractions = h.Interactions.SuccessfulInteractions
+			hs.FailedInteractions = h.Interactions.FailedInteractions
+			hs.LostSectors = h.Interactions.LostSectors
+			hs.Uptime = h.Interactions.Uptime
+			hs.Downtime = h.Interactions.Downtime
+		}
+		scoreboardMu.Unlock()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", hk, err))
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to fetch %d hosts, err: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (sb hostScoreboard) host(hk types.PublicKey) *hostScore {
+	hs, ok := sb[hk.String()]
+	if !ok {
+		hs = &hostScore{}
+		sb[hk.String()] = hs
+	}
+	hs.LastSeen = time.Now()
+	return hs
+}
+
+// String lists the hosts with the most failures, slowest first on a tie.
+func (sb hostScoreboard) String() string {
+	keys := sortedKeys(sb)
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := sb[keys[i]], sb[keys[j]]
+		if a.Failures+a.UploadFailures != b.Failures+b.UploadFailures {
+			return a.Failures+a.UploadFailures > b.Failures+b.UploadFailures
+		} else if a.AvgMSPerMiB != b.AvgMSPerMiB {
+			return a.AvgMSPerMiB > b.AvgMSPerMiB
+		}
+		return a.AvgUploadMSPerMiB > b.AvgUploadMSPerMiB
+	})
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "hosts:              %d\n", len(keys))
+	for i, hk := range keys {
+		if i == maxReportedHosts {
+			break
+		}
+		hs := sb[hk]
+		fmt.Fprintf(&out, "  %s: %d contract sectors, %d downloads, %d failures, %.0f ms/MiB, %d uploads, %d failures, %.0f ms/MiB, %d lost sectors\n", hk, hs.ContractSectors, hs.Downloads, hs.Failures, hs.AvgMSPerMiB, hs.Uploads, hs.UploadFailures, hs.AvgUploadMSPerMiB, hs.LostSectors)
+	}
+	return out.String()
+}
+
+// objectHosts returns the unique hosts storing the object's sectors.
+func objectHosts(obj api.Object) (hosts []types.PublicKey) {
+	seen := make(map[types.PublicKey]bool)
+	for _, slab := range obj.Slabs {
+		for _, shard := range slab.Shards {
+			for hk := range shard.Contracts {
+				if !seen[hk] {
+					seen[hk] = true
+					hosts = append(hosts, hk)
+				}
+			}
+		}
+	}
+	return
+}
+
+// contractHosts returns the hosts the renter has an active contract with.
+func contractHosts() (hosts []types.PublicKey, _ error) {
+	var contracts []api.ContractMetadata
+	if err := withSaneTimeout(func(ctx context.Context) (err error) {
+		contracts, err = bc.Contracts(ctx, api.ContractsOpts{FilterMode: api.ContractFilterModeActive})
+		return
+	}, nil); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[types.PublicKey]bool)
+	for _, c := range contracts {
+		if !seen[c.HostKey] {
+			seen[c.HostKey] = true
+			hosts = append(hosts, c.HostKey)
+		}
+	}
+	return
+}
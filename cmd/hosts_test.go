@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	rhpv2 "go.sia.tech/core/rhp/v2"
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+	"go.sia.tech/renterd/object"
+)
+
+func TestHostScoreboardRefresh(t *testing.T) {
+	good, bad := types.PublicKey{1}, types.PublicKey{2}
+
+	// serve the good host, fail to fetch the bad one
+	newTestBus(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/host/"+good.String() {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(api.Host{Interactions: api.HostInteractions{LostSectors: 3, SuccessfulInteractions: 7}})
+	})
+
+	sb := make(hostScoreboard)
+	sb.host(bad).LostSectors = 1
+	err := sb.refresh(&contractSnapshot{PerContract: []contractSnapshotEntry{
+		{HostKey: good, Size: 2 * rhpv2.SectorSize},
+		{HostKey: good, Size: rhpv2.SectorSize},
+		{HostKey: bad, Size: 5 * rhpv2.SectorSize},
+	}})
+	if err == nil || !strings.Contains(err.Error(), bad.String()) {
+		t.Fatalf("expected the bad host to fail, got %v", err)
+	}
+
+	// the good host is refreshed regardless, the bad host keeps its previous
+	// interactions
+	if hs := sb[good.String()]; hs.ContractSectors != 3 || hs.LostSectors != 3 || hs.SuccessfulInteractions != 7 {
+		t.Fatalf("good host wasn't refreshed, got %+v", hs)
+	} else if hs := sb[bad.String()]; hs.ContractSectors != 5 || hs.LostSectors != 1 {
+		t.Fatalf("bad host wasn't refreshed, got %+v", hs)
+	}
+}
+
+func TestHostScoreboardTransfers(t *testing.T) {
+	a, b, c := types.PublicKey{1}, types.PublicKey{2}, types.PublicKey{3}
+	obj := api.Object{
+		ObjectMetadata: api.ObjectMetadata{Size: 2 << 20},
+		Object: &object.Object{Slabs: []object.SlabSlice{{Slab: object.Slab{Shards: []object.Sector{
+			{Contracts: map[types.PublicKey][]types.FileContractID{a: {{1}}}},
+			{Contracts: map[types.PublicKey][]types.FileContractID{a: {{1}}, b: {{2}}}},
+		}}}}},
+	}
+
+	// transfers are attributed to the object's hosts
+	sb := make(hostScoreboard)
+	sb.recordUpload(obj, 200*time.Millisecond)
+	sb.recordUpload(obj, 400*time.Millisecond)
+	sb.recordDownload(obj, 100*time.Millisecond, nil)
+	sb.recordDownload(obj, time.Second, errors.New("download failed"))
+	for _, hk := range []types.PublicKey{a, b} {
+		hs := sb[hk.String()]
+		if hs.Uploads != 2 || hs.AvgUploadMSPerMiB != 150 {
+			t.Fatalf("expected 2 uploads at 150 ms/MiB, got %+v", hs)
+		} else if hs.Downloads != 1 || hs.Failures != 1 || hs.AvgMSPerMiB != 50 {
+			t.Fatalf("expected 1 download at 50 ms/MiB and 1 failure, got %+v", hs)
+		} else if hs.LastFailure != "download failed" {
+			t.Fatalf("expected the download failure, got %+v", hs)
+		}
+	}
+	if _, ok := sb[c.String()]; ok {
+		t.Fatal("expected host c to not be attributed any transfers")
+	}
+
+	// a failed upload counts against the given hosts
+	sb.recordUploadFailure([]types.PublicKey{a, c}, errors.New("upload failed"))
+	if hs := sb[a.String()]; hs.UploadFailures != 1 || hs.LastFailure != "upload failed" {
+		t.Fatalf("expected an upload failure, got %+v", hs)
+	} else if hs := sb[c.String()]; hs.UploadFailures != 1 || hs.Uploads != 0 {
+		t.Fatalf("expected an upload failure, got %+v", hs)
+	} else if hs := sb[b.String()]; hs.UploadFailures != 0 {
+		t.Fatalf("expected no upload failures, got %+v", hs)
+	}
+
+	// the report lists the hosts with the most failures first
+	if report := sb.String(); strings.Index(report, a.String()) > strings.Index(report, b.String()) {
+		t.Fatalf("expected host a to be listed first, got\n%s", report)
+	}
+}
+
+func TestProfileRecordUpload(t *testing.T) {
+	good, bad := types.PublicKey{1}, types.PublicKey{2}
+	p := newTestProfile(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/contracts":
+			json.NewEncoder(w).Encode([]api.ContractMetadata{{HostKey: good}, {HostKey: bad}, {HostKey: good}})
+		case strings.HasPrefix(r.URL.Path, "/object/"):
+			key := object.GenerateEncryptionKey(object.EncryptionKeyTypeBasic)
+			json.NewEncoder(w).Encode(api.Object{
+				ObjectMetadata: api.ObjectMetadata{Size: 1 << 20},
+				Object: &object.Object{Key: key, Slabs: []object.SlabSlice{{Slab: object.Slab{EncryptionKey: key, Shards: []object.Sector{
+					{Contracts: map[types.PublicKey][]types.FileContractID{good: {{1}}}},
+				}}}}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	// without a scoreboard nothing is recorded
+	p.recordUpload(defaultBucketName, "/data/key", time.Second, nil)
+
+	p.hosts = make(hostScoreboard)
+	p.recordUpload(defaultBucketName, "/data/key", time.Second, nil)
+	if hs := p.hosts[good.String()]; hs == nil || hs.Uploads != 1 || hs.AvgUploadMSPerMiB != 1000 {
+		t.Fatalf("expected an upload at 1000 ms/MiB, got %+v", hs)
+	} else if _, ok := p.hosts[bad.String()]; ok {
+		t.Fatal("expected the upload to only be attributed to the object's hosts")
+	}
+
+	// a failed upload counts against every contracted host once
+	p.recordUpload(defaultBucketName, "/data/key", time.Second, errors.New("upload failed"))
+	for _, hk := range []types.PublicKey{good, bad} {
+		if hs := p.hosts[hk.String()]; hs == nil || hs.UploadFailures != 1 {
+			t.Fatalf("expected an upload failure for %v, got %+v", hk, hs)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.sia.tech/renterd/api"
+	"lukechampine.com/frand"
+)
+
+const (
+	// listingPageSize is the page size used to check pagination, it's small
+	// so every listing spans multiple pages
+	listingPageSize = 3
+
+	// listingSuffix is appended to the profile's prefix to get the prefix the
+	// listing hierarchy is built under, it's kept out of the dataset
+	listingSuffix = ".listing"
+)
+
+// listingPaths are the paths of the objects in the hierarchy that's built to
+// check listings, relative to the hierarchy's root. Renterd sorts names in SQL
+// with a binary collation, the expected order is the byte order of the names,
+// which matches both SQLite's and MySQL's utf8mb4_bin. The latter pads names
+// with spaces when comparing them, so no path or directory may be a prefix of
+// another one followed by a space or control character.
+var listingPaths = []string{
+	"a",
+	"A",
+	"0",
+	"b c",
+	"b/c",
+	"b/c d/e",
+	"dir/file",
+	"dir/sub/file",
+	"dir/sub/sub/file",
+	"deep/1/2/3/4/5/6/7/8/9/file",
+	"spaces /in /dirs",
+	"ünïcödé/ñame",
+	"日本語/ファイル",
+	"emoji/🚀",
+	"special/!$&'()*+,;=@[]",
+	"special/%20%2F",
+	"special/#?",
+	"special/~tilde",
+	"trailing.",
+	"z",
+}
+
+// listingEntry is an entry the listing is expected to return.
+type listingEntry struct {
+	key  string
+	size int64
+}
+
+// checkListing builds a nested hierarchy of objects and checks that listing it
+// with delimiters, prefixes, substrings, sorting and pagination returns
+// exactly the expected entries, in the expected order. The hierarchy is
+// removed afterwards.
+func (p *profile) checkListing() (err error) {
+	root := remotePrefix(p.Prefix+listingSuffix) + randomString()[:8] + "/"
+	p.logger.Infof("checking listings of %d objects under '%s'", len(listingPaths), root)
+
+	// build the hierarchy, every object gets a unique size so sorting by size
+	// is deterministic
+	var entries []listingEntry
+	for i, rel := range frand.Perm(len(listingPaths)) {
+		entries = append(entries, listingEntry{key: root + listingPaths[rel], size: int64(i + 1)})
+	}
+	defer func() {
+		if rmErr := withSaneTimeout(func(ctx context.Context) error {
+			return bc.RemoveObjects(ctx, p.Bucket, root)
+		}, nil); rmErr != nil {
+			p.logger.Errorf("failed to remove listing hierarchy '%s', err: %v", root, rmErr)
+		}
+	}()
+	for _, e := range entries {
+		if err := withSaneTimeout(func(ctx context.Context) error {
+			return p.transport.UploadObject(ctx, bytes.NewReader(frand.Bytes(int(e.size))), p.Bucket, strings.TrimPrefix(e.key, "/"), api.UploadObjectOptions{})
+		}, nil); err != nil {
+			return fmt.Errorf("failed to upload '%s'; %w", e.key, err)
+		}
+	}
+
+	var problems []string
+	check := func(desc string, got []api.ObjectMetadata, want []string) {
+		if problem := compareListing(got, want); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", desc, problem))
+		}
+	}
+
+	// recursive listings in every order, names are sorted by their bytes
+	byName := sortedEntries(entries, func(a, b listingEntry) bool { return a.key < b.key })
+	bySize := sortedEntries(entries, func(a, b listingEntry) bool { return a.size < b.size })
+	for _, tc := range []struct {
+		sortBy, sortDir string
+		want            []string
+	}{
+		{api.ObjectSortByName, api.SortDirAsc, byName},
+		{api.ObjectSortByName, api.SortDirDesc, reversed(byName)},
+		{api.ObjectSortBySize, api.SortDirAsc, bySize},
+		{api.ObjectSortBySize, api.SortDirDesc, reversed(bySize)},
+	} {
+		opts := api.ListObjectOptions{SortBy: tc.sortBy, SortDir: tc.sortDir}
+		got, err := p.listObjects(root, opts)
+		if err != nil {
+			return err
+		}
+		check(fmt.Sprintf("list '%s' by %s %s", root, tc.sortBy, tc.sortDir), got, tc.want)
+
+		got, err = p.listObjectsPaginated(root, opts)
+		if err != nil {
+			return err
+		}
+		check(fmt.Sprintf("paginated list '%s' by %s %s", root, tc.sortBy, tc.sortDir), got, tc.want)
+	}
+
+	// listings of every directory with a delimiter
+	for _, dir := range listingDirs(root, byName) {
+		want := listingChildren(dir, byName)
+		got, err := p.listObjects(dir, api.ListObjectOptions{Delimiter: "/"})
+		if err != nil {
+			return err
+		}
+		check(fmt.Sprintf("list directory '%s'", dir), got, want)
+
+		got, err = p.listObjectsPaginated(dir, api.ListObjectOptions{Delimiter: "/"})
+		if err != nil {
+			return err
+		}
+		check(fmt.Sprintf("paginated list directory '%s'", dir), got, want)
+	}
+
+	// listings of partial prefixes and substrings
+	for _, e := range entries {
+		rel := []rune(strings.TrimPrefix(e.key, root))
+		partial := root + string(rel[:len(rel)/2])
+		got, err := p.listObjects(partial, api.ListObjectOptions{})
+		if err != nil {
+			return err
+		}
+		check(fmt.Sprintf("list prefix '%s'", partial), got, filterKeys(byName, func(key string) bool { return strings.HasPrefix(key, partial) }))
+
+		substring := string(rel[len(rel)/2:])
+		got, err = p.listObjects(root, api.ListObjectOptions{Substring: substring})
+		if err != nil {
+			return err
+		}
+		check(fmt.Sprintf("list substring '%s'", substring), got, filterKeys(byName, func(key string) bool { return strings.Contains(key, substring) }))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d listings were incorrect:\n  - %s", len(problems), strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+func (p *profile) listObjects(prefix string, opts api.ListObjectOptions) (objects []api.ObjectMetadata, err error) {
+	opts.Bucket = p.Bucket
+	err = withSaneTimeout(func(ctx context.Context) error {
+		res, err := bc.Objects(ctx, prefix, opts)
+		if err != nil {
+			return fmt.Errorf("failed to list '%s'; %w", prefix, err)
+		}
+		objects = res.Objects
+		return nil
+	}, nil)
+	return
+}
+
+// listObjectsPaginated lists the objects page by page, following the markers.
+func (p *profile) listObjectsPaginated(prefix string, opts api.ListObjectOptions) (objects []api.ObjectMetadata, err error) {
+	opts.Bucket = p.Bucket
+	opts.Limit = listingPageSize
+	for i := 0; ; i++ {
+		var res api.ObjectsResponse
+		if err := withSaneTimeout(func(ctx context.Context) (err error) {
+			res, err = bc.Objects(ctx, prefix, opts)
+			return
+		}, nil); err != nil {
+			return nil, fmt.Errorf("failed to list page %d of '%s'; %w", i, prefix, err)
+		} else if len(res.Objects) > listingPageSize {
+			return nil, fmt.Errorf("page %d of '%s' has %d entries, exceeding the limit of %d", i, prefix, len(res.Objects), listingPageSize)
+		}
+		objects = append(objects, res.Objects...)
+		if !res.HasMore {
+			return objects, nil
+		} else if res.NextMarker == "" || res.NextMarker == opts.Marker {
+			return nil, fmt.Errorf("page %d of '%s' has more entries but no new marker", i, prefix)
+		}
+		opts.Marker = res.NextMarker
+	}
+}
+
+// compareListing returns a description of how the listing differs from the
+// expected keys, or an empty string if it doesn't.
+func compareListing(got []api.ObjectMetadata, want []string) string {
+	seen := make(map[string]int)
+	var keys []string
+	for _, obj := range got {
+		seen[obj.Key]++
+		keys = append(keys, obj.Key)
+	}
+
+	var issues []string
+	expected := make(map[string]bool)
+	for _, key := range want {
+		expected[key] = true
+		if seen[key] == 0 {
+			issues = append(issues, fmt.Sprintf("missing '%s'", key))
+		}
+	}
+	for _, key := range sortedKeys(seen) {
+		if !expected[key] {
+			issues = append(issues, fmt.Sprintf("unexpected '%s'", key))
+		}
+		if seen[key] > 1 {
+			issues = append(issues, fmt.Sprintf("duplicate '%s' (%d times)", key, seen[key]))
+		}
+	}
+	if len(issues) == 0 && strings.Join(keys, "\x00") != strings.Join(want, "\x00") {
+		issues = append(issues, fmt.Sprintf("misordered, expected %q, got %q", want, keys))
+	}
+	return strings.Join(issues, ", ")
+}
+
+// listingDirs returns the root and every directory below it.
+func listingDirs(root string, keys []string) []string {
+	dirs := map[string]bool{root: true}
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, root), "/")
+		for i := 1; i < len(parts); i++ {
+			dirs[root+strings.Join(parts[:i], "/")+"/"] = true
+		}
+	}
+	return sortedKeys(dirs)
+}
+
+// listingChildren returns the files and directories directly below the given
+// directory, sorted by name.
+func listingChildren(dir string, keys []string) []string {
+	children := make(map[string]bool)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, dir) {
+			continue
+		}
+		rel := strings.TrimPrefix(key, dir)
+		if i := strings.Index(rel, "/"); i != -1 {
+			rel = rel[:i+1]
+		}
+		children[dir+rel] = true
+	}
+	return sortedKeys(children)
+}
+
+func sortedEntries(entries []listingEntry, less func(a, b listingEntry) bool) []string {
+	sorted := append([]listingEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+	keys := make([]string, len(sorted))
+	for i, e := range sorted {
+		keys[i] = e.key
+	}
+	return keys
+}
+
+func filterKeys(keys []string, keep func(key string) bool) (filtered []string) {
+	for _, key := range keys {
+		if keep(key) {
+			filtered = append(filtered, key)
+		}
+	}
+	return
+}
+
+func reversed(keys []string) []string {
+	r := make([]string, len(keys))
+	for i, key := range keys {
+		r[len(keys)-1-i] = key
+	}
+	return r
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"cmp"
+	"strings"
+	"testing"
+
+	"go.sia.tech/renterd/api"
+)
+
+func TestCompareListing(t *testing.T) {
+	objects := func(keys ...string) (objs []api.ObjectMetadata) {
+		for _, key := range keys {
+			objs = append(objs, api.ObjectMetadata{Key: key})
+		}
+		return
+	}
+
+	tests := []struct {
+		name string
+		got  []api.ObjectMetadata
+		want []string
+		diff string
+	}{
+		{
+			name: "equal",
+			got:  objects("/a", "/b", "/c"),
+			want: []string{"/a", "/b", "/c"},
+		},
+		{
+			name: "empty",
+		},
+		{
+			name: "missing",
+			got:  objects("/a", "/c"),
+			want: []string{"/a", "/b", "/c"},
+			diff: "missing '/b'",
+		},
+		{
+			name: "unexpected",
+			got:  objects("/a", "/b", "/c"),
+			want: []string{"/a", "/c"},
+			diff: "unexpected '/b'",
+		},
+		{
+			name: "duplicate",
+			got:  objects("/a", "/b", "/b"),
+			want: []string{"/a", "/b"},
+			diff: "duplicate '/b' (2 times)",
+		},
+		{
+			name: "misordered",
+			got:  objects("/b", "/a"),
+			want: []string{"/a", "/b"},
+			diff: `misordered, expected ["/a" "/b"], got ["/b" "/a"]`,
+		},
+		{
+			name: "multiple",
+			got:  objects("/a", "/a", "/x"),
+			want: []string{"/a", "/b"},
+			diff: "missing '/b', duplicate '/a' (2 times), unexpected '/x'",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := compareListing(test.got, test.want); diff != test.diff {
+				t.Fatalf("expected %q, got %q", test.diff, diff)
+			}
+		})
+	}
+}
+
+// TestListingPathsOrder checks that the listing hierarchy's names sort the
+// same with renterd's SQLite and MySQL collations, the latter pads names with
+// spaces when comparing them.
+func TestListingPathsOrder(t *testing.T) {
+	padSpaceCompare := func(a, b string) int {
+		n := min(len(a), len(b))
+		if c := strings.Compare(a[:n], b[:n]); c != 0 {
+			return c
+		}
+		for _, c := range []byte(a[n:]) {
+			if c != ' ' {
+				return cmp.Compare(c, ' ')
+			}
+		}
+		for _, c := range []byte(b[n:]) {
+			if c != ' ' {
+				return cmp.Compare(' ', c)
+			}
+		}
+		return 0
+	}
+
+	const root = "/data.listing/root/"
+	var keys []string
+	for _, path := range listingPaths {
+		keys = append(keys, root+path)
+	}
+	names := append(listingDirs(root, keys), keys...)
+	for _, dir := range listingDirs(root, keys) {
+		names = append(names, listingChildren(dir, keys)...)
+	}
+	for _, a := range names {
+		for _, b := range names {
+			if got, want := padSpaceCompare(a, b), strings.Compare(a, b); got != want {
+				t.Fatalf("'%s' and '%s' sort differently with MySQL's collation", a, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import "sync"
+
+type (
+	// profileLocks coordinates the cycles of a profile that run concurrently.
+	// A phase never runs twice at the same time, which could happen if its
+	// schedule changes while it runs. An object is only used by one phase at
+	// a time, e.g. verification never downloads an object that churn is
+	// overwriting, and objects that are removed while a verification runs
+	// are skipped by it rather than failing it. None of the locks block, a
+	// phase skips what's locked.
+	profileLocks struct {
+		mu       sync.Mutex
+		phases   map[string]bool
+		objects  map[string]bool
+		watchers map[*removedObjects]struct{}
+	}
+
+	// removedObjects collects the objects removed while a verification runs.
+	removedObjects struct {
+		keys map[string]bool
+	}
+)
+
+func newProfileLocks() *profileLocks {
+	return &profileLocks{
+		phases:   make(map[string]bool),
+		objects:  make(map[string]bool),
+		watchers: make(map[*removedObjects]struct{}),
+	}
+}
+
+// lockPhase locks the phase, it returns false if the phase is already
+// running. Without locks every lock succeeds.
+func (pl *profileLocks) lockPhase(phase string) bool {
+	if pl == nil {
+		return true
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.phases[phase] {
+		return false
+	}
+	pl.phases[phase] = true
+	return true
+}
+
+func (pl *profileLocks) unlockPhase(phase string) {
+	if pl == nil {
+		return
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	delete(pl.phases, phase)
+}
+
+// lockObject locks the object, it returns false if another phase is using it.
+func (pl *profileLocks) lockObject(key string) bool {
+	if pl == nil {
+		return true
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.objects[key] {
+		return false
+	}
+	pl.objects[key] = true
+	return true
+}
+
+func (pl *profileLocks) unlockObject(key string) {
+	if pl == nil {
+		return
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	delete(pl.objects, key)
+}
+
+// objectRemoved records that the object was removed or moved away from its
+// key.
+func (pl *profileLocks) objectRemoved(key string) {
+	if pl == nil {
+		return
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	for w := range pl.watchers {
+		w.keys[key] = true
+	}
+}
+
+// watchRemoved collects the objects that are removed until stop is called,
+// wasRemoved reports whether the object was removed since.
+func (pl *profileLocks) watchRemoved() (wasRemoved func(key string) bool, stop func()) {
+	if pl == nil {
+		return func(string) bool { return false }, func() {}
+	}
+	w := &removedObjects{keys: make(map[string]bool)}
+	pl.mu.Lock()
+	pl.watchers[w] = struct{}{}
+	pl.mu.Unlock()
+
+	wasRemoved = func(key string) bool {
+		pl.mu.Lock()
+		defer pl.mu.Unlock()
+		return w.keys[key]
+	}
+	stop = func() {
+		pl.mu.Lock()
+		defer pl.mu.Unlock()
+		delete(pl.watchers, w)
+	}
+	return
+}
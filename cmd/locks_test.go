@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestProfileLocks(t *testing.T) {
+	pl := newProfileLocks()
+
+	// a phase can't be locked twice
+	if !pl.lockPhase(phaseVerify) {
+		t.Fatal("expected the phase to be locked")
+	} else if pl.lockPhase(phaseVerify) {
+		t.Fatal("expected the phase to be locked already")
+	} else if !pl.lockPhase(phaseChurn) {
+		t.Fatal("expected another phase to be locked")
+	}
+	pl.unlockPhase(phaseVerify)
+	if !pl.lockPhase(phaseVerify) {
+		t.Fatal("expected the phase to be locked after it was unlocked")
+	}
+
+	// an object can't be locked twice
+	if !pl.lockObject("foo") {
+		t.Fatal("expected the object to be locked")
+	} else if pl.lockObject("foo") {
+		t.Fatal("expected the object to be locked already")
+	}
+	pl.unlockObject("foo")
+	if !pl.lockObject("foo") {
+		t.Fatal("expected the object to be locked after it was unlocked")
+	}
+
+	// only removals while watching are reported
+	pl.objectRemoved("before")
+	wasRemoved, stop := pl.watchRemoved()
+	pl.objectRemoved("during")
+	stop()
+	pl.objectRemoved("after")
+	if wasRemoved("before") || !wasRemoved("during") || wasRemoved("after") {
+		t.Fatal("expected only the object removed while watching to be reported")
+	}
+
+	// without locks everything is allowed
+	var none *profileLocks
+	if !none.lockPhase(phaseVerify) || !none.lockPhase(phaseVerify) || !none.lockObject("foo") || !none.lockObject("foo") {
+		t.Fatal("expected every lock to succeed without locks")
+	}
+	wasRemoved, stop = none.watchRemoved()
+	none.objectRemoved("foo")
+	stop()
+	if wasRemoved("foo") {
+		t.Fatal("expected no removals without locks")
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-func newLogger(path string) (*zap.Logger, func(context.Context) error, error) {
+func newLogger(path string, console *os.File) (*zap.Logger, func(context.Context) error, error) {
 	writer, closeFn, err := zap.Open(path)
 	if err != nil {
 		return nil, nil, err
@@ -32,7 +32,7 @@ func newLogger(path string) (*zap.Logger, func(context.Context) error, error) {
 
 	core := zapcore.NewTee(
 		zapcore.NewCore(fileEncoder, writer, zapcore.DebugLevel),
-		zapcore.NewCore(consoleEncoder, zapcore.AddSync(os.Stdout), zapcore.DebugLevel),
+		zapcore.NewCore(consoleEncoder, zapcore.AddSync(console), zapcore.DebugLevel),
 	)
 
 	logger := zap.New(
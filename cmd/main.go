@@ -3,16 +3,15 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
-	"strings"
-	"syscall"
+	"sort"
+	"sync"
 	"time"
 
 	"go.sia.tech/renterd/alerts"
-	"go.sia.tech/renterd/api"
 	"go.sia.tech/renterd/bus"
 	"go.sia.tech/renterd/worker"
 	"go.uber.org/zap"
@@ -22,118 +21,365 @@ const (
 	defaultBucketName = "integrity"
 	defaultConfigFile = "config.yml"
 	defaultLogFile    = "checker.log"
-	defaultStateFile  = "integrity.json"
+	defaultStateFile  = "integrity.db"
+
+	exitOK        = 0
+	exitFailure   = 1
+	exitUsage     = 2
+	exitIntegrity = 3
+
+	// reachabilityTimeout is how long 'config validate' waits for renterd
+	reachabilityTimeout = 10 * time.Second
 )
 
 var (
+	configPath string
+	logPath    string
+	statePath  string
+	overrides  overrideFlags
+
+	profileName string
+
 	bc     *bus.Client
 	wc     *worker.Client
-	rs     api.RedundancySettings
 	logger *zap.SugaredLogger
 
 	errIntegrity = errors.New("integrity check failed")
 )
 
 func main() {
-	// load config
-	err := loadConfig(defaultConfigFile)
+	flag.StringVar(&configPath, "config", defaultConfigFile, "path to the config file")
+	flag.StringVar(&logPath, "log", defaultLogFile, "path to the log file")
+	flag.StringVar(&statePath, "state", defaultStateFile, "path to the state database")
+	flag.StringVar(&profileName, "profile", "", "only use the profile with this name")
+	flag.Var(&overrides, "set", "override a config value, e.g. -set datasetSize=1073741824, can be repeated")
+	flag.Usage = usage
+	flag.Parse()
+
+	// find the command
+	cmd, cmdArgs, err := findCommand(flag.Args())
 	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	// load config
+	if err := loadConfig(configPath, overrides); err != nil {
 		log.Fatal(err)
 	}
 
+	os.Exit(cmd.run(cmdArgs))
+}
+
+// findCommand returns the command named by the first argument along with its
+// arguments, without arguments it defaults to running the checks.
+func findCommand(args []string) (command, []string, error) {
+	if len(args) == 0 {
+		args = []string{"run"}
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return command{}, nil, fmt.Errorf("unknown command '%s'", args[0])
+	}
+	return cmd, args[1:], nil
+}
+
+// initialize sets up the logger and the renterd clients, the returned function
+// closes the logger. Console logs are written to the given file.
+func initialize(console *os.File) func() {
+	closeFn, err := setup(console)
+	if err != nil && logger != nil {
+		logger.Fatal(err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	return closeFn
+}
+
+// setup is like initialize but returns an error instead of exiting. Once the
+// logger is set up the returned function is non-nil, even if setting up the
+// clients or the state database fails, and has to be called.
+func setup(console *os.File) (func(), error) {
 	// initialize logger
-	l, closeFn, err := newLogger(defaultLogFile)
+	l, closeFn, err := newLogger(logPath, console)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer func() { _ = withSaneTimeout(func(ctx context.Context) error { return closeFn(ctx) }, nil) }()
 	logger = l.Sugar().Named("integrity")
+	closeLogger := func() {
+		_ = withSaneTimeout(func(ctx context.Context) error { return closeFn(ctx) }, nil)
+	}
 
 	// initialize bus client
 	bc = bus.NewClient(cfg.BusAddr, cfg.BusPassw)
 	if _, err := bc.State(); err != nil {
-		logger.Fatalf("failed to fetch bus state, err: %v", err)
+		return closeLogger, fmt.Errorf("failed to fetch bus state, err: %v", err)
 	}
 
 	// initialize worker client
 	wc = worker.NewClient(cfg.WorkerAddr, cfg.WorkerPassw)
 	if _, err := wc.State(); err != nil {
-		logger.Fatalf("failed to fetch worker state, err: %v", err)
+		return closeLogger, fmt.Errorf("failed to fetch worker state, err: %v", err)
 	}
 
-	// load state
-	s, err := loadState(defaultStateFile)
+	// open the state database
+	closeStore, err := initStateStore()
 	if err != nil {
-		logger.Fatal(err)
+		return closeLogger, err
 	}
 
-	// ensure bucket exists
-	err = bc.CreateBucket(context.Background(), defaultBucketName, api.CreateBucketOptions{})
-	if err != nil && !strings.Contains(err.Error(), api.ErrBucketExists.Error()) {
-		logger.Fatal(err)
+	return func() {
+		closeStore()
+		closeLogger()
+	}, nil
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-14s %s\n", commands[name].usage, commands[name].desc)
 	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+	flag.PrintDefaults()
+}
 
-	// remove all files
-	if cfg.CleanStart {
-		logger.Infof("remove all files from %s/", cfg.WorkDir)
-		if err := withSaneTimeout(func(ctx context.Context) error {
-			return bc.RemoveObjects(ctx, defaultBucketName, cfg.WorkDir)
-		}, nil); err != nil && !strings.Contains(err.Error(), api.ErrObjectNotFound.Error()) {
+// initProfiles returns the profiles to operate on, makes sure their buckets
+// exist and adopts objects under their old prefix.
+func initProfiles() []*profile {
+	profiles, err := newProfiles(profileName)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	for _, p := range profiles {
+		if err := p.prepare(); err != nil {
 			logger.Fatal(err)
 		}
-
-		logger.Infof("resetting state")
-		s = &state{}
 	}
-
-	// run the integrity checks
-	stopChan := make(chan struct{})
-	defer close(stopChan)
-	go run(cfg, s, stopChan)
-
-	// listen for interrupt signal
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
-	<-signalCh
-
-	logger.Info("Shutting down...")
+	return profiles
 }
 
-func run(cfg config, s *state, stopChan chan struct{}) {
-	ticker := time.NewTicker(cfg.IntegrityCheckInterval)
-	for {
-		if s.timeSinceLastIntegrityCheck() > cfg.IntegrityCheckInterval {
-			res := runIntegrityChecks()
-			if err := registerAlert(res); err != nil {
-				logger.Warnf("failed to register alert, err: %v", err)
-			}
+// prepare makes sure the profile's bucket exists and adopts the objects under
+// its old prefix.
+func (p *profile) prepare() error {
+	if err := p.ensureBucket(); err != nil {
+		return err
+	}
+	return p.adoptObjects()
+}
 
-			s.Results = append([]result{res}, s.Results...)
-			if err := saveState(s, defaultStateFile); err != nil {
-				logger.Errorf("failed to save state, err: %v", err)
+// run runs the profile's cycles until it's stopped. Phases with their own
+// schedule run in cycles of their own, every cycle runs in its own goroutine
+// on a copy of the profile, so a slow or stuck phase doesn't hold back the
+// others. Config changes are applied in between cycles, a cycle uses the
+// config as it was when it started.
+func (p *profile) run(s *state, reloadCh <-chan config, stopChan chan struct{}) {
+	p.detached = true
+	runs := append([]string{""}, schedulablePhases...)
+
+	// every run has a timer that fires when its next cycle starts, a timer
+	// that fires after it was replaced is ignored
+	type due struct {
+		run string
+		gen int
+	}
+	dueCh, doneCh := make(chan due), make(chan string)
+	timers := make(map[string]*time.Timer)
+	gens := make(map[string]int)
+	running := make(map[string]bool)
+	var wg sync.WaitGroup
+	schedule := func(run string) {
+		if t, ok := timers[run]; ok {
+			t.Stop()
+			delete(timers, run)
+		}
+		gens[run]++
+		next := p.nextRun(run)
+		if next.IsZero() {
+			return
+		}
+		d := due{run: run, gen: gens[run]}
+		timers[run] = time.AfterFunc(time.Until(next), func() {
+			select {
+			case dueCh <- d:
+			case <-stopChan:
 			}
-		} else {
-			logger.Debugf("skipping integrity check, it hasn't been %v since the last check", cfg.IntegrityCheckInterval)
+		})
+	}
+	// cycles that are running when the profile is stopped are finished
+	defer func() {
+		for _, t := range timers {
+			t.Stop()
 		}
+		wg.Wait()
+	}()
+	for _, run := range runs {
+		schedule(run)
+	}
 
+	for {
 		select {
 		case <-stopChan:
 			return
-		case <-ticker.C:
+		case c := <-reloadCh:
+			if p.applyConfig(c) {
+				for _, run := range runs {
+					if !running[run] {
+						schedule(run)
+					}
+				}
+			}
+		case d := <-dueCh:
+			if d.gen != gens[d.run] || running[d.run] {
+				continue
+			}
+			running[d.run] = true
+			wg.Add(1)
+			go func(q *profile) {
+				defer wg.Done()
+				q.runCycle(s)
+				select {
+				case doneCh <- q.ownPhase:
+				case <-stopChan:
+				}
+			}(p.fork(d.run))
+		case run := <-doneCh:
+			running[run] = false
+			schedule(run)
 		}
 	}
 }
 
-func runIntegrityChecks() (res result) {
-	logger.Info("running integrity checks")
+// runCycle runs the integrity checks, alerts about their result and stores
+// it.
+func (p *profile) runCycle(s *state) result {
+	res := p.runIntegrityChecks(s)
+	if err := p.registerAlert(res); err != nil {
+		p.logger.Warnf("failed to register alert, err: %v", err)
+	}
+	if err := store.addResult(p.Name, s, res); err != nil {
+		p.logger.Error(err)
+	}
+	return res
+}
+
+// nextRun returns when the next cycle of the given run starts, an interrupted
+// cycle is resumed right away. It returns the zero time if the run doesn't
+// start again, e.g. a phase without its own schedule runs in the regular
+// cycle.
+func (p *profile) nextRun(run string) time.Time {
+	if run == "" {
+		next := p.nextCycle()
+		if next.IsZero() {
+			p.logger.Warn("the schedule never runs again, waiting for a config change")
+		} else {
+			p.logger.Debugf("next integrity check at %v", next)
+		}
+		return next
+	} else if p.hasCycleToResume(run) {
+		return time.Now()
+	} else if !p.hasOwnSchedule(run) {
+		return time.Time{}
+	}
+
+	// only completed runs of the phase are recorded, a failed cycle is
+	// retried on the phase's schedule rather than right away
+	now := time.Now()
+	next := p.nextPhaseRun(run, now)
+	if last, err := store.lastCycleStart(p.Name, run); err != nil {
+		p.logger.Warnf("failed to fetch the last cycle of phase '%s', err: %v", run, err)
+	} else if retry := p.phaseSchedule(run).next(last.Local(), now, 0, true); !next.IsZero() && retry.After(next) {
+		next = retry
+	}
+	if next.IsZero() {
+		p.logger.Warnf("the schedule of phase '%s' never runs again, waiting for a config change", run)
+	} else {
+		p.logger.Debugf("next run of phase '%s' at %v", run, next)
+	}
+	return next
+}
+
+// nextCycle returns when the profile's next regular cycle starts, an
+// interrupted cycle is resumed right away. It returns the zero time if the
+// schedule never runs again.
+func (p *profile) nextCycle() time.Time {
+	if p.hasCycleToResume("") {
+		return time.Now()
+	}
+
+	last, err := store.lastCycleStart(p.Name, "")
+	if err != nil {
+		p.logger.Warnf("failed to fetch the last cycle, running it, err: %v", err)
+		return time.Now()
+	}
+	sc := p.cycleSchedule()
+	return sc.next(last.Local(), time.Now(), sc.randomJitter(), p.CatchUp)
+}
+
+func (p *profile) runIntegrityChecks(s *state) (res result) {
+	if p.ownPhase != "" {
+		p.logger.Infof("running phase '%s'", p.ownPhase)
+	} else {
+		p.logger.Info("running integrity checks")
+	}
+
+	// attribute downloads to the hosts in the state's scoreboard
+	scoreboardMu.Lock()
+	if s.Hosts == nil {
+		s.Hosts = make(hostScoreboard)
+	}
+	p.hosts = s.Hosts
+	scoreboardMu.Unlock()
+
+	// resume the interrupted cycle or start a new one, its plan and progress
+	// are persisted as it runs
+	cycleStart := time.Now()
+	plan, pErr := store.beginCycle(p.Name, p.ownPhase)
+	if pErr != nil {
+		p.logger.Warnf("failed to persist the cycle's plan, it can't be resumed, err: %v", pErr)
+	} else {
+		if plan.resumed {
+			p.logger.Infof("resuming the cycle started at %v", plan.startedAt.UTC())
+		}
+		cycleStart = plan.startedAt
+		p.plan = plan
+		defer func() { p.plan = nil }()
+	}
 
 	// defer building the result
 	var err error
 	var uploaded, downloaded, removed, prunable int64
+	var churned int
 	var downloadedMBPS, uploadedMBPS float64
 	var complete bool
+	var packed packingStats
+	var pruned pruneStats
+	var prunedContracts bool
+	var phases cyclePhases
 	defer func(start time.Time) {
+		// include the work done before the cycle was resumed
+		var resumed bool
+		if p.plan != nil && p.plan.resumed {
+			resumed = true
+			uploaded += int64(float64(p.plan.completed[phaseUpload]) * p.rs.Redundancy())
+			downloaded += p.plan.completed[phaseVerify]
+			removed += p.plan.completed[phaseDelete]
+		}
+
+		// report how much of the dataset was verified recently, whether or
+		// not the verify phase ran
+		cov, cErr := p.datasetCoverage()
+		if cErr != nil {
+			p.logger.Warnf("failed to compute coverage, err: %v", cErr)
+		}
+
 		res = result{
+			Phase:     p.ownPhase,
 			StartedAt: start.UTC(),
 			EndedAt:   time.Now().UTC(),
 
@@ -141,79 +387,184 @@ func runIntegrityChecks() (res result) {
 			Downloaded: humanReadableSize(downloaded),
 			Removed:    humanReadableSize(removed),
 			Prunable:   humanReadableSize(prunable),
+			Churned:    churned,
 
 			DownloadSpeedMBPS: downloadedMBPS,
 			UploadSpeedMBPS:   uploadedMBPS,
 
+			PackedUploaded:  packed.uploaded,
+			PackedFlushed:   packed.flushed,
+			PackedUnflushed: packed.unflushed,
+
 			DatasetComplete: complete,
+			Resumed:         resumed,
+			Coverage:        cov,
+			Phases:          phases.results,
+			SkippedPhases:   phases.skipped,
+		}
+		if prunedContracts {
+			res.PrunableBefore = humanReadableSize(pruned.prunableBefore)
+			res.Pruned = humanReadableSize(pruned.pruned)
+			res.PruneDuration = pruned.duration.Round(time.Millisecond).String()
+			res.PrunedContracts = pruned.contracts
+		}
+		if packed.maxUnflushed > 0 {
+			res.MaxUnflushed = packed.maxUnflushed.Round(time.Second).String()
 		}
 		if err != nil {
 			res.Err = &resultErr{err}
 		}
-	}(time.Now())
 
-	// update redundancy
-	err = withSaneTimeout(func(ctx context.Context) error {
-		us, err := bc.UploadSettings(ctx)
-		if err != nil {
-			return err
+		// snapshot the contracts
+		snapshot, sErr := takeContractSnapshot(s.lastContractSnapshot())
+		if sErr != nil {
+			p.logger.Warnf("failed to snapshot contracts, err: %v", sErr)
 		}
-		rs = us.Redundancy
-		return nil
-	}, nil)
+		res.ContractSnapshot = snapshot
+
+		// update the host scoreboard
+		if err := p.hosts.refresh(snapshot); err != nil {
+			p.logger.Warnf("failed to refresh host scoreboard, err: %v", err)
+		}
+
+		// compute the cost of the cycle
+		res.Cost = costs.cycleCost(snapshot)
+	}(cycleStart)
+
+	// update redundancy, none of the phases can run without it
+	err = p.refreshRedundancy()
 	if err != nil {
-		err = fmt.Errorf("failed to refresh redundancy; %w", err)
 		return
 	}
 
+	// run the phases, a failed phase doesn't prevent the others from running
+	defer func() { err = phases.err() }()
+
 	// ensure our dataset matches requested size
-	start := time.Now()
-	uploaded, _, err = ensureDataset(cfg.DatasetSize)
-	if err != nil {
-		err = fmt.Errorf("failed to ensure dataset; %w", err)
-		return
+	p.runPhase(&phases, phaseFill, func() (err error) {
+		start := time.Now()
+		uploaded, _, err = p.ensureDataset(p.DatasetSize)
+		if err != nil {
+			return fmt.Errorf("failed to ensure dataset; %w", err)
+		}
+		uploadedMBPS = mbps(uploaded, time.Since(start).Milliseconds())
+		complete = true
+		return nil
+	})
+
+	p.runPhase(&phases, phaseVerify, func() (err error) {
+		size := pctOf(p.IntegrityCheckDownloadPct, p.DatasetSize)
+		if p.SweepPeriod > 0 {
+			size = p.sweepSize(size)
+			p.logger.Infof("sweeping %v of our dataset, least recently verified first", humanReadableSize(size))
+		} else {
+			p.logger.Infof("checking integrity of %v%% of our dataset (%v)", p.IntegrityCheckDownloadPct, humanReadableSize(size))
+		}
+
+		// check integrity of a portion of the dataset
+		start := time.Now()
+		downloaded, err = p.checkIntegrity(phaseVerify, size)
+		if err != nil {
+			return fmt.Errorf("failed to check integrity of the dataset; %w", err)
+		}
+		downloadedMBPS = mbps(downloaded, time.Since(start).Milliseconds())
+
+		// check packed files before and after they're flushed
+		if p.PackedFiles > 0 {
+			packed, err = p.checkPacking()
+			if err != nil {
+				return fmt.Errorf("failed to check packed files; %w", err)
+			}
+		}
+		return nil
+	})
+
+	// check the bucket's policy is honored
+	p.runPhase(&phases, phaseBucketPolicy, func() error {
+		if err := p.verifyBucketPolicy(); err != nil {
+			return fmt.Errorf("failed to verify the bucket policy; %w", err)
+		}
+		return nil
+	})
+
+	// test the lifecycle of an ephemeral bucket
+	if p.BucketLifecycleObjects > 0 {
+		p.runPhase(&phases, phaseBucketLifecycle, func() error {
+			if err := p.testBucketLifecycle(); err != nil {
+				return fmt.Errorf("failed bucket lifecycle test; %w", err)
+			}
+			return nil
+		})
 	}
-	uploadedMBPS = mbps(downloaded, time.Since(start).Milliseconds())
-	complete = true
 
-	size := int64(cfg.IntegrityCheckDownloadPct * float64(cfg.DatasetSize))
-	logger.Infof("checking integrity of %d%% of our dataset (%v)", int(cfg.IntegrityCheckDownloadPct*100), humanReadableSize(size))
+	// churn deletes data, which a failing fill phase wouldn't replace, so it
+	// only shrinks the dataset further
+	if p.inCycle(phaseChurn) && p.phaseFailing(phaseFill) {
+		p.logger.Warnf("skipping phase '%s', phase '%s' failed", phaseChurn, phaseFill)
+		phases.skipped = append(phases.skipped, phaseChurn)
+	} else {
+		p.runPhase(&phases, phaseChurn, func() (err error) {
+			// delete data
+			size := pctOf(p.IntegrityCheckDeletePct, p.DatasetSize)
+			p.logger.Infof("deleting %v%% of our dataset (%v)", p.IntegrityCheckDeletePct, humanReadableSize(size))
+			removed, err = p.pruneDataset(size)
+			if err != nil {
+				return fmt.Errorf("failed to prune the dataset, removed %d; %w", removed, err)
+			}
 
-	// check integrity of a portion of the dataset
-	start = time.Now()
-	downloaded, err = checkIntegrity(size)
-	if err != nil {
-		err = fmt.Errorf("failed to check integrity of the dataset; %w", err)
-		return
+			// rename, copy and overwrite data
+			if p.ChurnOperations > 0 {
+				p.logger.Infof("performing %d churn operations", p.ChurnOperations)
+				churned, err = p.churnDataset(p.ChurnOperations)
+				if err != nil {
+					return fmt.Errorf("failed to churn the dataset, churned %d; %w", churned, err)
+				}
+			}
+			return nil
+		})
 	}
-	downloadedMBPS = mbps(downloaded, time.Since(start).Milliseconds())
 
-	// delete data
-	size = int64(cfg.IntegrityCheckDeletePct * float64(cfg.DatasetSize))
-	logger.Infof("deleting %d%% of our dataset (%v)", int(cfg.IntegrityCheckDeletePct*100), humanReadableSize(size))
-	removed, err = pruneDataset(size)
-	if err != nil {
-		err = fmt.Errorf("failed to prune the dataset, removed %d; %w", removed, err)
-		return
+	// check listings of a nested hierarchy
+	if p.ListingCheck {
+		p.runPhase(&phases, phaseListing, func() error {
+			if err := p.checkListing(); err != nil {
+				return fmt.Errorf("failed to check listings; %w", err)
+			}
+			return nil
+		})
 	}
 
-	// update redundancy
-	if err = withSaneTimeout(func(ctx context.Context) error {
-		res, err := bc.PrunableData(ctx)
-		if err != nil {
-			return err
-		}
-		prunable = int64(res.TotalPrunable)
-		return nil
-	}, nil); err != nil {
-		err = fmt.Errorf("failed to fetch prunable data; %w", err)
-		return
+	// prune contracts and verify the dataset survived, pruning is global to
+	// the bus so only one profile prunes contracts
+	if p.prunesContracts() {
+		p.runPhase(&phases, phasePrune, func() (err error) {
+			prunedContracts = true
+			pruned, err = p.pruneContracts()
+			prunable = pruned.prunableAfter
+			if err != nil {
+				return fmt.Errorf("failed to prune contracts; %w", err)
+			}
+			return nil
+		})
 	}
 
+	// fetch prunable data
+	if !prunedContracts {
+		pd, pErr := prunableData()
+		if pErr != nil {
+			phases.errs = append(phases.errs, pErr)
+		}
+		prunable = int64(pd.TotalPrunable)
+	}
 	return
 }
 
-func registerAlert(res result) error {
+func (p *profile) registerAlert(res result) error {
+	// warn about exceeded budgets
+	if err := p.registerBudgetAlert(res); err != nil {
+		p.logger.Warnf("failed to register budget alert, err: %v", err)
+	}
+
 	// set severity level
 	severity := alerts.SeverityInfo
 	if err := res.Error(); errors.Is(err, errIntegrity) {
@@ -223,12 +574,18 @@ func registerAlert(res result) error {
 	// set data source
 	data := make(map[string]any)
 	data["source"] = "renterd-integrity"
+	data["profile"] = p.Name
 	data["result"] = res
 
 	// set message
-	msg := "integrity check completed successfully"
+	check := fmt.Sprintf("integrity check of profile '%s'", p.Name)
+	if res.Phase != "" {
+		data["phase"] = res.Phase
+		check = fmt.Sprintf("phase '%s' of profile '%s'", res.Phase, p.Name)
+	}
+	msg := fmt.Sprintf("%s completed successfully", check)
 	if err := res.Error(); err != nil {
-		msg = fmt.Sprintf("integrity check failed, err: %v", err)
+		msg = fmt.Sprintf("%s failed, err: %v", check, err)
 	}
 
 	// create alert
@@ -240,7 +597,7 @@ func registerAlert(res result) error {
 		Timestamp: time.Now(),
 	}
 
-	logger.Debugf("registered alert: %v", alert.Message)
+	p.logger.Debugf("registered alert: %v", alert.Message)
 	return withSaneTimeout(func(ctx context.Context) error {
 		return bc.RegisterAlert(ctx, alert)
 	}, nil)
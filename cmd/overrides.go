@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	envPrefix = "RENTERD_INTEGRITY_"
+
+	redacted = "<redacted>"
+)
+
+// overrideFlags collects the repeatable -set flag.
+type overrideFlags []string
+
+func (o *overrideFlags) String() string { return strings.Join(*o, ",") }
+
+func (o *overrideFlags) Set(v string) error {
+	*o = append(*o, v)
+	return nil
+}
+
+// applyEnvOverrides sets every config field for which an environment variable
+// is set, the variable's name is derived from the field's yaml path, e.g.
+// 'chaos.checkSize' is set through RENTERD_INTEGRITY_CHAOS_CHECK_SIZE and a
+// profile's 'datasetSize' through RENTERD_INTEGRITY_PROFILES_<NAME>_DATASET_SIZE.
+func applyEnvOverrides(c *config) (err error) {
+	for path, field := range overrideFields(c) {
+		name := envName(path)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := field.set(value); err != nil {
+			return fmt.Errorf("invalid value for environment variable %s, err: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// applyOverrides applies overrides in the form 'path=value', where path is the
+// field's yaml path, e.g. 'chaos.checkSize=1073741824', or
+// 'profiles.<name>.<path>' for a profile's setting.
+func applyOverrides(c *config, overrides []string) error {
+	fields := overrideFields(c)
+	for _, o := range overrides {
+		path, value, ok := strings.Cut(o, "=")
+		if !ok {
+			return fmt.Errorf("invalid override '%s', expected 'key=value'", o)
+		}
+		field, ok := fields[path]
+		if !ok {
+			return fmt.Errorf("invalid override '%s', unknown key '%s'", o, path)
+		}
+		if err := field.set(value); err != nil {
+			return fmt.Errorf("invalid override '%s', err: %v", o, err)
+		}
+	}
+	return nil
+}
+
+// overrideField is a config field that can be overridden, setting a profile's
+// field marks its key as set so it takes precedence over the top-level
+// setting.
+type overrideField struct {
+	field reflect.Value
+	keys  map[string]bool
+	key   string
+}
+
+func (f overrideField) set(value string) error {
+	if err := setField(f.field, value); err != nil {
+		return err
+	} else if f.keys != nil {
+		f.keys[f.key] = true
+	}
+	return nil
+}
+
+// overrideFields returns the fields of the config that can be overridden,
+// keyed by their yaml path. The settings of a named profile are keyed by
+// 'profiles.<name>.<path>'.
+func overrideFields(c *config) map[string]overrideField {
+	fields := make(map[string]overrideField)
+	for path, field := range configFields(c) {
+		fields[path] = overrideField{field: field}
+	}
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		if p.Name == "" {
+			continue
+		}
+		for path, field := range configFields(p) {
+			key, _, _ := strings.Cut(path, ".")
+			fields["profiles."+p.Name+"."+path] = overrideField{field: field, keys: p.set, key: key}
+		}
+	}
+	return fields
+}
+
+// loadSecretFiles reads the passwords from their files, a password file takes
+// precedence over a password set at the same level. If prev is set, only the
+// files whose path changed since prev are read, so a password set through an
+// environment variable or flag takes precedence over a file set in the config
+// file, while a file set through one takes precedence over the config file's
+// password.
+func loadSecretFiles(c, prev *config) error {
+	read := func(path, prevPath string, dst *string) error {
+		if path == "" || path == prevPath {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read secret file '%s', err: %v", path, err)
+		}
+		*dst = strings.TrimSpace(string(b))
+		return nil
+	}
+
+	if prev == nil {
+		prev = &config{}
+	}
+	if err := read(c.BusPasswFile, prev.BusPasswFile, &c.BusPassw); err != nil {
+		return err
+	}
+	if err := read(c.WorkerPasswFile, prev.WorkerPasswFile, &c.WorkerPassw); err != nil {
+		return err
+	}
+	if err := read(c.S3.SecretKeyFile, prev.S3.SecretKeyFile, &c.S3.SecretKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// redactedConfig returns a copy of the config with all secrets redacted.
+func redactedConfig(c config) config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+
+	redact(&c.BusPassw)
+	redact(&c.WorkerPassw)
+	redact(&c.S3.SecretKey)
+	return c
+}
+
+// configFields returns the fields of the given config struct pointer that can
+// be set from a string, keyed by their yaml path.
+func configFields(c any) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	walkConfigFields(reflect.ValueOf(c).Elem(), "", func(path string, field reflect.Value) {
+		fields[path] = field
+	})
+	return fields
+}
+
+// walkConfigFields calls fn for every field that can be set from a string
+// along with its yaml path.
+func walkConfigFields(v reflect.Value, prefix string, fn func(path string, field reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		field := v.Field(i)
+		if opts == "inline" {
+			walkConfigFields(field, prefix, fn)
+			continue
+		} else if name == "" || name == "-" {
+			continue
+		}
+		path := prefix + name
+
+		switch {
+		case field.Kind() == reflect.Struct:
+			walkConfigFields(field, path+".", fn)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.String:
+			// slices of structs can only be configured through the file
+		default:
+			fn(path, field)
+		}
+	}
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		var values []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported type %v", field.Type())
+	}
+	return nil
+}
+
+// envName turns a yaml path like 'chaos.checkSize' into the name of its
+// environment variable, RENTERD_INTEGRITY_CHAOS_CHECK_SIZE.
+func envName(path string) string {
+	var sb strings.Builder
+	sb.WriteString(envPrefix)
+	var prev rune
+	for _, r := range path {
+		switch {
+		case r == '.':
+			sb.WriteRune('_')
+		case unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)):
+			sb.WriteRune('_')
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return sb.String()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"workDir", "RENTERD_INTEGRITY_WORK_DIR"},
+		{"chaos.checkSize", "RENTERD_INTEGRITY_CHAOS_CHECK_SIZE"},
+		{"s3.accessKeyID", "RENTERD_INTEGRITY_S3_ACCESS_KEY_ID"},
+		{"maxUploadSCPerTB", "RENTERD_INTEGRITY_MAX_UPLOAD_SCPER_TB"},
+		{"bucket", "RENTERD_INTEGRITY_BUCKET"},
+	}
+	for _, test := range tests {
+		if got := envName(test.path); got != test.want {
+			t.Errorf("envName(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides []string
+		check     func(c config) bool
+		err       string
+	}{
+		{
+			name:      "string",
+			overrides: []string{"workDir=/tmp/integrity"},
+			check:     func(c config) bool { return c.WorkDir == "/tmp/integrity" },
+		},
+		{
+			name:      "nested",
+			overrides: []string{"chaos.checkSize=1024"},
+			check:     func(c config) bool { return c.Chaos.CheckSize == 1024 },
+		},
+		{
+			name:      "inline profile",
+			overrides: []string{"integrityCheckInterval=5m", "listingCheck=true"},
+			check: func(c config) bool {
+				return c.IntegrityCheckInterval == 5*time.Minute && c.ListingCheck
+			},
+		},
+		{
+			name:      "slice",
+			overrides: []string{"contentGenerators=random, zeros,"},
+			check: func(c config) bool {
+				return reflect.DeepEqual(c.ContentGenerators, []string{contentRandom, contentZeros})
+			},
+		},
+		{
+			name:      "last wins",
+			overrides: []string{"uploadConcurrency=2", "uploadConcurrency=8"},
+			check:     func(c config) bool { return c.UploadConcurrency == 8 },
+		},
+		{
+			name:      "missing value",
+			overrides: []string{"workDir"},
+			err:       "expected 'key=value'",
+		},
+		{
+			name:      "unknown key",
+			overrides: []string{"chaos.unknown=1"},
+			err:       "unknown key 'chaos.unknown'",
+		},
+		{
+			name:      "invalid value",
+			overrides: []string{"uploadConcurrency=many"},
+			err:       "invalid override 'uploadConcurrency=many'",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaultConfig
+			err := applyOverrides(&c, test.overrides)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(c) {
+				t.Fatalf("overrides %v weren't applied", test.overrides)
+			}
+		})
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	t.Setenv("RENTERD_INTEGRITY_CHAOS_CORRUPT_SECTORS", "3")
+	t.Setenv("RENTERD_INTEGRITY_PREFIX", "env")
+
+	c := defaultConfig
+	if err := applyEnvOverrides(&c); err != nil {
+		t.Fatal(err)
+	} else if c.Chaos.CorruptSectors != 3 {
+		t.Fatalf("expected 3 corrupt sectors, got %d", c.Chaos.CorruptSectors)
+	} else if c.Prefix != "env" {
+		t.Fatalf("expected prefix 'env', got '%s'", c.Prefix)
+	}
+
+	t.Setenv("RENTERD_INTEGRITY_CHAOS_CORRUPT_SECTORS", "some")
+	if err := applyEnvOverrides(&c); err == nil || !strings.Contains(err.Error(), "RENTERD_INTEGRITY_CHAOS_CORRUPT_SECTORS") {
+		t.Fatalf("expected invalid value error, got %v", err)
+	}
+}
+
+func TestSecretPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	fileSecret := write("file", "from-file\n")
+	envSecret := write("env", "from-env-file")
+	configPath := write("config.yml", "busPassword: from-config\nbusPasswordFile: "+fileSecret+"\nworkerPassword: from-config\n")
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		overrides []string
+		bus       string
+		worker    string
+	}{
+		{
+			name:   "file beats config",
+			bus:    "from-file",
+			worker: "from-config",
+		},
+		{
+			name:   "env beats file",
+			env:    map[string]string{"RENTERD_INTEGRITY_BUS_PASSWORD": "from-env"},
+			bus:    "from-env",
+			worker: "from-config",
+		},
+		{
+			name:   "env file beats config",
+			env:    map[string]string{"RENTERD_INTEGRITY_WORKER_PASSWORD_FILE": envSecret},
+			bus:    "from-file",
+			worker: "from-env-file",
+		},
+		{
+			name:      "flag beats env",
+			env:       map[string]string{"RENTERD_INTEGRITY_BUS_PASSWORD": "from-env"},
+			overrides: []string{"busPassword=from-flag"},
+			bus:       "from-flag",
+			worker:    "from-config",
+		},
+		{
+			name:      "flag file beats env",
+			env:       map[string]string{"RENTERD_INTEGRITY_WORKER_PASSWORD": "from-env"},
+			overrides: []string{"workerPasswordFile=" + envSecret},
+			bus:       "from-file",
+			worker:    "from-env-file",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			c, err := buildConfig(configPath, test.overrides)
+			if err != nil {
+				t.Fatal(err)
+			} else if c.BusPassw != test.bus {
+				t.Fatalf("expected bus password '%s', got '%s'", test.bus, c.BusPassw)
+			} else if c.WorkerPassw != test.worker {
+				t.Fatalf("expected worker password '%s', got '%s'", test.worker, c.WorkerPassw)
+			}
+		})
+	}
+}
+
+func TestProfileOverridePrecedence(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(configPath, []byte(`uploadConcurrency: 1
+profiles:
+  - name: a
+    bucket: a
+    uploadConcurrency: 2
+  - name: b
+    bucket: b
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		overrides []string
+		a, b      int
+	}{
+		{
+			name: "profile beats top-level",
+			a:    2,
+			b:    1,
+		},
+		{
+			name: "env beats file",
+			env:  map[string]string{"RENTERD_INTEGRITY_PROFILES_A_UPLOAD_CONCURRENCY": "3"},
+			a:    3,
+			b:    1,
+		},
+		{
+			name:      "flag beats env",
+			env:       map[string]string{"RENTERD_INTEGRITY_PROFILES_A_UPLOAD_CONCURRENCY": "3"},
+			overrides: []string{"profiles.a.uploadConcurrency=4"},
+			a:         4,
+			b:         1,
+		},
+		{
+			name:      "flag sets a profile's unset key",
+			overrides: []string{"profiles.b.uploadConcurrency=5"},
+			a:         2,
+			b:         5,
+		},
+		{
+			name:      "top-level flag is inherited",
+			env:       map[string]string{"RENTERD_INTEGRITY_UPLOAD_CONCURRENCY": "6"},
+			overrides: []string{"uploadConcurrency=7"},
+			a:         2,
+			b:         7,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			c, err := buildConfig(configPath, test.overrides)
+			if err != nil {
+				t.Fatal(err)
+			}
+			profiles := c.resolveProfiles()
+			if profiles[0].UploadConcurrency != test.a {
+				t.Fatalf("expected profile 'a' to upload %d files concurrently, got %d", test.a, profiles[0].UploadConcurrency)
+			} else if profiles[1].UploadConcurrency != test.b {
+				t.Fatalf("expected profile 'b' to upload %d files concurrently, got %d", test.b, profiles[1].UploadConcurrency)
+			}
+		})
+	}
+
+	// unknown profiles can't be overridden
+	if _, err := buildConfig(configPath, []string{"profiles.c.uploadConcurrency=1"}); err == nil || !strings.Contains(err.Error(), "unknown key 'profiles.c.uploadConcurrency'") {
+		t.Fatalf("expected unknown key error, got %v", err)
+	}
+}
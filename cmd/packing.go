@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.sia.tech/renterd/api"
+	"lukechampine.com/frand"
+)
+
+// packingStats summarizes a cycle's packing checks.
+type packingStats struct {
+	uploaded  int
+	flushed   int
+	unflushed int
+
+	// maxUnflushed is the longest time a packed file that's still in the
+	// buffer has been waiting to be flushed, or the longest time it took a
+	// file to get flushed this cycle, whichever is longer
+	maxUnflushed time.Duration
+}
+
+// checkPacking uploads the profile's tiny files and verifies them straight
+// away, while they are still in renterd's slab buffers. Files that were packed
+// in previous cycles are verified again once they've been flushed to the
+// network. The check is skipped if upload packing is disabled.
+func (p *profile) checkPacking() (stats packingStats, _ error) {
+	if !p.packing {
+		p.logger.Debug("skipping packing checks, upload packing is disabled")
+		return
+	}
+	if p.packed == nil {
+		p.packed = make(map[string]time.Time)
+	}
+
+	// verify the files that were flushed since the last cycle
+	if err := p.checkFlushedFiles(&stats); err != nil {
+		return stats, err
+	}
+
+	// upload and verify new tiny files
+	p.logger.Infof("uploading %d packed files", p.PackedFiles)
+	for i := 0; i < p.PackedFiles; i++ {
+		size := int64(frand.Intn(int(p.PackedMaxFilesize))) + 1
+		key, err := p.uploadFile(p.Bucket, size)
+		if err != nil {
+			return stats, fmt.Errorf("failed to upload packed file; %w", err)
+		}
+		stats.uploaded++
+
+		if err := p.verifyObject(p.Bucket, key, size); err != nil {
+			return stats, fmt.Errorf("failed to verify packed file before it was flushed; %w", err)
+		}
+		p.packed["/"+strings.TrimPrefix(key, "/")] = time.Now()
+	}
+	return
+}
+
+func (p *profile) checkFlushedFiles(stats *packingStats) error {
+	for _, key := range sortedKeys(p.packed) {
+		uploadedAt := p.packed[key]
+
+		var obj api.Object
+		if err := withSaneTimeout(func(ctx context.Context) (err error) {
+			obj, err = bc.Object(ctx, p.Bucket, key, api.GetObjectOptions{})
+			return
+		}, nil); err != nil && strings.Contains(err.Error(), api.ErrObjectNotFound.Error()) {
+			// the file was pruned before it was flushed
+			delete(p.packed, key)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to fetch packed file '%s'; %w", key, err)
+		}
+
+		waited := time.Since(uploadedAt)
+		if waited > stats.maxUnflushed {
+			stats.maxUnflushed = waited
+		}
+		if isPartial(obj) {
+			stats.unflushed++
+			if p.PackedFlushTimeout > 0 && waited > p.PackedFlushTimeout {
+				return fmt.Errorf("packed file '%s' wasn't flushed after %v", key, waited.Round(time.Second))
+			}
+			continue
+		}
+
+		p.logger.Debugf("packed file '%s' was flushed within %v", key, waited.Round(time.Second))
+		if err := p.verifyObject(p.Bucket, key, obj.Size); err != nil {
+			return fmt.Errorf("failed to verify packed file after it was flushed; %w", err)
+		}
+		delete(p.packed, key)
+		stats.flushed++
+	}
+	return nil
+}
+
+// isPartial returns true if any of the object's data is still in a slab
+// buffer.
+func isPartial(obj api.Object) bool {
+	if obj.Object == nil {
+		return false
+	}
+	for _, slab := range obj.Slabs {
+		if slab.IsPartial() {
+			return true
+		}
+	}
+	return false
+}
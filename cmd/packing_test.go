@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.sia.tech/renterd/api"
+)
+
+func TestCheckPackingEnabled(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		// serve the upload settings and record requests for packed files,
+		// which are reported as pruned
+		var fetched bool
+		p := newTestProfile(t, func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/settings/upload":
+				json.NewEncoder(w).Encode(api.UploadSettings{
+					Packing:    api.UploadPackingSettings{Enabled: enabled},
+					Redundancy: api.RedundancySettings{MinShards: 1, TotalShards: 3},
+				})
+			case strings.HasPrefix(r.URL.Path, "/object/"):
+				fetched = true
+				http.Error(w, api.ErrObjectNotFound.Error(), http.StatusNotFound)
+			default:
+				http.NotFound(w, r)
+			}
+		})
+		p.packed = map[string]time.Time{"/data/packed": time.Now()}
+		if err := p.refreshRedundancy(); err != nil {
+			t.Fatal(err)
+		} else if p.packing != enabled {
+			t.Fatalf("expected packing to be %v", enabled)
+		} else if p.rs.TotalShards != 3 {
+			t.Fatalf("expected redundancy to be refreshed, got %+v", p.rs)
+		}
+
+		if _, err := p.checkPacking(); err != nil {
+			t.Fatal(err)
+		} else if fetched != enabled {
+			t.Fatalf("packing enabled: %v, but packed files checked: %v", enabled, fetched)
+		}
+	}
+}
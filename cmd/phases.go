@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// checks of a cycle that run every cycle, they're tracked like the scheduled
+// phases
+const (
+	phaseBucketPolicy    = "bucketPolicy"
+	phaseBucketLifecycle = "bucketLifecycle"
+	phaseListing         = "listing"
+)
+
+type (
+	// phaseState is the state of a phase across cycles.
+	phaseState struct {
+		LastSuccess         time.Time `json:"lastSuccess"`
+		LastAttempt         time.Time `json:"lastAttempt"`
+		LastError           string    `json:"lastError,omitempty"`
+		ConsecutiveFailures int       `json:"consecutiveFailures,omitempty"`
+	}
+
+	// phaseStates holds the state of every phase that ran, by name.
+	phaseStates map[string]*phaseState
+
+	// phaseResult is the outcome of a phase in a single cycle.
+	phaseResult struct {
+		Name     string `json:"name"`
+		Duration string `json:"duration"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	// cyclePhases collects the outcome of the phases of a cycle.
+	cyclePhases struct {
+		results []phaseResult
+		skipped []string
+		errs    []error
+	}
+)
+
+func (ps phaseStates) String() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "phases:             %d\n", len(ps))
+	for _, name := range sortedKeys(ps) {
+		s := ps[name]
+		fmt.Fprintf(&out, "  %s: last success %s", name, formatTime(s.LastSuccess))
+		if s.ConsecutiveFailures > 0 {
+			fmt.Fprintf(&out, ", %d consecutive failures, last error: %s", s.ConsecutiveFailures, s.LastError)
+		}
+		fmt.Fprintln(&out)
+	}
+	return out.String()
+}
+
+// runPhase runs the phase if it's part of the running cycle and due, and
+// records its outcome. A failed phase doesn't stop the cycle, its error is
+// collected and the remaining phases still run, e.g. verification keeps
+// running against the existing data while uploads are broken.
+func (p *profile) runPhase(cp *cyclePhases, phase string, fn func() error) {
+	if !p.inCycle(phase) {
+		return
+	} else if !p.phaseDue(phase, time.Now()) {
+		p.logger.Infof("skipping phase '%s', it's not due", phase)
+		cp.skipped = append(cp.skipped, phase)
+		return
+	} else if !p.locks.lockPhase(phase) {
+		p.logger.Infof("skipping phase '%s', it's already running", phase)
+		cp.skipped = append(cp.skipped, phase)
+		return
+	}
+	defer p.locks.unlockPhase(phase)
+
+	start := time.Now()
+	err := fn()
+	res := phaseResult{
+		Name:     phase,
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		p.logger.Errorf("phase '%s' failed, err: %v", phase, err)
+		res.Error = err.Error()
+		cp.errs = append(cp.errs, err)
+		p.phaseFailed(phase, start, err)
+	} else {
+		p.phaseRan(phase, start)
+	}
+	cp.results = append(cp.results, res)
+}
+
+// inCycle returns whether the phase is part of the running cycle. The cycle of
+// a phase with its own schedule only runs that phase, and once phases run in
+// cycles of their own the regular cycle leaves them out.
+func (p *profile) inCycle(phase string) bool {
+	if p.ownPhase != "" {
+		return phase == p.ownPhase
+	}
+	return !p.detached || !p.hasOwnSchedule(phase)
+}
+
+// phaseFailing returns whether the phase's last run failed.
+func (p *profile) phaseFailing(phase string) bool {
+	failures, err := store.phaseFailures(p.Name, phase)
+	if err != nil {
+		p.logger.Warnf("failed to fetch the failures of phase '%s', err: %v", phase, err)
+		return false
+	}
+	return failures > 0
+}
+
+// phaseFailed records the phase's failed run that started at the given time.
+func (p *profile) phaseFailed(phase string, start time.Time, err error) {
+	if err := store.recordPhaseFailure(p.Name, phase, start, err); err != nil {
+		p.logger.Warnf("failed to record the failure of phase '%s', err: %v", phase, err)
+	}
+}
+
+// err combines the errors of the failed phases into one that matches all of
+// them.
+func (cp *cyclePhases) err() (err error) {
+	for _, e := range cp.errs {
+		if err == nil {
+			err = e
+		} else {
+			err = fmt.Errorf("%w; %w", err, e)
+		}
+	}
+	return
+}
+
+// recordPhaseFailure records the failure of the profile's phase's run that
+// started at the given time.
+func (st *stateStore) recordPhaseFailure(profile, phase string, start time.Time, phaseErr error) error {
+	_, err := st.db.Exec(`INSERT INTO phase_runs (profile, phase, ran_at, jitter, attempted_at, error, failures) VALUES (?, ?, 0, 0, ?, ?, 1)
+ON CONFLICT (profile, phase) DO UPDATE SET attempted_at = excluded.attempted_at, error = excluded.error, failures = failures + 1`, profile, phase, start.UnixNano(), phaseErr.Error())
+	return err
+}
+
+// phaseFailures returns the number of consecutive failures of the profile's
+// phase.
+func (st *stateStore) phaseFailures(profile, phase string) (failures int, _ error) {
+	err := st.db.QueryRow(`SELECT failures FROM phase_runs WHERE profile = ? AND phase = ?`, profile, phase).Scan(&failures)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return failures, err
+}
+
+// phaseStates returns the state of the profile's phases.
+func (st *stateStore) phaseStates(profile string) (phaseStates, error) {
+	rows, err := st.db.Query(`SELECT phase, ran_at, attempted_at, error, failures FROM phase_runs WHERE profile = ?`, profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load phases of profile '%s', err: %v", profile, err)
+	}
+	defer rows.Close()
+
+	states := make(phaseStates)
+	for rows.Next() {
+		var phase string
+		var ranAt, attemptedAt int64
+		var errStr *string
+		var ps phaseState
+		if err := rows.Scan(&phase, &ranAt, &attemptedAt, &errStr, &ps.ConsecutiveFailures); err != nil {
+			return nil, err
+		}
+		if ranAt > 0 {
+			ps.LastSuccess = time.Unix(0, ranAt).UTC()
+		}
+		if attemptedAt > 0 {
+			ps.LastAttempt = time.Unix(0, attemptedAt).UTC()
+		}
+		if errStr != nil {
+			ps.LastError = *errStr
+		}
+		states[phase] = &ps
+	}
+	return states, rows.Err()
+}
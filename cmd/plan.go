@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// phases of a cycle whose work is planned up front and persisted, so an
+// interrupted cycle can be resumed
+const (
+	phaseTrim        = "trim"
+	phaseUpload      = "upload"
+	phaseVerify      = "verify"
+	phaseDelete      = "delete"
+	phasePruneVerify = "pruneVerify"
+)
+
+type (
+	// cyclePlan is the persisted plan of the running cycle, run is the phase
+	// with its own schedule the cycle belongs to or empty for the profile's
+	// regular cycle.
+	cyclePlan struct {
+		profile   string
+		run       string
+		startedAt time.Time
+		resumed   bool
+
+		// completed is the amount of data per phase that was processed
+		// before the cycle was resumed
+		completed map[string]int64
+	}
+
+	// cycleTask is a single unit of work of a phase, either an object or
+	// the size of a file to upload.
+	cycleTask struct {
+		idx  int
+		Key  string
+		Size int64
+	}
+)
+
+// beginCycle resumes the profile's running cycle of the given run or starts a
+// new one.
+func (st *stateStore) beginCycle(profile, run string) (*cyclePlan, error) {
+	plan := &cyclePlan{profile: profile, run: run, completed: make(map[string]int64)}
+
+	var startedAt int64
+	err := st.db.QueryRow(`SELECT started_at FROM cycles WHERE profile = ? AND run = ?`, profile, run).Scan(&startedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		plan.startedAt = time.Now()
+		if _, err := st.db.Exec(`INSERT INTO cycles (profile, run, started_at) VALUES (?, ?, ?)`, profile, run, plan.startedAt.UnixNano()); err != nil {
+			return nil, fmt.Errorf("failed to record running cycle, err: %v", err)
+		}
+		return plan, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to fetch running cycle, err: %v", err)
+	}
+	plan.startedAt = time.Unix(0, startedAt)
+	plan.resumed = true
+
+	rows, err := st.db.Query(`SELECT phase, SUM(size) FROM cycle_tasks WHERE profile = ? AND run = ? AND done GROUP BY phase`, profile, run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch progress of running cycle, err: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var phase string
+		var size int64
+		if err := rows.Scan(&phase, &size); err != nil {
+			return nil, err
+		}
+		plan.completed[phase] = size
+	}
+	return plan, rows.Err()
+}
+
+// hasRunningCycle returns whether the profile has a cycle of the given run to
+// resume.
+func (st *stateStore) hasRunningCycle(profile, run string) (exists bool, _ error) {
+	err := st.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM cycles WHERE profile = ? AND run = ?)`, profile, run).Scan(&exists)
+	return exists, err
+}
+
+// hasCycleToResume returns whether the profile's previous cycle of the given
+// run was interrupted and can be resumed.
+func (p *profile) hasCycleToResume(run string) bool {
+	exists, err := store.hasRunningCycle(p.Name, run)
+	if err != nil {
+		p.logger.Warnf("failed to check for a cycle to resume, err: %v", err)
+	}
+	return exists
+}
+
+// tasks returns the phase's remaining tasks. If the phase wasn't planned yet,
+// its tasks are built and persisted first.
+func (plan *cyclePlan) tasks(phase string, build func() ([]cycleTask, error)) ([]cycleTask, error) {
+	var planned bool
+	if err := store.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM cycle_tasks WHERE profile = ? AND run = ? AND phase = ?)`, plan.profile, plan.run, phase).Scan(&planned); err != nil {
+		return nil, err
+	}
+
+	// plan the phase
+	if !planned {
+		tasks, err := build()
+		if err != nil {
+			return nil, err
+		}
+		if err := store.transaction(func(tx *sql.Tx) error {
+			for i := range tasks {
+				tasks[i].idx = i
+				if _, err := tx.Exec(`INSERT INTO cycle_tasks (profile, run, phase, idx, key, size) VALUES (?, ?, ?, ?, ?, ?)`, plan.profile, plan.run, phase, i, tasks[i].Key, tasks[i].Size); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to persist the plan of phase '%s', err: %v", phase, err)
+		}
+		return tasks, nil
+	}
+
+	// fetch the remaining tasks
+	rows, err := store.db.Query(`SELECT idx, key, size FROM cycle_tasks WHERE profile = ? AND run = ? AND phase = ? AND NOT done ORDER BY idx`, plan.profile, plan.run, phase)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []cycleTask
+	for rows.Next() {
+		var t cycleTask
+		if err := rows.Scan(&t.idx, &t.Key, &t.Size); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// done marks the task of the phase as done.
+func (plan *cyclePlan) done(phase string, t cycleTask) error {
+	_, err := store.db.Exec(`UPDATE cycle_tasks SET done = 1 WHERE profile = ? AND run = ? AND phase = ? AND idx = ?`, plan.profile, plan.run, phase, t.idx)
+	return err
+}
+
+// plannedTasks returns the remaining tasks of the phase in the running cycle,
+// outside of a cycle the tasks are built on the spot.
+func (p *profile) plannedTasks(phase string, build func() ([]cycleTask, error)) ([]cycleTask, error) {
+	if p.plan == nil {
+		return build()
+	}
+	return p.plan.tasks(phase, build)
+}
+
+// resumedPlan returns whether the running cycle was resumed, the objects of
+// its plan may have been removed before the restart.
+func (p *profile) resumedPlan() bool {
+	return p.plan != nil && p.plan.resumed
+}
+
+// taskDone records the progress of the running cycle, failing to do so only
+// means the task is redone if the cycle is resumed.
+func (p *profile) taskDone(phase string, t cycleTask) {
+	if p.plan == nil {
+		return
+	}
+	if err := p.plan.done(phase, t); err != nil {
+		p.logger.Warnf("failed to record progress of phase '%s', err: %v", phase, err)
+	}
+}
+
+// plannedBatch plans a random batch of objects of the given size.
+func (p *profile) plannedBatch(phase string, size int64) ([]cycleTask, error) {
+	return p.plannedTasks(phase, func() ([]cycleTask, error) {
+		batch, err := p.calculateRandomBatch(size)
+		if err != nil {
+			return nil, err
+		}
+		tasks := make([]cycleTask, len(batch))
+		for i, entry := range batch {
+			tasks[i] = cycleTask{Key: entry.Key, Size: entry.Size}
+		}
+		return tasks, nil
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.sia.tech/renterd/api"
+	"go.uber.org/zap"
+)
+
+// profile is a dataset that's checked independently of the other profiles,
+// each profile has its own bucket, state and alerts.
+type profile struct {
+	profileConfig
+
+	logger    *zap.SugaredLogger
+	rs        api.RedundancySettings
+	packing   bool
+	transport transport
+
+	// hosts is the scoreboard downloads are attributed to, it's nil outside
+	// of integrity checks
+	hosts hostScoreboard
+
+	// plan is the persisted plan of the running cycle, it's nil outside of
+	// integrity checks
+	plan *cyclePlan
+
+	// ownPhase is the phase with its own schedule whose cycle is running,
+	// it's empty for the profile's regular cycle. If detached is set, phases
+	// with their own schedule run in cycles of their own rather than in the
+	// regular cycle.
+	ownPhase string
+	detached bool
+
+	// locks coordinates the cycles that run concurrently, it's shared by the
+	// copies of the profile the cycles run on
+	locks *profileLocks
+
+	// packed holds the packed files that haven't been flushed yet along with
+	// the time they were uploaded
+	packed map[string]time.Time
+}
+
+// newProfiles returns the configured profiles, if name is set only the profile
+// with that name is returned.
+func newProfiles(name string) (profiles []*profile, _ error) {
+	for _, pc := range cfg.resolveProfiles() {
+		if name != "" && pc.Name != name {
+			continue
+		}
+
+		t, err := newTransport(pc.Transport)
+		if err != nil {
+			return nil, err
+		}
+
+		p := &profile{
+			profileConfig: pc,
+			transport:     t,
+			locks:         newProfileLocks(),
+			packed:        make(map[string]time.Time),
+		}
+		if logger != nil {
+			p.logger = logger.Named(pc.Name)
+		}
+		profiles = append(profiles, p)
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("profile '%s' not found", name)
+	}
+	return
+}
+
+// refreshRedundancy fetches the upload settings and updates the profile's
+// redundancy and whether upload packing is enabled, which decides whether the
+// packing checks run.
+func (p *profile) refreshRedundancy() error {
+	err := withSaneTimeout(func(ctx context.Context) error {
+		us, err := bc.UploadSettings(ctx)
+		if err != nil {
+			return err
+		}
+		p.rs = us.Redundancy
+		p.packing = us.Packing.Enabled
+		return nil
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to refresh redundancy; %w", err)
+	}
+	return nil
+}
+
+// fork returns a copy of the profile to run a cycle of the given run on, the
+// cycle uses the config as it was when the cycle started. The copy shares the
+// locks and the packed files with the profile.
+func (p *profile) fork(run string) *profile {
+	q := *p
+	q.ownPhase = run
+	return &q
+}
+
+func (p *profile) resetDataset() error {
+	p.logger.Infof("remove all files from %s%s", p.Bucket, p.remotePrefix())
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		return bc.RemoveObjects(ctx, p.Bucket, p.remotePrefix())
+	}, nil); err != nil && !strings.Contains(err.Error(), api.ErrObjectNotFound.Error()) {
+		return err
+	}
+	return nil
+}
+
+// adoptObjects moves the objects under the profile's old prefix to its
+// current prefix, so changing the prefix doesn't orphan the dataset.
+func (p *profile) adoptObjects() error {
+	if p.AdoptPrefix == "" || p.AdoptPrefix == p.Prefix {
+		return nil
+	}
+
+	from, to := remotePrefix(p.AdoptPrefix), p.remotePrefix()
+	p.logger.Infof("adopting objects from %s%s", p.Bucket, from)
+	if err := withSaneTimeout(func(ctx context.Context) error {
+		return bc.RenameObjects(ctx, p.Bucket, from, to, false)
+	}, nil); err != nil && !strings.Contains(err.Error(), api.ErrObjectNotFound.Error()) {
+		return fmt.Errorf("failed to adopt objects from '%s'; %w", from, err)
+	}
+	return nil
+}
+
+// objectKey returns the key of the object with the given name, keys are
+// independent of where the data is stored locally.
+func (p *profile) objectKey(name string) string {
+	return p.Prefix + "/" + name
+}
+
+// remotePrefix returns the prefix that all of the profile's object keys share.
+func (p *profile) remotePrefix() string {
+	return remotePrefix(p.Prefix)
+}
+
+func remotePrefix(prefix string) string {
+	return "/" + prefix + "/"
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.sia.tech/renterd/api"
+	"go.sia.tech/renterd/bus"
+	"go.uber.org/zap"
+)
+
+// newTestBus points the bus client at a test server serving the given handler,
+// the client is restored when the test finishes.
+func newTestBus(t *testing.T, h http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	prev := bc
+	bc = bus.NewClient(srv.URL, "")
+	t.Cleanup(func() {
+		bc = prev
+		srv.Close()
+	})
+}
+
+// newTestProfile returns the default profile, its bus is a test server serving
+// the given handler.
+func newTestProfile(t *testing.T, h http.HandlerFunc) *profile {
+	t.Helper()
+	newTestBus(t, h)
+
+	p := &profile{logger: zap.NewNop().Sugar()}
+	p.Name = "default"
+	p.Bucket = defaultBucketName
+	return p
+}
+
+func TestAdoptObjects(t *testing.T) {
+	tests := []struct {
+		name        string
+		adoptPrefix string
+		status      int
+		err         string
+		renamed     bool
+	}{
+		{name: "no prefix to adopt"},
+		{name: "same prefix", adoptPrefix: "data"},
+		{name: "adopted", adoptPrefix: "old", status: http.StatusOK, renamed: true},
+		{name: "nothing to adopt", adoptPrefix: "old", status: http.StatusNotFound, renamed: true},
+		{name: "failed", adoptPrefix: "old", status: http.StatusInternalServerError, err: "failed to adopt objects from '/old/'", renamed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var req *api.ObjectsRenameRequest
+			p := newTestProfile(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/objects/rename" {
+					http.NotFound(w, r)
+					return
+				}
+				req = new(api.ObjectsRenameRequest)
+				if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				switch test.status {
+				case http.StatusNotFound:
+					http.Error(w, api.ErrObjectNotFound.Error(), http.StatusNotFound)
+				case http.StatusInternalServerError:
+					http.Error(w, "internal error", http.StatusInternalServerError)
+				}
+			})
+			p.Prefix = "data"
+			p.AdoptPrefix = test.adoptPrefix
+
+			err := p.adoptObjects()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.renamed {
+				if req != nil {
+					t.Fatalf("expected no objects to be renamed, got %+v", *req)
+				}
+				return
+			} else if req == nil {
+				t.Fatal("expected the objects to be renamed")
+			} else if req.Bucket != defaultBucketName || req.From != "/old/" || req.To != "/data/" || req.Mode != api.ObjectsRenameModeMulti || req.Force {
+				t.Fatalf("unexpected rename request %+v", *req)
+			}
+		})
+	}
+}
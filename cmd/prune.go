@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.sia.tech/renterd/api"
+)
+
+// prunedContract records the outcome of pruning a single contract.
+type prunedContract struct {
+	ID        string `json:"id"`
+	Size      string `json:"size"`
+	Pruned    string `json:"pruned"`
+	Remaining string `json:"remaining"`
+	Duration  string `json:"duration"`
+	Error     string `json:"error,omitempty"`
+}
+
+// contractPruner is the profile that prunes contracts. Pruning isn't limited
+// to a profile's dataset, it prunes every contract of the bus, so only one
+// profile of the process prunes them.
+var contractPruner struct {
+	mu    sync.Mutex
+	owner string
+}
+
+// pruneStats summarizes a cycle's pruning phase.
+type pruneStats struct {
+	prunableBefore int64
+	prunableAfter  int64
+	pruned         int64
+	duration       time.Duration
+	contracts      []prunedContract
+}
+
+// pruneContracts prunes every contract with prunable data and re-verifies part
+// of the dataset afterwards, proving pruning didn't remove any live sectors.
+// Contracts that fail to prune are recorded but don't fail the phase.
+func (p *profile) pruneContracts() (stats pruneStats, _ error) {
+	before, err := prunableData()
+	if err != nil {
+		return stats, err
+	}
+	stats.prunableBefore = int64(before.TotalPrunable)
+	p.logger.Infof("pruning %s from %d contracts", humanReadableSize(stats.prunableBefore), len(before.Contracts))
+
+	start := time.Now()
+	for _, c := range before.Contracts {
+		if c.Prunable == 0 {
+			continue
+		}
+
+		cStart := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), p.PruneTimeout+time.Minute)
+		res, err := bc.PruneContract(ctx, c.ID, p.PruneTimeout)
+		cancel()
+
+		pc := prunedContract{
+			ID:        c.ID.String(),
+			Size:      humanReadableSize(int64(res.ContractSize)),
+			Pruned:    humanReadableSize(int64(res.Pruned)),
+			Remaining: humanReadableSize(int64(res.Remaining)),
+			Duration:  time.Since(cStart).Round(time.Millisecond).String(),
+			Error:     res.Error,
+		}
+		if err != nil {
+			pc.Error = err.Error()
+		}
+		if pc.Error != "" {
+			p.logger.Warnf("failed to prune contract %v, err: %v", c.ID, pc.Error)
+		}
+		stats.pruned += int64(res.Pruned)
+		stats.contracts = append(stats.contracts, pc)
+	}
+	stats.duration = time.Since(start)
+
+	after, err := prunableData()
+	if err != nil {
+		return stats, err
+	}
+	stats.prunableAfter = int64(after.TotalPrunable)
+	p.logger.Infof("pruned %s in %v, %s prunable data remaining", humanReadableSize(stats.pruned), stats.duration.Round(time.Second), humanReadableSize(stats.prunableAfter))
+
+	// verify pruning didn't remove any live sectors
+	size := pctOf(p.PruneVerifyPct, p.DatasetSize)
+	p.logger.Infof("verifying %v%% of our dataset (%v) after pruning", p.PruneVerifyPct, humanReadableSize(size))
+	if _, err := p.checkIntegrity(phasePruneVerify, size); err != nil {
+		return stats, fmt.Errorf("failed to verify the dataset after pruning; %w", err)
+	}
+	return
+}
+
+// prunesContracts returns whether the profile prunes contracts. The first
+// profile with contract pruning enabled that asks becomes the pruner, until it
+// disables contract pruning.
+func (p *profile) prunesContracts() bool {
+	contractPruner.mu.Lock()
+	defer contractPruner.mu.Unlock()
+
+	if !p.ContractPruning {
+		if contractPruner.owner == p.Name {
+			contractPruner.owner = ""
+		}
+		return false
+	} else if contractPruner.owner == "" {
+		contractPruner.owner = p.Name
+	} else if contractPruner.owner != p.Name {
+		p.logger.Infof("skipping contract pruning, contracts are pruned by profile '%s'", contractPruner.owner)
+		return false
+	}
+	return true
+}
+
+func prunableData() (res api.ContractsPrunableDataResponse, err error) {
+	err = withSaneTimeout(func(ctx context.Context) (err error) {
+		res, err = bc.PrunableData(ctx)
+		return
+	}, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to fetch prunable data; %w", err)
+	}
+	return
+}
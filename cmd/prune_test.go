@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestPrunesContracts(t *testing.T) {
+	t.Cleanup(func() { contractPruner.owner = "" })
+
+	newProfile := func(name string, pruning bool) *profile {
+		p := &profile{logger: zap.NewNop().Sugar()}
+		p.Name = name
+		p.ContractPruning = pruning
+		return p
+	}
+	a, b, c := newProfile("a", true), newProfile("b", true), newProfile("c", false)
+
+	steps := []struct {
+		p    *profile
+		want bool
+	}{
+		{c, false},
+		{a, true},
+		{b, false},
+		{a, true},
+		{c, false},
+	}
+	for i, step := range steps {
+		if got := step.p.prunesContracts(); got != step.want {
+			t.Fatalf("%d: expected profile '%s' to prune: %v", i, step.p.Name, step.want)
+		}
+	}
+
+	// the pruner hands over once it disables pruning
+	a.ContractPruning = false
+	if a.prunesContracts() {
+		t.Fatal("expected 'a' to stop pruning")
+	} else if !b.prunesContracts() {
+		t.Fatal("expected 'b' to take over pruning")
+	} else if a.ContractPruning = true; a.prunesContracts() {
+		t.Fatal("expected 'a' to wait for 'b'")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var (
+	errCorruptState     = errors.New("state database is corrupt")
+	errCycleInterrupted = errors.New("cycle was interrupted, the checker stopped while it was running")
+)
+
+// backupPath returns the path of the database's backup, which holds the state
+// as it was before the last write.
+func backupPath(path string) string {
+	return path + ".bak"
+}
+
+// isCorrupt returns whether the error indicates the database file is corrupt
+// or isn't a database at all.
+func isCorrupt(err error) bool {
+	var sErr *sqlite.Error
+	if errors.As(err, &sErr) {
+		code := sErr.Code() & 0xff // primary result code
+		return code == sqlite3.SQLITE_CORRUPT || code == sqlite3.SQLITE_NOTADB
+	}
+	return errors.Is(err, errCorruptState)
+}
+
+// checkIntegrity runs a quick integrity check of the database.
+func (st *stateStore) checkIntegrity() error {
+	var res string
+	if err := st.db.QueryRow(`PRAGMA quick_check`).Scan(&res); err != nil {
+		return err
+	} else if res != "ok" {
+		return fmt.Errorf("%w: %s", errCorruptState, res)
+	}
+	return nil
+}
+
+// backupIfDue backs up the database unless it was backed up less than
+// stateBackupInterval ago, by default it backs up before every write.
+func (st *stateStore) backupIfDue() error {
+	st.backupMu.Lock()
+	defer st.backupMu.Unlock()
+	if !st.lastBackup.IsZero() && time.Since(st.lastBackup) < cfg.StateBackupInterval {
+		return nil
+	}
+	return st.writeBackup()
+}
+
+// backup writes a copy of the database next to it. The copy is written to a
+// temporary file, synced and renamed, so the previous backup stays intact if
+// the process dies halfway.
+func (st *stateStore) backup() error {
+	st.backupMu.Lock()
+	defer st.backupMu.Unlock()
+	return st.writeBackup()
+}
+
+// writeBackup writes the backup, the caller must hold the backup mutex since
+// all backups share the same temporary file.
+func (st *stateStore) writeBackup() error {
+	dst := backupPath(st.path)
+	tmp := dst + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, err := st.db.Exec(`VACUUM INTO ?`, tmp); err != nil {
+		return fmt.Errorf("failed to back up state database, err: %v", err)
+	} else if err := syncAndRename(tmp, dst); err != nil {
+		return fmt.Errorf("failed to back up state database, err: %v", err)
+	}
+	st.lastBackup = time.Now()
+	return nil
+}
+
+// recoverState replaces the corrupt database with its backup, the corrupt
+// database is moved aside so it can be inspected.
+func recoverState(path string) error {
+	backup := backupPath(path)
+	if _, err := os.Stat(backup); errors.Is(err, os.ErrNotExist) {
+		return errors.New("no backup found")
+	} else if err != nil {
+		return err
+	}
+
+	// move the corrupt database and its journal aside
+	corrupt := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Rename(path+suffix, corrupt+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// restore the backup
+	tmp := path + ".tmp"
+	if err := copyFile(backup, tmp); err != nil {
+		return fmt.Errorf("failed to copy backup, err: %v", err)
+	}
+	return syncAndRename(tmp, path)
+}
+
+// reconcileCycles adds a failed result for every cycle of the profile that
+// was still running when the process died and is too old to be resumed.
+func (st *stateStore) reconcileCycles(profile string, s *state) (reconciled []result, _ error) {
+	type running struct {
+		run       string
+		startedAt int64
+	}
+	var cycles []running
+	rows, err := st.db.Query(`SELECT run, started_at FROM cycles WHERE profile = ? ORDER BY started_at`, profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch running cycles of profile '%s', err: %v", profile, err)
+	}
+	for rows.Next() {
+		var c running
+		if err := rows.Scan(&c.run, &c.startedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		cycles = append(cycles, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range cycles {
+		// the time the cycle ended is unknown
+		start := time.Unix(0, c.startedAt).UTC()
+		if cfg.CycleResumeTimeout > 0 && time.Since(start) < cfg.CycleResumeTimeout {
+			continue
+		}
+		res := result{
+			Phase:       c.run,
+			StartedAt:   start,
+			EndedAt:     start,
+			Interrupted: true,
+			Err:         &resultErr{errCycleInterrupted},
+		}
+		if err := st.addResult(profile, s, res); err != nil {
+			return reconciled, err
+		}
+		reconciled = append(reconciled, res)
+	}
+	return reconciled, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// syncAndRename syncs the file and atomically moves it to its destination,
+// after which the directory is synced to persist the rename.
+func syncAndRename(tmp, dst string) error {
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	} else if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// reconcileInterruptedCycles records a failed result for every cycle of the
+// profile that was interrupted when the process died, and alerts about them.
+func (p *profile) reconcileInterruptedCycles(s *state) {
+	reconciled, err := store.reconcileCycles(p.Name, s)
+	if err != nil {
+		p.logger.Error(err)
+	}
+	for _, res := range reconciled {
+		if res.Phase != "" {
+			p.logger.Warnf("the cycle of phase '%s' started at %v was interrupted", res.Phase, res.StartedAt)
+		} else {
+			p.logger.Warnf("the cycle started at %v was interrupted", res.StartedAt)
+		}
+		if err := p.registerAlert(res); err != nil {
+			p.logger.Warnf("failed to register alert, err: %v", err)
+		}
+	}
+}
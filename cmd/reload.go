@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	configPollInterval = 10 * time.Second
+)
+
+var (
+	// reloadableFields are the profile settings that can be changed without
+	// restarting the checker.
+	reloadableFields = []string{
+		"datasetSize",
+		"minFilesize",
+		"maxFilesize",
+		"fileSizeDistribution",
+		"slabBoundaryPct",
+		"contentGenerators",
+		"uploadConcurrency",
+		"churnOperations",
+		"listingCheck",
+		"contractPruning",
+		"pruneTimeout",
+		"pruneVerifyPct",
+		"sweepPeriod",
+		"coverageWindow",
+		"maxUploadSCPerTB",
+		"maxDownloadSCPerTB",
+		"bucketLifecycleObjects",
+		"packedFiles",
+		"packedMaxFilesize",
+		"packedFlushTimeout",
+		"integrityCheckInterval",
+		"schedule",
+		"phaseSchedules",
+		"catchUp",
+		"integrityCheckDeletePct",
+		"integrityCheckDownloadPct",
+	}
+)
+
+// watchConfig reloads the config whenever the config file changes or the
+// process receives a SIGHUP, valid configs are forwarded to every profile
+// through the returned channels.
+func watchConfig(path string, overrides []string, profiles []*profile, stopChan chan struct{}) map[string]chan config {
+	reloadChans := make(map[string]chan config)
+	for _, p := range profiles {
+		reloadChans[p.Name] = make(chan config, 1)
+	}
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hupCh)
+
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+
+		lastMod := modTime(path)
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-hupCh:
+				logger.Info("received SIGHUP, reloading config")
+			case <-ticker.C:
+				if mod := modTime(path); mod.Equal(lastMod) {
+					continue
+				} else {
+					lastMod = mod
+				}
+				logger.Info("config file changed, reloading config")
+			}
+
+			c, err := buildConfig(path, overrides)
+			if err != nil {
+				logger.Errorf("rejected config reload, err: %v", err)
+				continue
+			}
+			// changes are diffed against the running config, so a change
+			// that requires a restart is warned about on every reload until
+			// the file matches the running config again
+			logGlobalConfigChanges(cfg, c)
+
+			// replace any reload that wasn't picked up yet
+			for _, reloadCh := range reloadChans {
+				select {
+				case <-reloadCh:
+				default:
+				}
+				reloadCh <- c
+			}
+		}
+	}()
+	return reloadChans
+}
+
+// logGlobalConfigChanges warns about changes outside of the profile settings,
+// those require a restart.
+func logGlobalConfigChanges(prev, next config) {
+	redactedPrev, redactedNext := redactedConfig(prev), redactedConfig(next)
+	prevFields, nextFields := configFields(&redactedPrev), configFields(&redactedNext)
+	profileFields := configFields(&profileConfig{})
+
+	for _, key := range sortedKeys(prevFields) {
+		if _, ok := profileFields[key]; ok {
+			continue
+		} else if !reflect.DeepEqual(prevFields[key].Interface(), nextFields[key].Interface()) {
+			logger.Warnf("config change %s: %v -> %v requires a restart, ignoring", key, prevFields[key], nextFields[key])
+		}
+	}
+
+	prevProfiles := make(map[string]bool)
+	for _, p := range prev.resolveProfiles() {
+		prevProfiles[p.Name] = true
+	}
+	for _, p := range next.resolveProfiles() {
+		if !prevProfiles[p.Name] {
+			logger.Warnf("config change adds profile '%s', which requires a restart, ignoring", p.Name)
+		}
+	}
+}
+
+// applyConfig applies the reloadable changes to the profile's settings in the
+// given config and logs what changed, it returns whether anything was applied.
+func (p *profile) applyConfig(c config) (applied bool) {
+	var next *profileConfig
+	for _, pc := range c.resolveProfiles() {
+		if pc.Name == p.Name {
+			next = &pc
+			break
+		}
+	}
+	if next == nil {
+		p.logger.Warn("profile was removed from the config, which requires a restart, ignoring")
+		return false
+	}
+
+	curr := configFields(&p.profileConfig)
+	upd := configFields(next)
+	for _, key := range sortedKeys(curr) {
+		if reflect.DeepEqual(curr[key].Interface(), upd[key].Interface()) {
+			continue
+		}
+
+		if !isReloadable(key) {
+			p.logger.Warnf("config change %s: %v -> %v requires a restart, ignoring", key, curr[key], upd[key])
+			continue
+		}
+
+		p.logger.Infof("config change %s: %v -> %v", key, curr[key], upd[key])
+		curr[key].Set(upd[key])
+		applied = true
+	}
+
+	// the histogram isn't a config field since it can only be set in the file
+	if !reflect.DeepEqual(p.FileSizeDistribution.Histogram, next.FileSizeDistribution.Histogram) {
+		p.logger.Infof("config change fileSizeDistribution.histogram: %v -> %v", p.FileSizeDistribution.Histogram, next.FileSizeDistribution.Histogram)
+		p.FileSizeDistribution.Histogram = next.FileSizeDistribution.Histogram
+		applied = true
+	}
+	return
+}
+
+func isReloadable(key string) bool {
+	for _, field := range reloadableFields {
+		if key == field || strings.HasPrefix(key, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func modTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newObservedLogger returns a logger that records warnings and errors.
+func newObservedLogger() (*zap.SugaredLogger, *observer.ObservedLogs) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	return zap.New(core).Sugar(), logs
+}
+
+func TestApplyConfig(t *testing.T) {
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+	cfg = defaultConfig
+
+	l, logs := newObservedLogger()
+	p := &profile{profileConfig: cfg.profileConfig, logger: l}
+
+	next := defaultConfig
+	next.DatasetSize = cfg.DatasetSize * 2
+	next.Bucket = "other"
+	next.FileSizeDistribution.Histogram = []sizeBucketConfig{{Min: 1, Max: 2, Weight: 1}}
+
+	// reloadable changes are applied, others are ignored
+	if !p.applyConfig(next) {
+		t.Fatal("expected the config to be applied")
+	} else if p.DatasetSize != next.DatasetSize {
+		t.Fatalf("expected dataset size %d, got %d", next.DatasetSize, p.DatasetSize)
+	} else if len(p.FileSizeDistribution.Histogram) != 1 {
+		t.Fatal("expected the histogram to be applied")
+	} else if p.Bucket != defaultConfig.Bucket {
+		t.Fatalf("expected bucket '%s', got '%s'", defaultConfig.Bucket, p.Bucket)
+	} else if logs.FilterMessageSnippet("config change bucket").Len() != 1 {
+		t.Fatalf("expected a warning about the bucket, got %v", logs.All())
+	}
+
+	// the ignored change is warned about until it's reverted
+	if p.applyConfig(next) {
+		t.Fatal("expected nothing to be applied")
+	} else if logs.FilterMessageSnippet("config change bucket").Len() != 2 {
+		t.Fatalf("expected a second warning about the bucket, got %v", logs.All())
+	}
+	next.Bucket = defaultConfig.Bucket
+	if p.applyConfig(next) {
+		t.Fatal("expected nothing to be applied")
+	} else if logs.FilterMessageSnippet("config change bucket").Len() != 2 {
+		t.Fatalf("expected no more warnings, got %v", logs.All())
+	}
+
+	// a removed profile is ignored
+	next.Profiles = []profileConfig{{Name: "other"}}
+	if p.applyConfig(next) {
+		t.Fatal("expected nothing to be applied")
+	} else if logs.FilterMessageSnippet("profile was removed").Len() != 1 {
+		t.Fatalf("expected a warning about the removed profile, got %v", logs.All())
+	}
+}
+
+func TestLogGlobalConfigChanges(t *testing.T) {
+	prevLogger := logger
+	t.Cleanup(func() { logger = prevLogger })
+	l, logs := newObservedLogger()
+	logger = l
+
+	prev := defaultConfig
+	prev.BusPassw = "old"
+
+	// profile settings are applied by the profiles
+	next := prev
+	next.DatasetSize *= 2
+	logGlobalConfigChanges(prev, next)
+	if logs.Len() != 0 {
+		t.Fatalf("expected no warnings, got %v", logs.All())
+	}
+
+	// global settings and new profiles require a restart, secrets are redacted
+	next.BusAddr = "http://localhost:9999/api/bus"
+	next.BusPassw = "new"
+	next.Profiles = []profileConfig{{Name: defaultConfig.Name}, {Name: "new"}}
+	logGlobalConfigChanges(prev, next)
+	if logs.FilterMessageSnippet("config change busAddr").Len() != 1 {
+		t.Fatalf("expected a warning about the bus address, got %v", logs.All())
+	} else if logs.FilterMessageSnippet("adds profile 'new'").Len() != 1 {
+		t.Fatalf("expected a warning about the new profile, got %v", logs.All())
+	}
+	for _, entry := range logs.All() {
+		if strings.Contains(entry.Message, "busPassword") {
+			t.Fatalf("expected secrets to be redacted, got %q", entry.Message)
+		}
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	prevCfg, prevLogger := cfg, logger
+	t.Cleanup(func() { cfg, logger = prevCfg, prevLogger })
+	l, logs := newObservedLogger()
+	logger = l
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("datasetSize: 1048576\n")
+
+	c, err := buildConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = c
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	reloadCh := watchConfig(path, nil, []*profile{{profileConfig: cfg.profileConfig}}, stopChan)[cfg.Name]
+
+	reload := func() (config, bool) {
+		t.Helper()
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case c := <-reloadCh:
+			return c, true
+		case <-time.After(time.Second):
+			return config{}, false
+		}
+	}
+
+	// an invalid config is rejected
+	write("datasetSize: -1\n")
+	if _, ok := reload(); ok {
+		t.Fatal("expected the config to be rejected")
+	} else if logs.FilterMessageSnippet("rejected config reload").Len() != 1 {
+		t.Fatalf("expected the reload to be rejected, got %v", logs.All())
+	}
+
+	// a valid config is forwarded, a change that requires a restart is
+	// warned about on every reload
+	write("datasetSize: 2097152\nworkDir: /tmp/other\n")
+	for i := 1; i <= 2; i++ {
+		if c, ok := reload(); !ok {
+			t.Fatal("expected the config to be forwarded")
+		} else if c.DatasetSize != 2097152 {
+			t.Fatalf("expected dataset size %d, got %d", 2097152, c.DatasetSize)
+		} else if n := logs.FilterMessageSnippet("config change workDir").Len(); n != i {
+			t.Fatalf("expected %d warnings about the work dir, got %d", i, n)
+		}
+	}
+}
+
+func TestRunAppliesReload(t *testing.T) {
+	prevStore := store
+	t.Cleanup(func() { store = prevStore })
+	store = newTestStore(t)
+
+	p := &profile{profileConfig: cfg.profileConfig, logger: zap.NewNop().Sugar()}
+	p.IntegrityCheckInterval = time.Hour
+	s := &state{}
+	if err := store.addResult(p.Name, s, result{StartedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reload is applied while the profile waits for its next cycle
+	reloadCh, stopChan, done := make(chan config), make(chan struct{}), make(chan struct{})
+	go func() {
+		p.run(s, reloadCh, stopChan)
+		close(done)
+	}()
+
+	next := cfg
+	next.DatasetSize = cfg.DatasetSize * 2
+	reloadCh <- next
+	close(stopChan)
+	<-done
+
+	if p.DatasetSize != next.DatasetSize {
+		t.Fatalf("expected dataset size %d, got %d", next.DatasetSize, p.DatasetSize)
+	} else if len(s.Results) != 1 {
+		t.Fatalf("expected no cycle to run, got %d results", len(s.Results))
+	}
+}
+
+func TestRunPhasesIndependently(t *testing.T) {
+	prevStore := store
+	t.Cleanup(func() { store = prevStore })
+	store = newTestStore(t)
+
+	// the first request hangs until the test ends, every other one fails
+	var once sync.Once
+	hung, release := make(chan struct{}), make(chan struct{})
+	p := newTestProfile(t, func(w http.ResponseWriter, r *http.Request) {
+		first := false
+		once.Do(func() { first = true })
+		if first {
+			close(hung)
+			<-release
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	p.profileConfig = cfg.profileConfig
+	p.Name = "default"
+	p.IntegrityCheckInterval = time.Hour
+	p.PhaseSchedules.Verify = scheduleConfig{Interval: time.Hour}
+	p.locks = newProfileLocks()
+	s := &state{}
+
+	stopChan, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		p.run(s, make(chan config), stopChan)
+		close(done)
+	}()
+
+	// the regular cycle and the cycle of the verify phase start right away,
+	// one of them hangs while the other one completes
+	<-hung
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.Results)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("expected a cycle to complete while the other one hangs")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// stopping waits for the hung cycle
+	close(release)
+	close(stopChan)
+	<-done
+	if len(s.Results) != 2 {
+		t.Fatalf("expected both cycles to complete, got %d results", len(s.Results))
+	} else if s.Results[0].Phase == s.Results[1].Phase {
+		t.Fatalf("expected a result of each cycle, got phases '%s' and '%s'", s.Results[0].Phase, s.Results[1].Phase)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.sia.tech/core/types"
+)
+
+type report struct {
+	Cycles            int       `json:"cycles"`
+	Failures          int       `json:"failures"`
+	IntegrityFailures int       `json:"integrityFailures"`
+	LastCheck         time.Time `json:"lastCheck"`
+	LastSuccess       time.Time `json:"lastSuccess"`
+	LastError         string    `json:"lastError,omitempty"`
+
+	AvgDownloadSpeedMBPS float64 `json:"avgDownloadSpeedMBPS"`
+	AvgUploadSpeedMBPS   float64 `json:"avgUploadSpeedMBPS"`
+
+	TotalCost types.Currency `json:"totalCost"`
+	Coverage  *coverage      `json:"coverage,omitempty"`
+}
+
+// newReport summarizes the given results, which are expected to be sorted from
+// newest to oldest.
+func newReport(results []result) (r report) {
+	var downloads, uploads int
+	for _, res := range results {
+		r.Cycles++
+		if r.LastCheck.IsZero() {
+			r.LastCheck = res.StartedAt
+		}
+
+		if err := res.Error(); err != nil {
+			r.Failures++
+			// errors loaded from the state lost their type, so we match on the
+			// message
+			if strings.Contains(err.Error(), errIntegrity.Error()) {
+				r.IntegrityFailures++
+			}
+			if r.LastError == "" {
+				r.LastError = err.Error()
+			}
+		} else if r.LastSuccess.IsZero() {
+			r.LastSuccess = res.StartedAt
+		}
+
+		if res.Cost != nil && r.TotalCost.IsZero() {
+			r.TotalCost = res.Cost.RunningTotal
+		}
+		if res.Coverage != nil && r.Coverage == nil {
+			r.Coverage = res.Coverage
+		}
+
+		if res.DownloadSpeedMBPS > 0 {
+			r.AvgDownloadSpeedMBPS += res.DownloadSpeedMBPS
+			downloads++
+		}
+		if res.UploadSpeedMBPS > 0 {
+			r.AvgUploadSpeedMBPS += res.UploadSpeedMBPS
+			uploads++
+		}
+	}
+
+	if downloads > 0 {
+		r.AvgDownloadSpeedMBPS /= float64(downloads)
+	}
+	if uploads > 0 {
+		r.AvgUploadSpeedMBPS /= float64(uploads)
+	}
+	return
+}
+
+func (r report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "cycles:             %d (%d failed, %d integrity failures)\n", r.Cycles, r.Failures, r.IntegrityFailures)
+	fmt.Fprintf(&sb, "last check:         %s\n", formatTime(r.LastCheck))
+	fmt.Fprintf(&sb, "last success:       %s\n", formatTime(r.LastSuccess))
+	if r.LastError != "" {
+		fmt.Fprintf(&sb, "last error:         %s\n", r.LastError)
+	}
+	fmt.Fprintf(&sb, "avg download speed: %.2f mbps\n", r.AvgDownloadSpeedMBPS)
+	fmt.Fprintf(&sb, "avg upload speed:   %.2f mbps\n", r.AvgUploadSpeedMBPS)
+	fmt.Fprintf(&sb, "total cost:         %v\n", r.TotalCost)
+	if r.Coverage != nil {
+		sb.WriteString(r.Coverage.String())
+	}
+	return sb.String()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%v ago)", t.Format(time.RFC3339), time.Since(t).Round(time.Second))
+}
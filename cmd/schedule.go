@@ -0,0 +1,301 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+// phases of a cycle that can be scheduled separately, phaseVerify is shared
+// with the cycle's plan
+const (
+	phaseFill  = "fill"
+	phaseChurn = "churn"
+	phasePrune = "prune"
+)
+
+// schedulablePhases are the phases that can have their own schedule.
+var schedulablePhases = []string{phaseFill, phaseVerify, phaseChurn, phasePrune}
+
+type (
+	// scheduleConfig determines when a cycle or phase runs. It either runs
+	// on a cron schedule or at a fixed interval after it last started, delayed
+	// by a random jitter and restricted to the allowed time windows.
+	scheduleConfig struct {
+		Cron     string        `yaml:"cron"`
+		Interval time.Duration `yaml:"interval"`
+		Jitter   time.Duration `yaml:"jitter"`
+		Windows  []string      `yaml:"windows"`
+	}
+
+	// phaseSchedulesConfig holds the schedules of the phases of a cycle, a
+	// phase with a schedule runs on its own, a phase without one runs every
+	// cycle.
+	phaseSchedulesConfig struct {
+		Fill   scheduleConfig `yaml:"fill"`
+		Verify scheduleConfig `yaml:"verify"`
+		Churn  scheduleConfig `yaml:"churn"`
+		Prune  scheduleConfig `yaml:"prune"`
+	}
+
+	// timeWindow is a daily window in local time, a window whose end precedes
+	// its start wraps around midnight.
+	timeWindow struct {
+		start, end time.Duration
+	}
+)
+
+// isZero returns whether the schedule is unset.
+func (sc scheduleConfig) isZero() bool {
+	return sc.Cron == "" && sc.Interval == 0 && sc.Jitter == 0 && len(sc.Windows) == 0
+}
+
+// validate checks the schedule, key is the schedule's path in the config.
+func (sc scheduleConfig) validate(key string, addProblem func(format string, args ...any)) {
+	if sc.Cron != "" {
+		if c, err := parseCron(sc.Cron); err != nil {
+			addProblem("%s.cron: %v", key, err)
+		} else if c.next(time.Now()).IsZero() {
+			addProblem("%s.cron: '%s' never matches", key, sc.Cron)
+		}
+		if sc.Interval != 0 {
+			addProblem("%s: cron and interval are mutually exclusive", key)
+		}
+	}
+	if sc.Interval < 0 {
+		addProblem("%s.interval: must not be negative, got %v", key, sc.Interval)
+	}
+	if sc.Jitter < 0 {
+		addProblem("%s.jitter: must not be negative, got %v", key, sc.Jitter)
+	}
+	for i, w := range sc.Windows {
+		if _, err := parseTimeWindow(w); err != nil {
+			addProblem("%s.windows[%d]: %v", key, i, err)
+		}
+	}
+}
+
+// randomJitter returns a random delay of up to the schedule's jitter.
+func (sc scheduleConfig) randomJitter() time.Duration {
+	if sc.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(frand.Uint64n(uint64(sc.Jitter)))
+}
+
+// next returns when the cycle or phase that last started at the given time
+// runs next, if it never ran it's due right away. A cron schedule skips the
+// slots that were missed unless catchUp is set, an interval schedule always
+// runs right away once it's overdue. The jitter is added before moving the
+// time into the allowed windows. The schedule is evaluated in now's location,
+// it returns the zero time if a cron schedule never runs again.
+func (sc scheduleConfig) next(last, now time.Time, jitter time.Duration, catchUp bool) time.Time {
+	if !last.IsZero() {
+		last = last.In(now.Location())
+	}
+
+	t := now
+	if sc.Cron != "" {
+		c, _ := parseCron(sc.Cron) // validated
+		from := last
+		if from.IsZero() {
+			from = now
+		}
+		t = c.next(from)
+		if !t.IsZero() && t.Before(now) && !catchUp {
+			t = c.next(now)
+		}
+		if t.IsZero() {
+			return time.Time{}
+		}
+	} else if sc.Interval > 0 && !last.IsZero() {
+		t = last.Add(sc.Interval)
+	}
+
+	t = t.Add(jitter)
+	if t.Before(now) {
+		t = now
+	}
+	return sc.nextWindow(t)
+}
+
+// inWindow returns whether the time falls within one of the allowed windows,
+// without windows every time is allowed.
+func (sc scheduleConfig) inWindow(t time.Time) bool {
+	if len(sc.Windows) == 0 {
+		return true
+	}
+	for _, w := range sc.timeWindows() {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextWindow returns the given time if it's in an allowed window, otherwise it
+// returns the start of the first window after it.
+func (sc scheduleConfig) nextWindow(t time.Time) time.Time {
+	if sc.inWindow(t) {
+		return t
+	}
+
+	var next time.Time
+	for _, w := range sc.timeWindows() {
+		start := w.nextStart(t)
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+func (sc scheduleConfig) timeWindows() []timeWindow {
+	windows := make([]timeWindow, 0, len(sc.Windows))
+	for _, s := range sc.Windows {
+		w, _ := parseTimeWindow(s) // validated
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+// parseTimeWindow parses a window of the form "HH:MM-HH:MM".
+func parseTimeWindow(s string) (timeWindow, error) {
+	startStr, endStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("expected 'HH:MM-HH:MM', got '%s'", s)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(startStr))
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid start '%s'", startStr)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(endStr))
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid end '%s'", endStr)
+	} else if start.Equal(end) {
+		return timeWindow{}, fmt.Errorf("window '%s' is empty", s)
+	}
+	return timeWindow{
+		start: time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+		end:   time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute,
+	}, nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	d := sinceMidnight(t)
+	if w.start < w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+// nextStart returns the first start of the window after the given time.
+func (w timeWindow) nextStart(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	start := midnight.Add(w.start)
+	if !start.After(t) {
+		start = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(w.start)
+	}
+	return start
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// cycleSchedule returns the profile's cycle schedule, which runs every
+// integrity check interval unless a cron expression or interval is set.
+func (p *profile) cycleSchedule() scheduleConfig {
+	sc := p.Schedule
+	if sc.Cron == "" && sc.Interval == 0 {
+		sc.Interval = p.IntegrityCheckInterval
+	}
+	return sc
+}
+
+// phaseSchedule returns the schedule of the given phase, it's zero if the
+// phase has no schedule of its own. A schedule without a cron expression or
+// interval runs every integrity check interval.
+func (p *profile) phaseSchedule(phase string) (sc scheduleConfig) {
+	switch phase {
+	case phaseFill:
+		sc = p.PhaseSchedules.Fill
+	case phaseVerify:
+		sc = p.PhaseSchedules.Verify
+	case phaseChurn:
+		sc = p.PhaseSchedules.Churn
+	case phasePrune:
+		sc = p.PhaseSchedules.Prune
+	}
+	if !sc.isZero() && sc.Cron == "" && sc.Interval == 0 {
+		sc.Interval = p.IntegrityCheckInterval
+	}
+	return
+}
+
+// hasOwnSchedule returns whether the phase runs on its own schedule rather
+// than in every cycle.
+func (p *profile) hasOwnSchedule(phase string) bool {
+	return !p.phaseSchedule(phase).isZero()
+}
+
+// nextPhaseRun returns when the phase with its own schedule runs next, it
+// returns the zero time if it never runs again.
+func (p *profile) nextPhaseRun(phase string, now time.Time) time.Time {
+	sc := p.phaseSchedule(phase)
+	last, jitter, err := store.lastPhaseRun(p.Name, phase)
+	if err != nil {
+		p.logger.Warnf("failed to fetch the last run of phase '%s', running it, err: %v", phase, err)
+		return now
+	}
+	if jitter > sc.Jitter {
+		jitter = sc.Jitter
+	}
+	return sc.next(last, now, jitter, true)
+}
+
+// phaseDue returns whether the phase should run now, which is the case if it
+// has no schedule of its own or its next run is due and within its windows.
+func (p *profile) phaseDue(phase string, now time.Time) bool {
+	sc := p.phaseSchedule(phase)
+	if sc.isZero() {
+		return true
+	} else if !sc.inWindow(now) {
+		return false
+	}
+	next := p.nextPhaseRun(phase, now)
+	return !next.IsZero() && !next.After(now)
+}
+
+// phaseRan records that the phase completed a run that started at the given
+// time, along with the jitter of its next run.
+func (p *profile) phaseRan(phase string, start time.Time) {
+	if err := store.recordPhaseRun(p.Name, phase, start, p.phaseSchedule(phase).randomJitter()); err != nil {
+		p.logger.Warnf("failed to record the run of phase '%s', err: %v", phase, err)
+	}
+}
+
+// lastPhaseRun returns when the profile's phase last started a completed run
+// and the jitter of its next run, it returns the zero time if it never ran.
+func (st *stateStore) lastPhaseRun(profile, phase string) (time.Time, time.Duration, error) {
+	var ranAt, jitter int64
+	err := st.db.QueryRow(`SELECT ran_at, jitter FROM phase_runs WHERE profile = ? AND phase = ?`, profile, phase).Scan(&ranAt, &jitter)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && ranAt == 0) {
+		return time.Time{}, 0, nil
+	} else if err != nil {
+		return time.Time{}, 0, err
+	}
+	return time.Unix(0, ranAt), time.Duration(jitter), nil
+}
+
+// recordPhaseRun records the start of the profile's phase's last completed
+// run, which resets its failures.
+func (st *stateStore) recordPhaseRun(profile, phase string, start time.Time, jitter time.Duration) error {
+	_, err := st.db.Exec(`INSERT INTO phase_runs (profile, phase, ran_at, jitter, attempted_at) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (profile, phase) DO UPDATE SET ran_at = excluded.ran_at, jitter = excluded.jitter, attempted_at = excluded.attempted_at, error = NULL, failures = 0`, profile, phase, start.UnixNano(), int64(jitter), start.UnixNano())
+	return err
+}
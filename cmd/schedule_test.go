@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	bits := func(values ...int) (b uint64) {
+		for _, v := range values {
+			b |= 1 << v
+		}
+		return
+	}
+	span := func(lo, hi int) (b uint64) {
+		for v := lo; v <= hi; v++ {
+			b |= 1 << v
+		}
+		return
+	}
+
+	tests := []struct {
+		expr string
+		want cronSchedule
+		err  string
+	}{
+		{
+			expr: "*/15 * * * *",
+			want: cronSchedule{minute: bits(0, 15, 30, 45), hour: span(0, 23), dom: span(1, 31), month: span(1, 12), dow: span(0, 7), domStar: true, dowStar: true},
+		},
+		{
+			expr: "@daily",
+			want: cronSchedule{minute: bits(0), hour: bits(0), dom: span(1, 31), month: span(1, 12), dow: span(0, 7), domStar: true, dowStar: true},
+		},
+		{
+			expr: "5,10-12 22-23,0-5/2 1 */6 1-5",
+			want: cronSchedule{minute: bits(5, 10, 11, 12), hour: bits(22, 23, 0, 2, 4), dom: bits(1), month: bits(1, 7), dow: span(1, 5)},
+		},
+		{
+			expr: "0 0 * * 7",
+			want: cronSchedule{minute: bits(0), hour: bits(0), dom: span(1, 31), month: span(1, 12), dow: bits(0, 7), domStar: true},
+		},
+		{expr: "* * * *", err: "expected 5 fields, got 4"},
+		{expr: "60 * * * *", err: "minute: '60' is out of range 0-59"},
+		{expr: "* 24 * * *", err: "hour: '24' is out of range 0-23"},
+		{expr: "* * 0 * *", err: "day of month: '0' is out of range 1-31"},
+		{expr: "* * * 13 *", err: "month: '13' is out of range 1-12"},
+		{expr: "* * * * 8", err: "day of week: '8' is out of range 0-7"},
+		{expr: "*/0 * * * *", err: "minute: invalid step '0'"},
+		{expr: "5-1 * * * *", err: "minute: '5-1' is out of range 0-59"},
+		{expr: "a * * * *", err: "minute: invalid value 'a'"},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			c, err := parseCron(test.expr)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if c != test.want {
+				t.Fatalf("expected %+v, got %+v", test.want, c)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// Monday
+	after := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	date := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", date(1, 1, 10, 45)},
+		{"30 10 * * *", date(1, 2, 10, 30)},
+		{"@daily", date(1, 2, 0, 0)},
+		{"0 9 * * 1-5", date(1, 2, 9, 0)},
+		{"0 0 1 * *", date(2, 1, 0, 0)},
+		{"0 0 13 * 5", date(1, 5, 0, 0)},
+		{"0 12 * * 0", date(1, 7, 12, 0)},
+		{"0 12 * * 7", date(1, 7, 12, 0)},
+		{"0 0 29 2 *", date(2, 29, 0, 0)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			c, err := parseCron(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			} else if got := c.next(after); !got.Equal(test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		window    string
+		t         time.Time
+		contains  bool
+		nextStart time.Time
+	}{
+		{"09:00-17:00", at(1, 9, 0), true, at(2, 9, 0)},
+		{"09:00-17:00", at(1, 16, 59), true, at(2, 9, 0)},
+		{"09:00-17:00", at(1, 17, 0), false, at(2, 9, 0)},
+		{"09:00-17:00", at(1, 8, 0), false, at(1, 9, 0)},
+		{"22:00-06:00", at(1, 23, 0), true, at(2, 22, 0)},
+		{"22:00-06:00", at(1, 5, 59), true, at(1, 22, 0)},
+		{"22:00-06:00", at(1, 6, 0), false, at(1, 22, 0)},
+		{"22:00-06:00", at(1, 12, 0), false, at(1, 22, 0)},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s at %s", test.window, test.t.Format("15:04")), func(t *testing.T) {
+			w, err := parseTimeWindow(test.window)
+			if err != nil {
+				t.Fatal(err)
+			} else if got := w.contains(test.t); got != test.contains {
+				t.Fatalf("expected contains to be %v", test.contains)
+			} else if got := w.nextStart(test.t); !got.Equal(test.nextStart) {
+				t.Fatalf("expected next start %v, got %v", test.nextStart, got)
+			}
+		})
+	}
+
+	for _, s := range []string{"10:00", "25:00-01:00", "10:00-10:00"} {
+		if _, err := parseTimeWindow(s); err == nil {
+			t.Fatalf("expected window '%s' to be invalid", s)
+		}
+	}
+}
+
+func TestScheduleConfigNext(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name    string
+		sc      scheduleConfig
+		last    time.Time
+		jitter  time.Duration
+		catchUp bool
+		want    time.Time
+	}{
+		{
+			name: "never ran",
+			sc:   scheduleConfig{Interval: time.Hour},
+			want: now,
+		},
+		{
+			name: "interval",
+			sc:   scheduleConfig{Interval: time.Hour},
+			last: at(1, 10, 0),
+			want: at(1, 11, 0),
+		},
+		{
+			name: "overdue interval",
+			sc:   scheduleConfig{Interval: time.Hour},
+			last: at(1, 8, 0),
+			want: now,
+		},
+		{
+			name:   "jitter",
+			sc:     scheduleConfig{Interval: time.Hour, Jitter: 10 * time.Minute},
+			last:   at(1, 10, 0),
+			jitter: 5 * time.Minute,
+			want:   at(1, 11, 5),
+		},
+		{
+			name: "cron never ran",
+			sc:   scheduleConfig{Cron: "0 * * * *"},
+			want: at(1, 11, 0),
+		},
+		{
+			name: "cron skips missed slots",
+			sc:   scheduleConfig{Cron: "0 * * * *"},
+			last: at(1, 7, 10),
+			want: at(1, 11, 0),
+		},
+		{
+			name:    "cron catches up",
+			sc:      scheduleConfig{Cron: "0 * * * *"},
+			last:    at(1, 7, 10),
+			catchUp: true,
+			want:    now,
+		},
+		{
+			name:    "cron in now's location",
+			sc:      scheduleConfig{Cron: "0 11 * * *"},
+			last:    time.Date(2023, 12, 31, 11, 0, 0, 0, time.UTC).In(time.FixedZone("UTC+2", 2*60*60)),
+			catchUp: true,
+			want:    at(1, 11, 0),
+		},
+		{
+			name: "cron never matches",
+			sc:   scheduleConfig{Cron: "0 0 30 2 *"},
+			last: at(1, 10, 0),
+			want: time.Time{},
+		},
+		{
+			name: "window",
+			sc:   scheduleConfig{Interval: time.Hour, Windows: []string{"22:00-06:00"}},
+			last: at(1, 10, 0),
+			want: at(1, 22, 0),
+		},
+		{
+			name: "earliest window",
+			sc:   scheduleConfig{Interval: time.Hour, Windows: []string{"22:00-06:00", "12:00-13:00"}},
+			last: at(1, 10, 0),
+			want: at(1, 12, 0),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.sc.next(test.last, now, test.jitter, test.catchUp); !got.Equal(test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestScheduleConfigValidate(t *testing.T) {
+	tests := []struct {
+		sc   scheduleConfig
+		want []string
+	}{
+		{sc: scheduleConfig{Cron: "0 * * * *", Windows: []string{"22:00-06:00"}}},
+		{sc: scheduleConfig{Cron: "0 0 30 2 *"}, want: []string{"schedule.cron: '0 0 30 2 *' never matches"}},
+		{sc: scheduleConfig{Cron: "0 * * * *", Interval: time.Hour}, want: []string{"schedule: cron and interval are mutually exclusive"}},
+		{sc: scheduleConfig{Interval: -time.Hour, Jitter: -time.Minute}, want: []string{"schedule.interval: must not be negative, got -1h0m0s", "schedule.jitter: must not be negative, got -1m0s"}},
+		{sc: scheduleConfig{Windows: []string{"10:00"}}, want: []string{"schedule.windows[0]: expected 'HH:MM-HH:MM', got '10:00'"}},
+	}
+	for _, test := range tests {
+		var problems []string
+		test.sc.validate("schedule", func(format string, args ...any) {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		})
+		if strings.Join(problems, "\n") != strings.Join(test.want, "\n") {
+			t.Fatalf("expected problems %q, got %q", test.want, problems)
+		}
+	}
+}
+
+func TestPhaseInCycle(t *testing.T) {
+	p := &profile{profileConfig: cfg.profileConfig}
+	p.IntegrityCheckInterval = 2 * time.Hour
+	p.PhaseSchedules.Verify = scheduleConfig{Jitter: time.Minute}
+	p.PhaseSchedules.Churn = scheduleConfig{Interval: time.Hour}
+
+	// a schedule without cron or interval runs at the check interval
+	if sc := p.phaseSchedule(phaseVerify); sc.Interval != 2*time.Hour {
+		t.Fatalf("expected the check interval, got %v", sc.Interval)
+	} else if sc := p.phaseSchedule(phaseChurn); sc.Interval != time.Hour {
+		t.Fatalf("expected the phase's interval, got %v", sc.Interval)
+	} else if !p.phaseSchedule(phaseFill).isZero() {
+		t.Fatal("expected no schedule for fill")
+	}
+
+	// the cycle of the once command runs every phase
+	for _, phase := range schedulablePhases {
+		if !p.inCycle(phase) {
+			t.Fatalf("expected phase '%s' to be in the cycle", phase)
+		}
+	}
+
+	// the regular cycle leaves out phases with their own schedule
+	p.detached = true
+	for phase, want := range map[string]bool{phaseFill: true, phaseVerify: false, phaseChurn: false, phasePrune: true} {
+		if p.inCycle(phase) != want {
+			t.Fatalf("expected phase '%s' in the regular cycle to be %v", phase, want)
+		}
+	}
+
+	// the cycle of a phase only runs that phase
+	q := p.fork(phaseVerify)
+	for _, phase := range schedulablePhases {
+		if q.inCycle(phase) != (phase == phaseVerify) {
+			t.Fatalf("unexpected phase '%s' in the cycle of phase '%s'", phase, phaseVerify)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+
+	"lukechampine.com/frand"
+)
+
+const (
+	distributionUniform    = "uniform"
+	distributionLogUniform = "logUniform"
+	distributionLogNormal  = "logNormal"
+	distributionPareto     = "pareto"
+	distributionHistogram  = "histogram"
+)
+
+var distributions = []string{
+	distributionUniform,
+	distributionLogUniform,
+	distributionLogNormal,
+	distributionPareto,
+	distributionHistogram,
+}
+
+// randomFileSize returns a random file size between the profile's min file
+// size and max, following the configured distribution. Part of the sizes is
+// moved to the nearest slab boundary if configured.
+func (p *profile) randomFileSize(max int64) int64 {
+	min := p.MinFilesize
+	if max <= min {
+		return max
+	}
+
+	if p.SlabBoundaryPct > 0 && frand.Float64()*100 < p.SlabBoundaryPct {
+		if size, ok := slabBoundarySize(int64(p.rs.SlabSizeNoRedundancy()), min, max); ok {
+			return size
+		}
+	}
+
+	d := p.FileSizeDistribution
+	var size float64
+	switch d.Type {
+	case distributionLogUniform:
+		lmin, lmax := math.Log(float64(min)), math.Log(float64(max))
+		size = math.Exp(lmin + frand.Float64()*(lmax-lmin))
+	case distributionLogNormal:
+		size = math.Exp(math.Log(float64(d.Median)) + d.Sigma*normFloat64())
+	case distributionPareto:
+		size = float64(min) / math.Pow(1-frand.Float64(), 1/d.Alpha)
+	case distributionHistogram:
+		b := d.pickBucket()
+		bmin, bmax := b.Min, b.Max
+		if bmax > bmin {
+			bmin += int64(frand.Intn(int(bmax - bmin)))
+		}
+		size = float64(bmin)
+	default:
+		size = float64(int64(frand.Intn(int(max-min))) + min)
+	}
+	return clamp(int64(size), min, max)
+}
+
+// pickBucket picks a random histogram bucket, weighted by the buckets' weights.
+func (d sizeDistributionConfig) pickBucket() sizeBucketConfig {
+	var total float64
+	for _, b := range d.Histogram {
+		total += b.Weight
+	}
+	r := frand.Float64() * total
+	for _, b := range d.Histogram {
+		if r < b.Weight {
+			return b
+		}
+		r -= b.Weight
+	}
+	return d.Histogram[len(d.Histogram)-1]
+}
+
+// validate checks the distribution's parameters.
+func (d sizeDistributionConfig) validate(addProblem func(format string, args ...any)) {
+	switch d.Type {
+	case distributionUniform, distributionLogUniform:
+	case distributionLogNormal:
+		if d.Median <= 0 {
+			addProblem("fileSizeDistribution.median: must be positive, got %d", d.Median)
+		}
+		if d.Sigma <= 0 {
+			addProblem("fileSizeDistribution.sigma: must be positive, got %v", d.Sigma)
+		}
+	case distributionPareto:
+		if d.Alpha <= 0 {
+			addProblem("fileSizeDistribution.alpha: must be positive, got %v", d.Alpha)
+		}
+	case distributionHistogram:
+		if len(d.Histogram) == 0 {
+			addProblem("fileSizeDistribution.histogram: must not be empty")
+		}
+		var total float64
+		for i, b := range d.Histogram {
+			if b.Min <= 0 || b.Min > b.Max {
+				addProblem("fileSizeDistribution.histogram[%d]: min must be positive and not exceed max, got %d > %d", i, b.Min, b.Max)
+			}
+			if b.Weight < 0 {
+				addProblem("fileSizeDistribution.histogram[%d].weight: must not be negative, got %v", i, b.Weight)
+			}
+			total += b.Weight
+		}
+		if len(d.Histogram) > 0 && total <= 0 {
+			addProblem("fileSizeDistribution.histogram: weights must add up to a positive number")
+		}
+	default:
+		addProblem("fileSizeDistribution.type: must be one of %v, got '%s'", distributions, d.Type)
+	}
+}
+
+// slabBoundarySize returns a random multiple of the slab size between min and
+// max, or one byte below or above it.
+func slabBoundarySize(slabSize, min, max int64) (int64, bool) {
+	if slabSize <= 0 {
+		return 0, false
+	}
+
+	// find the range of multiples whose boundary sizes fit
+	lo := (min + 1 + slabSize - 1) / slabSize
+	hi := (max - 1) / slabSize
+	if lo < 1 {
+		lo = 1
+	}
+	if lo > hi {
+		return 0, false
+	}
+
+	n := lo + int64(frand.Intn(int(hi-lo+1)))
+	return n*slabSize + int64(frand.Intn(3)) - 1, true
+}
+
+// normFloat64 returns a standard normally distributed number using the
+// Box-Muller transform.
+func normFloat64() float64 {
+	u1 := 1 - frand.Float64() // avoid log(0)
+	u2 := frand.Float64()
+	return math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+}
+
+func clamp(n, min, max int64) int64 {
+	if n < min {
+		return min
+	} else if n > max {
+		return max
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSlabBoundarySize(t *testing.T) {
+	const slabSize = 40 << 20 // 10-of-30 with 4 MiB sectors
+
+	tests := []struct {
+		name     string
+		slabSize int64
+		min, max int64
+		ok       bool
+	}{
+		{"no slab size", 0, 0, 1 << 30, false},
+		{"below first boundary", slabSize, 1 << 20, slabSize, false},
+		{"single boundary", slabSize, 1 << 20, slabSize + 1, true},
+		{"many boundaries", slabSize, 1 << 20, 10 * slabSize, true},
+		{"above min", slabSize, slabSize, 3 * slabSize, true},
+		{"between boundaries", slabSize, slabSize + 1, 2*slabSize - 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				size, ok := slabBoundarySize(test.slabSize, test.min, test.max)
+				if ok != test.ok {
+					t.Fatalf("expected ok to be %v, got %v", test.ok, ok)
+				} else if !ok {
+					return
+				}
+
+				// the size must be within one byte of a slab boundary and
+				// within the bounds
+				if size < test.min || size > test.max {
+					t.Fatalf("size %d is outside [%d, %d]", size, test.min, test.max)
+				}
+				if off := (size + 1) % test.slabSize; off > 2 {
+					t.Fatalf("size %d is not within one byte of a slab boundary", size)
+				}
+			}
+		})
+	}
+}
+
+func TestRandomFileSize(t *testing.T) {
+	const min, max = 1 << 10, 1 << 20
+
+	tests := []struct {
+		name string
+		dist sizeDistributionConfig
+	}{
+		{"uniform", sizeDistributionConfig{Type: distributionUniform}},
+		{"logUniform", sizeDistributionConfig{Type: distributionLogUniform}},
+		{"logNormal", sizeDistributionConfig{Type: distributionLogNormal, Median: 1 << 16, Sigma: 2}},
+		{"pareto", sizeDistributionConfig{Type: distributionPareto, Alpha: 1.1}},
+		{"histogram", sizeDistributionConfig{Type: distributionHistogram, Histogram: []sizeBucketConfig{
+			{Min: 1 << 12, Max: 1 << 13, Weight: 1},
+			{Min: 1 << 18, Max: 1 << 18, Weight: 3},
+		}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &profile{}
+			p.MinFilesize = min
+			p.FileSizeDistribution = test.dist
+			for i := 0; i < 1000; i++ {
+				size := p.randomFileSize(max)
+				if size < min || size > max {
+					t.Fatalf("size %d is outside [%d, %d]", size, min, max)
+				}
+				if test.dist.Type == distributionHistogram && !(size >= 1<<12 && size <= 1<<13) && size != 1<<18 {
+					t.Fatalf("size %d is outside the histogram's buckets", size)
+				}
+			}
+		})
+	}
+
+	// the max is returned if it doesn't exceed the min
+	p := &profile{}
+	p.MinFilesize = min
+	if size := p.randomFileSize(min / 2); size != min/2 {
+		t.Fatalf("expected %d, got %d", min/2, size)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+)
+
+type (
+	// contractSnapshot captures the bus's active contracts at the end of a
+	// cycle. Renterd doesn't track download and storage spending separately,
+	// storage is paid for as part of uploads and downloads are paid for from
+	// accounts, which are funded through fund account spending.
+	contractSnapshot struct {
+		Version       string                  `json:"version"`
+		Contracts     int                     `json:"contracts"`
+		TotalSize     uint64                  `json:"totalSize"`
+		TotalPrunable uint64                  `json:"totalPrunable"`
+		Spending      spendingSnapshot        `json:"spending"`
+		PerContract   []contractSnapshotEntry `json:"perContract,omitempty"`
+
+		// Delta is the difference with the previous cycle's snapshot, sizes
+		// are only compared for contracts that are in both snapshots while
+		// the spending includes the full spending of added contracts, e.g.
+		// renewals, which start with no spending
+		Delta *snapshotDelta `json:"delta,omitempty"`
+	}
+
+	contractSnapshotEntry struct {
+		ID       types.FileContractID `json:"id"`
+		HostKey  types.PublicKey      `json:"hostKey"`
+		Size     uint64               `json:"size"`
+		Prunable uint64               `json:"prunable"`
+		Spending spendingSnapshot     `json:"spending"`
+	}
+
+	spendingSnapshot struct {
+		Uploads     types.Currency `json:"uploads"`
+		FundAccount types.Currency `json:"fundAccount"`
+		Deletions   types.Currency `json:"deletions"`
+		SectorRoots types.Currency `json:"sectorRoots"`
+		Total       types.Currency `json:"total"`
+	}
+
+	snapshotDelta struct {
+		Added    int              `json:"added"`
+		Removed  int              `json:"removed"`
+		Size     int64            `json:"size"`
+		Prunable int64            `json:"prunable"`
+		Spending spendingSnapshot `json:"spending"`
+	}
+)
+
+// takeContractSnapshot snapshots the bus's active contracts and compares them
+// to the previous snapshot if there is one.
+func takeContractSnapshot(prev *contractSnapshot) (*contractSnapshot, error) {
+	var contracts []api.ContractMetadata
+	var prunable api.ContractsPrunableDataResponse
+	var bs api.BusStateResponse
+	if err := withSaneTimeout(func(ctx context.Context) (err error) {
+		contracts, err = bc.Contracts(ctx, api.ContractsOpts{FilterMode: api.ContractFilterModeActive})
+		if err != nil {
+			return fmt.Errorf("failed to fetch contracts; %w", err)
+		}
+		prunable, err = bc.PrunableData(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch prunable data; %w", err)
+		}
+		bs, err = bc.State()
+		if err != nil {
+			return fmt.Errorf("failed to fetch bus state; %w", err)
+		}
+		return nil
+	}, nil); err != nil {
+		return nil, err
+	}
+
+	prunableByID := make(map[types.FileContractID]uint64)
+	for _, c := range prunable.Contracts {
+		prunableByID[c.ID] = c.Prunable
+	}
+
+	s := &contractSnapshot{
+		Version:   bs.Version,
+		Contracts: len(contracts),
+	}
+	for _, c := range contracts {
+		e := contractSnapshotEntry{
+			ID:       c.ID,
+			HostKey:  c.HostKey,
+			Size:     c.Size,
+			Prunable: prunableByID[c.ID],
+			Spending: newSpendingSnapshot(c.Spending),
+		}
+		s.TotalSize += e.Size
+		s.TotalPrunable += e.Prunable
+		s.Spending = s.Spending.add(e.Spending)
+		s.PerContract = append(s.PerContract, e)
+	}
+
+	if prev != nil {
+		s.Delta = s.diff(prev)
+	}
+	return s, nil
+}
+
+// diff returns the difference between the snapshot and the given previous
+// one.
+func (s *contractSnapshot) diff(prev *contractSnapshot) *snapshotDelta {
+	prevByID := make(map[types.FileContractID]contractSnapshotEntry)
+	for _, e := range prev.PerContract {
+		prevByID[e.ID] = e
+	}
+
+	d := &snapshotDelta{}
+	seen := make(map[types.FileContractID]bool)
+	for _, e := range s.PerContract {
+		seen[e.ID] = true
+		p, ok := prevByID[e.ID]
+		if !ok {
+			d.Added++
+			d.Spending = d.Spending.add(e.Spending)
+			continue
+		}
+		d.Size += int64(e.Size) - int64(p.Size)
+		d.Prunable += int64(e.Prunable) - int64(p.Prunable)
+		d.Spending = d.Spending.add(e.Spending.sub(p.Spending))
+	}
+	for id := range prevByID {
+		if !seen[id] {
+			d.Removed++
+		}
+	}
+	return d
+}
+
+func newSpendingSnapshot(cs api.ContractSpending) spendingSnapshot {
+	s := spendingSnapshot{
+		Uploads:     cs.Uploads,
+		FundAccount: cs.FundAccount,
+		Deletions:   cs.Deletions,
+		SectorRoots: cs.SectorRoots,
+	}
+	s.Total = s.Uploads.Add(s.FundAccount).Add(s.Deletions).Add(s.SectorRoots)
+	return s
+}
+
+func (s spendingSnapshot) add(o spendingSnapshot) spendingSnapshot {
+	return spendingSnapshot{
+		Uploads:     s.Uploads.Add(o.Uploads),
+		FundAccount: s.FundAccount.Add(o.FundAccount),
+		Deletions:   s.Deletions.Add(o.Deletions),
+		SectorRoots: s.SectorRoots.Add(o.SectorRoots),
+		Total:       s.Total.Add(o.Total),
+	}
+}
+
+// sub returns the spending since o, spending never decreases for the same
+// contract so negative differences are treated as zero.
+func (s spendingSnapshot) sub(o spendingSnapshot) spendingSnapshot {
+	sub := func(a, b types.Currency) types.Currency {
+		if a.Cmp(b) < 0 {
+			return types.ZeroCurrency
+		}
+		return a.Sub(b)
+	}
+	return spendingSnapshot{
+		Uploads:     sub(s.Uploads, o.Uploads),
+		FundAccount: sub(s.FundAccount, o.FundAccount),
+		Deletions:   sub(s.Deletions, o.Deletions),
+		SectorRoots: sub(s.SectorRoots, o.SectorRoots),
+		Total:       sub(s.Total, o.Total),
+	}
+}
+
+// lastContractSnapshot returns the most recent contract snapshot in the
+// state.
+func (s *state) lastContractSnapshot() *contractSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, res := range s.Results {
+		if res.ContractSnapshot != nil {
+			return res.ContractSnapshot
+		}
+	}
+	return nil
+}
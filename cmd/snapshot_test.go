@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"go.sia.tech/core/types"
+)
+
+func TestSpendingSnapshotSub(t *testing.T) {
+	sc := types.Siacoins
+
+	tests := []struct {
+		name string
+		s, o spendingSnapshot
+		want spendingSnapshot
+	}{
+		{
+			name: "zero",
+		},
+		{
+			name: "increase",
+			s:    spendingSnapshot{Uploads: sc(5), FundAccount: sc(3), Deletions: sc(2), SectorRoots: sc(1), Total: sc(11)},
+			o:    spendingSnapshot{Uploads: sc(2), FundAccount: sc(1), Deletions: sc(2), SectorRoots: sc(0), Total: sc(5)},
+			want: spendingSnapshot{Uploads: sc(3), FundAccount: sc(2), Deletions: sc(0), SectorRoots: sc(1), Total: sc(6)},
+		},
+		{
+			name: "decrease is clamped",
+			s:    spendingSnapshot{Uploads: sc(1), FundAccount: sc(4), Total: sc(5)},
+			o:    spendingSnapshot{Uploads: sc(2), FundAccount: sc(1), Total: sc(3)},
+			want: spendingSnapshot{Uploads: sc(0), FundAccount: sc(3), Total: sc(2)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.s.sub(test.o); got != test.want {
+				t.Fatalf("expected %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestContractSnapshotDiff(t *testing.T) {
+	sc := types.Siacoins
+	id := func(b byte) types.FileContractID { return types.FileContractID{b} }
+	spending := func(uploads, fundAccount uint32) spendingSnapshot {
+		return spendingSnapshot{Uploads: sc(uploads), FundAccount: sc(fundAccount), Total: sc(uploads + fundAccount)}
+	}
+
+	prev := &contractSnapshot{PerContract: []contractSnapshotEntry{
+		{ID: id(1), Size: 100, Prunable: 10, Spending: spending(1, 1)},
+		{ID: id(2), Size: 200, Prunable: 20, Spending: spending(2, 0)},
+		{ID: id(3), Size: 300, Spending: spending(3, 3)},
+	}}
+	curr := &contractSnapshot{PerContract: []contractSnapshotEntry{
+		{ID: id(1), Size: 150, Prunable: 0, Spending: spending(4, 1)},
+		{ID: id(2), Size: 200, Prunable: 30, Spending: spending(2, 5)},
+		{ID: id(4), Size: 50, Spending: spending(2, 1)},
+	}}
+
+	d := curr.diff(prev)
+	if d.Added != 1 || d.Removed != 1 {
+		t.Fatalf("expected 1 added and 1 removed contract, got %d and %d", d.Added, d.Removed)
+	} else if d.Size != 50 {
+		t.Fatalf("expected size delta 50, got %d", d.Size)
+	} else if d.Prunable != 0 {
+		t.Fatalf("expected prunable delta 0, got %d", d.Prunable)
+	} else if want := spending(5, 6); d.Spending != want {
+		t.Fatalf("expected spending %+v, got %+v", want, d.Spending)
+	}
+}
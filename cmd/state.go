@@ -3,20 +3,26 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
-	"math"
-	"os"
+	"sync"
 	"time"
 )
 
 type (
 	state struct {
-		Ok      bool     `json:"ok"`
-		Results []result `json:"results"`
+		Ok      bool           `json:"ok"`
+		Results []result       `json:"results"`
+		Hosts   hostScoreboard `json:"hosts,omitempty"`
+		Phases  phaseStates    `json:"phases,omitempty"`
+
+		// mu guards the results, the cycles of phases with their own
+		// schedule store their results concurrently
+		mu sync.Mutex
 	}
 
 	result struct {
+		// Phase is set for the cycles of a phase with its own schedule
+		Phase string `json:"phase,omitempty"`
+
 		StartedAt time.Time `json:"startedAt"`
 		EndedAt   time.Time `json:"endedAt"`
 
@@ -24,12 +30,31 @@ type (
 		Uploaded   string `json:"uploaded,omitempty"`
 		Removed    string `json:"removed,omitempty"`
 		Prunable   string `json:"prunable,omitempty"`
+		Churned    int    `json:"churned,omitempty"`
+
+		PrunableBefore  string           `json:"prunableBefore,omitempty"`
+		Pruned          string           `json:"pruned,omitempty"`
+		PruneDuration   string           `json:"pruneDuration,omitempty"`
+		PrunedContracts []prunedContract `json:"prunedContracts,omitempty"`
 
 		DownloadSpeedMBPS float64 `json:"downloadSpeedMBPS,omitempty"`
 		UploadSpeedMBPS   float64 `json:"uploadSpeedMBPS,omitempty"`
 
-		DatasetComplete bool       `json:"datasetComplete"`
-		Err             *resultErr `json:"error,omitempty"`
+		PackedUploaded  int    `json:"packedUploaded,omitempty"`
+		PackedFlushed   int    `json:"packedFlushed,omitempty"`
+		PackedUnflushed int    `json:"packedUnflushed,omitempty"`
+		MaxUnflushed    string `json:"maxUnflushed,omitempty"`
+
+		ContractSnapshot *contractSnapshot `json:"contractSnapshot,omitempty"`
+		Cost             *cycleCost        `json:"cost,omitempty"`
+
+		DatasetComplete bool          `json:"datasetComplete"`
+		Coverage        *coverage     `json:"coverage,omitempty"`
+		Phases          []phaseResult `json:"phases,omitempty"`
+		SkippedPhases   []string      `json:"skippedPhases,omitempty"`
+		Resumed         bool          `json:"resumed,omitempty"`
+		Interrupted     bool          `json:"interrupted,omitempty"`
+		Err             *resultErr    `json:"error,omitempty"`
 	}
 
 	resultErr struct {
@@ -37,61 +62,13 @@ type (
 	}
 )
 
-func (s *state) timeSinceLastIntegrityCheck() time.Duration {
-	if len(s.Results) == 0 || !s.Results[0].DatasetComplete {
-		return math.MaxInt64
-	}
-	return time.Since(s.Results[0].StartedAt)
-}
-
-func saveState(s *state, path string) error {
-	// open the file
-	f, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("failed to open state file at '%s', err: %v", path, err)
-	}
-	defer f.Close()
-
-	// trim the results
-	if len(s.Results) > 30 {
-		s.Results = s.Results[:30]
-	}
-
-	// update overall OK status
+// updateOk updates the overall OK status, which is only true if none of the
+// recent results failed.
+func (s *state) updateOk() {
 	s.Ok = true
 	for _, res := range s.Results {
 		s.Ok = s.Ok && res.Err == nil
 	}
-
-	// encode the state
-	enc := json.NewEncoder(f)
-	if err := enc.Encode(s); err != nil {
-		return err
-	}
-	return nil
-}
-
-func loadState(path string) (s *state, _ error) {
-	// check whether the state file exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return &state{}, nil
-	}
-
-	// open the file
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open state file at '%s', err: %v", path, err)
-	}
-	defer f.Close()
-
-	// decode the state
-	dec := json.NewDecoder(f)
-	if err := dec.Decode(&s); err != nil && errors.Is(err, io.EOF) {
-		return &state{}, nil
-	} else if err != nil {
-		return nil, err
-	}
-	return
 }
 
 func (r result) Error() error {
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// recentResults is the number of results kept in memory, older results are
+// only kept in the database.
+const recentResults = 30
+
+// migrations are applied in order to bring the database schema up to date,
+// the schema version is the number of migrations that were applied.
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE results (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	profile TEXT NOT NULL,
+	started_at INTEGER NOT NULL,
+	ended_at INTEGER NOT NULL,
+	error TEXT,
+	data TEXT NOT NULL
+);
+CREATE INDEX results_profile_started_at ON results(profile, started_at);
+
+CREATE TABLE hosts (
+	profile TEXT NOT NULL,
+	host_key TEXT NOT NULL,
+	data TEXT NOT NULL,
+	PRIMARY KEY (profile, host_key)
+);
+
+CREATE TABLE imports (
+	path TEXT PRIMARY KEY,
+	profile TEXT NOT NULL,
+	imported_at INTEGER NOT NULL
+);`,
+
+	// 2: running cycles
+	`CREATE TABLE cycles (
+	profile TEXT PRIMARY KEY,
+	started_at INTEGER NOT NULL
+);`,
+
+	// 3: plans of running cycles
+	`CREATE TABLE cycle_tasks (
+	profile TEXT NOT NULL,
+	phase TEXT NOT NULL,
+	idx INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	done INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (profile, phase, idx)
+);`,
+
+	// 4: last runs of scheduled phases
+	`CREATE TABLE phase_runs (
+	profile TEXT NOT NULL,
+	phase TEXT NOT NULL,
+	ran_at INTEGER NOT NULL,
+	jitter INTEGER NOT NULL,
+	PRIMARY KEY (profile, phase)
+);`,
+
+	// 5: state of phases
+	`ALTER TABLE phase_runs ADD COLUMN attempted_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE phase_runs ADD COLUMN error TEXT;
+ALTER TABLE phase_runs ADD COLUMN failures INTEGER NOT NULL DEFAULT 0;`,
+
+	// 6: last verification of every object
+	`CREATE TABLE verifications (
+	profile TEXT NOT NULL,
+	key TEXT NOT NULL,
+	verified_at INTEGER NOT NULL,
+	PRIMARY KEY (profile, key)
+);`,
+
+	// 7: phases with their own schedule are planned separately from the
+	// cycle, their results are marked with the phase
+	`CREATE TABLE cycles_new (
+	profile TEXT NOT NULL,
+	run TEXT NOT NULL,
+	started_at INTEGER NOT NULL,
+	PRIMARY KEY (profile, run)
+);
+INSERT INTO cycles_new (profile, run, started_at) SELECT profile, '', started_at FROM cycles;
+DROP TABLE cycles;
+ALTER TABLE cycles_new RENAME TO cycles;
+
+CREATE TABLE cycle_tasks_new (
+	profile TEXT NOT NULL,
+	run TEXT NOT NULL,
+	phase TEXT NOT NULL,
+	idx INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	done INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (profile, run, phase, idx)
+);
+INSERT INTO cycle_tasks_new (profile, run, phase, idx, key, size, done) SELECT profile, '', phase, idx, key, size, done FROM cycle_tasks;
+DROP TABLE cycle_tasks;
+ALTER TABLE cycle_tasks_new RENAME TO cycle_tasks;
+
+ALTER TABLE results ADD COLUMN phase TEXT NOT NULL DEFAULT '';`,
+}
+
+// store is the state database, it's opened by the commands that use it.
+var store *stateStore
+
+// stateStore persists the state of every profile in a SQLite database, all
+// writes are transactional.
+type stateStore struct {
+	db   *sql.DB
+	path string
+
+	// recovered is set if the database was corrupt and restored from its
+	// backup
+	recovered bool
+
+	backupMu   sync.Mutex // serializes backups, they share a temporary file
+	lastBackup time.Time
+}
+
+// openStateStore opens the database at the given path, migrates its schema and
+// imports the JSON state files of the configured profiles. A corrupt database
+// is restored from its backup. The path of a JSON state file is replaced by
+// the path of the database next to it, into which the file is imported.
+func openStateStore(path string) (*stateStore, error) {
+	path = databasePath(path)
+	st, err := openDatabase(path)
+	if err != nil && isCorrupt(err) {
+		if rErr := recoverState(path); rErr != nil {
+			return nil, fmt.Errorf("state database at '%s' is corrupt and could not be recovered, err: %v; %w", path, rErr, err)
+		}
+		st, err = openDatabase(path)
+		if st != nil {
+			st.recovered = true
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range cfg.resolveProfiles() {
+		if err := st.importJSON(p.Name, legacyStatePath(path, p.Name)); err != nil {
+			st.Close()
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+func openDatabase(path string) (*stateStore, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)", path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database at '%s', err: %v", path, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	st := &stateStore{db: db, path: path}
+	if err := st.checkIntegrity(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to check state database at '%s'; %w", path, err)
+	}
+	if err := st.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate state database at '%s'; %w", path, err)
+	}
+	return st, nil
+}
+
+// initStateStore opens the state database at the state path, the returned
+// function closes it.
+func initStateStore() (func(), error) {
+	st, err := openStateStore(statePath)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []string
+	if st.path != statePath {
+		msgs = append(msgs, fmt.Sprintf("state file at '%s' is a JSON state file, the state is kept in '%s'", statePath, st.path))
+	}
+	if st.recovered {
+		msgs = append(msgs, fmt.Sprintf("state database at '%s' was corrupt and has been restored from its backup", st.path))
+	}
+	for _, msg := range msgs {
+		warn(msg)
+	}
+	store = st
+	return func() { _ = st.Close() }, nil
+}
+
+// warn logs a warning, or prints it to stderr if the logger isn't set up yet.
+func warn(msg string) {
+	if logger != nil {
+		logger.Warn(msg)
+	} else {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+}
+
+func (st *stateStore) Close() error {
+	return st.db.Close()
+}
+
+func (st *stateStore) migrate() error {
+	if _, err := st.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := st.db.QueryRow(`SELECT version FROM schema_version`).Scan(&version); errors.Is(err, sql.ErrNoRows) {
+		if _, err := st.db.Exec(`INSERT INTO schema_version (version) VALUES (0)`); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if err := st.transaction(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(migrations[i]); err != nil {
+				return fmt.Errorf("migration %d failed; %w", i+1, err)
+			}
+			_, err := tx.Exec(`UPDATE schema_version SET version = ?`, i+1)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadState loads the profile's state, with its most recent results.
+func (st *stateStore) loadState(profile string) (*state, error) {
+	results, err := st.results(profile, recentResults)
+	if err != nil {
+		return nil, err
+	}
+	s := &state{Results: results, Hosts: make(hostScoreboard)}
+
+	rows, err := st.db.Query(`SELECT host_key, data FROM hosts WHERE profile = ?`, profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hosts of profile '%s', err: %v", profile, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hk, data string
+		var hs hostScore
+		if err := rows.Scan(&hk, &data); err != nil {
+			return nil, err
+		} else if err := json.Unmarshal([]byte(data), &hs); err != nil {
+			return nil, fmt.Errorf("failed to decode host '%s', err: %v", hk, err)
+		}
+		s.Hosts[hk] = &hs
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	s.Phases, err = st.phaseStates(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	s.updateOk()
+	return s, nil
+}
+
+// results returns the profile's results from newest to oldest, limit 0 returns
+// all of them.
+func (st *stateStore) results(profile string, limit int) (results []result, _ error) {
+	query := `SELECT data FROM results WHERE profile = ? ORDER BY started_at DESC, id DESC`
+	args := []any{profile}
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load results of profile '%s', err: %v", profile, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		var res result
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		} else if err := json.Unmarshal([]byte(data), &res); err != nil {
+			return nil, fmt.Errorf("failed to decode result, err: %v", err)
+		}
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// addResult stores the result along with the state's host scoreboard and
+// applies the configured retention, the result is added to the state once it
+// was stored.
+func (st *stateStore) addResult(profile string, s *state, res result) error {
+	// back up the previous state, a failed backup doesn't lose the result
+	if err := st.backupIfDue(); err != nil {
+		warn(fmt.Sprintf("failed to back up the state before saving the result of profile '%s', err: %v", profile, err))
+	}
+
+	if err := st.transaction(func(tx *sql.Tx) error {
+		if err := insertResult(tx, profile, res); err != nil {
+			return err
+		}
+		if err := deleteCycle(tx, profile, res.Phase); err != nil {
+			return err
+		}
+		if err := replaceHosts(tx, profile, s.Hosts); err != nil {
+			return err
+		}
+		return applyRetention(tx, profile)
+	}); err != nil {
+		return fmt.Errorf("failed to save state, err: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Results = append([]result{res}, s.Results...)
+	if len(s.Results) > recentResults {
+		s.Results = s.Results[:recentResults]
+	}
+	s.updateOk()
+	return nil
+}
+
+// lastCycleStart returns when the profile's last cycle of the given run
+// started, the regular cycle's run is empty. It returns the zero time if it
+// never ran. Every run stores results, so the last cycle of a run isn't
+// necessarily a recent result.
+func (st *stateStore) lastCycleStart(profile, run string) (time.Time, error) {
+	var startedAt int64
+	err := st.db.QueryRow(`SELECT started_at FROM results WHERE profile = ? AND phase = ? ORDER BY started_at DESC, id DESC LIMIT 1`, profile, run).Scan(&startedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("failed to fetch the last cycle of profile '%s', err: %v", profile, err)
+	}
+	return time.Unix(0, startedAt), nil
+}
+
+// resetState removes the profile's results and hosts.
+func (st *stateStore) resetState(profile string) error {
+	if err := st.backup(); err != nil {
+		return err
+	}
+	return st.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM results WHERE profile = ?`, profile); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM cycles WHERE profile = ?`, profile); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM cycle_tasks WHERE profile = ?`, profile); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM phase_runs WHERE profile = ?`, profile); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM verifications WHERE profile = ?`, profile); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM hosts WHERE profile = ?`, profile)
+		return err
+	})
+}
+
+// importJSON imports the profile's JSON state file, files are only imported
+// once.
+func (st *stateStore) importJSON(profile, path string) error {
+	var imported bool
+	if err := st.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM imports WHERE path = ?)`, path).Scan(&imported); err != nil {
+		return err
+	} else if imported {
+		return nil
+	}
+
+	s, err := decodeJSONState(path)
+	if err != nil {
+		return fmt.Errorf("failed to import state file at '%s', err: %v", path, err)
+	} else if s == nil {
+		return nil
+	}
+
+	return st.transaction(func(tx *sql.Tx) error {
+		// results are stored from newest to oldest
+		for i := len(s.Results) - 1; i >= 0; i-- {
+			if err := insertResult(tx, profile, s.Results[i]); err != nil {
+				return err
+			}
+		}
+		if err := replaceHosts(tx, profile, s.Hosts); err != nil {
+			return err
+		}
+		if err := applyRetention(tx, profile); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO imports (path, profile, imported_at) VALUES (?, ?, ?)`, path, profile, time.Now().UnixNano())
+		return err
+	})
+}
+
+func (st *stateStore) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertResult(tx *sql.Tx, profile string, res result) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	var errStr sql.NullString
+	if err := res.Error(); err != nil {
+		errStr = sql.NullString{String: err.Error(), Valid: true}
+	}
+	_, err = tx.Exec(`INSERT INTO results (profile, phase, started_at, ended_at, error, data) VALUES (?, ?, ?, ?, ?, ?)`,
+		profile, res.Phase, res.StartedAt.UnixNano(), res.EndedAt.UnixNano(), errStr, string(data))
+	return err
+}
+
+// deleteCycle removes the profile's running cycle and its plan, run is the
+// phase the cycle belongs to or empty for the profile's regular cycle.
+func deleteCycle(tx *sql.Tx, profile, run string) error {
+	if _, err := tx.Exec(`DELETE FROM cycles WHERE profile = ? AND run = ?`, profile, run); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM cycle_tasks WHERE profile = ? AND run = ?`, profile, run)
+	return err
+}
+
+func replaceHosts(tx *sql.Tx, profile string, hosts hostScoreboard) error {
+	if _, err := tx.Exec(`DELETE FROM hosts WHERE profile = ?`, profile); err != nil {
+		return err
+	}
+
+	scoreboardMu.Lock()
+	defer scoreboardMu.Unlock()
+	for hk, hs := range hosts {
+		data, err := json.Marshal(hs)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO hosts (profile, host_key, data) VALUES (?, ?, ?)`, profile, hk, string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyRetention removes the profile's results that are older than the
+// configured retention or exceed the configured number of results.
+func applyRetention(tx *sql.Tx, profile string) error {
+	if cfg.StateRetention > 0 {
+		cutoff := time.Now().Add(-cfg.StateRetention).UnixNano()
+		if _, err := tx.Exec(`DELETE FROM results WHERE profile = ? AND started_at < ?`, profile, cutoff); err != nil {
+			return err
+		}
+	}
+	if cfg.StateMaxResults > 0 {
+		if _, err := tx.Exec(`DELETE FROM results WHERE profile = ? AND id NOT IN (
+	SELECT id FROM results WHERE profile = ? ORDER BY started_at DESC, id DESC LIMIT ?
+)`, profile, profile, cfg.StateMaxResults); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// databasePath returns the path of the state database, a JSON state file
+// written by an older version is replaced by the database next to it.
+func databasePath(path string) string {
+	if filepath.Ext(path) != ".json" {
+		return path
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".db"
+}
+
+// legacyStatePath returns the path of the profile's JSON state file, which sat
+// next to the database. Without profiles there was a single state file.
+func legacyStatePath(path, name string) string {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	if len(cfg.Profiles) == 0 {
+		return base + ".json"
+	}
+	return fmt.Sprintf("%s-%s.json", base, name)
+}
+
+// decodeJSONState decodes a JSON state file, it returns nil if the file
+// doesn't exist or is empty.
+func decodeJSONState(path string) (*state, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var s state
+	if err := json.NewDecoder(f).Decode(&s); errors.Is(err, io.EOF) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStore opens a state database in a temporary directory with the
+// default config.
+func newTestStore(t *testing.T) *stateStore {
+	t.Helper()
+	prev := cfg
+	cfg = defaultConfig
+	t.Cleanup(func() { cfg = prev })
+
+	st, err := openStateStore(filepath.Join(t.TempDir(), "integrity.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func TestMigrate(t *testing.T) {
+	st := newTestStore(t)
+
+	version := func() (v int) {
+		t.Helper()
+		if err := st.db.QueryRow(`SELECT version FROM schema_version`).Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if v := version(); v != len(migrations) {
+		t.Fatalf("expected schema version %d, got %d", len(migrations), v)
+	}
+
+	// migrating again is a no-op
+	if err := st.migrate(); err != nil {
+		t.Fatal(err)
+	} else if v := version(); v != len(migrations) {
+		t.Fatalf("expected schema version %d, got %d", len(migrations), v)
+	}
+	var rows int
+	if err := st.db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	} else if rows != 1 {
+		t.Fatalf("expected a single schema version, got %d", rows)
+	}
+
+	// a newer schema isn't supported
+	if _, err := st.db.Exec(`UPDATE schema_version SET version = ?`, len(migrations)+1); err != nil {
+		t.Fatal(err)
+	} else if err := st.migrate(); err == nil || !strings.Contains(err.Error(), "newer than the supported version") {
+		t.Fatalf("expected newer schema to fail, got %v", err)
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	st := newTestStore(t)
+
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	legacy := &state{
+		Results: []result{
+			{StartedAt: start.Add(time.Minute), EndedAt: start.Add(2 * time.Minute), Err: &resultErr{errors.New("failed")}},
+			{StartedAt: start, EndedAt: start.Add(time.Minute)},
+		},
+		Hosts: hostScoreboard{"ed25519:01": &hostScore{Downloads: 3}},
+	}
+	path := filepath.Join(filepath.Dir(st.path), "integrity.json")
+	if b, err := json.Marshal(legacy); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// importing twice imports the file once
+	for i := 0; i < 2; i++ {
+		if err := st.importJSON("default", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := st.loadState("default")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(s.Results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(s.Results))
+	} else if !s.Results[0].StartedAt.Equal(legacy.Results[0].StartedAt) || s.Results[0].Error() == nil {
+		t.Fatalf("expected the newest, failed result first, got %+v", s.Results[0])
+	} else if s.Ok {
+		t.Fatal("expected state not to be ok")
+	} else if hs := s.Hosts["ed25519:01"]; hs == nil || hs.Downloads != 3 {
+		t.Fatalf("expected imported host, got %+v", s.Hosts)
+	}
+
+	// a missing file is skipped
+	if err := st.importJSON("default", filepath.Join(filepath.Dir(st.path), "missing.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a JSON state path is imported into the database next to it
+	prev := cfg
+	cfg = defaultConfig
+	t.Cleanup(func() { cfg = prev })
+	jsonStore, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jsonStore.Close()
+	if want := filepath.Join(filepath.Dir(path), "integrity.db"); jsonStore.path != want {
+		t.Fatalf("expected database at '%s', got '%s'", want, jsonStore.path)
+	} else if results, err := jsonStore.results("default", 0); err != nil {
+		t.Fatal(err)
+	} else if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		retention  time.Duration
+		maxResults int
+		want       int
+	}{
+		{
+			name: "unlimited",
+			want: 5,
+		},
+		{
+			name:      "retention",
+			retention: 150 * time.Minute,
+			want:      3,
+		},
+		{
+			name:       "max results",
+			maxResults: 2,
+			want:       2,
+		},
+		{
+			name:       "both",
+			retention:  150 * time.Minute,
+			maxResults: 4,
+			want:       3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			st := newTestStore(t)
+			cfg.StateRetention = test.retention
+			cfg.StateMaxResults = test.maxResults
+
+			// results started 0 to 4 hours ago, another profile's results
+			// are kept
+			if err := st.transaction(func(tx *sql.Tx) error {
+				for i := 4; i >= 0; i-- {
+					start := now.Add(-time.Duration(i) * time.Hour)
+					for _, profile := range []string{"default", "other"} {
+						if err := insertResult(tx, profile, result{StartedAt: start, EndedAt: start}); err != nil {
+							return err
+						}
+					}
+				}
+				return applyRetention(tx, "default")
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			results, err := st.results("default", 0)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(results) != test.want {
+				t.Fatalf("expected %d results, got %d", test.want, len(results))
+			}
+			for i, res := range results {
+				if want := now.Add(-time.Duration(i) * time.Hour); !res.StartedAt.Equal(want) {
+					t.Fatalf("expected result %d to start at %v, got %v", i, want, res.StartedAt)
+				}
+			}
+			if other, err := st.results("other", 0); err != nil {
+				t.Fatal(err)
+			} else if len(other) != 5 {
+				t.Fatalf("expected other profile to keep 5 results, got %d", len(other))
+			}
+		})
+	}
+}
+
+func TestAddResultBackup(t *testing.T) {
+	st := newTestStore(t)
+	s := &state{Hosts: make(hostScoreboard)}
+
+	// every write is backed up by default
+	for i := 0; i < 2; i++ {
+		if err := st.addResult("default", s, result{StartedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(backupPath(st.path)); err != nil {
+			t.Fatalf("expected backup to be written, err: %v", err)
+		} else if err := os.Remove(backupPath(st.path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// with an interval, writes are only backed up once it passed
+	cfg.StateBackupInterval = time.Hour
+	if err := st.addResult("default", s, result{StartedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(backupPath(st.path)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected no backup within the backup interval, err: %v", err)
+	}
+
+	// a failed backup doesn't lose the result
+	st.lastBackup = time.Time{}
+	if err := os.MkdirAll(filepath.Join(backupPath(st.path), "blocked"), 0700); err != nil {
+		t.Fatal(err)
+	} else if err := st.addResult("default", s, result{StartedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	} else if results, err := st.results("default", 0); err != nil {
+		t.Fatal(err)
+	} else if len(results) != 4 || len(s.Results) != 4 {
+		t.Fatalf("expected 4 results, got %d stored and %d in memory", len(results), len(s.Results))
+	}
+}
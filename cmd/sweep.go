@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+// coverage describes how much of the dataset was verified recently.
+type coverage struct {
+	Window         string  `json:"window"`
+	Objects        int     `json:"objects"`
+	Verified       int     `json:"verified"`
+	VerifiedPct    float64 `json:"verifiedPct"`
+	NeverVerified  int     `json:"neverVerified"`
+	Oldest         string  `json:"oldest,omitempty"`
+	OldestVerified string  `json:"oldestVerified,omitempty"`
+}
+
+// sweepSize returns the amount of data the verify phase checks in sweep mode.
+// It verifies at least the configured percentage, and enough to cover the
+// whole dataset once per sweep period given the time since the phase last ran.
+func (p *profile) sweepSize(size int64) int64 {
+	last, _, err := store.lastPhaseRun(p.Name, phaseVerify)
+	if err != nil {
+		p.logger.Warnf("failed to fetch the last verification, err: %v", err)
+		return size
+	} else if last.IsZero() {
+		return size
+	}
+
+	elapsed := time.Since(last)
+	if elapsed > p.SweepPeriod {
+		elapsed = p.SweepPeriod
+	}
+	total, err := p.calculateDatasetSize()
+	if err != nil {
+		p.logger.Warnf("failed to calculate the dataset size, err: %v", err)
+		return size
+	}
+	if sweep := int64(float64(total) * elapsed.Seconds() / p.SweepPeriod.Seconds()); sweep > size {
+		return sweep
+	}
+	return size
+}
+
+// sweepBatch returns a batch of objects of the given size, picking the objects
+// that were verified least recently first. Objects that were never verified
+// come first, in random order.
+func (p *profile) sweepBatch(size int64) ([]cycleTask, error) {
+	entries, err := p.fetchEntries()
+	if err != nil {
+		return nil, err
+	}
+	verified, err := store.verifications(p.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	frand.Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return verified[entries[i].Key].Before(verified[entries[j].Key])
+	})
+
+	var tasks []cycleTask
+	for _, entry := range entries {
+		tasks = append(tasks, cycleTask{Key: entry.Key, Size: entry.Size})
+		size -= entry.Size
+		if size <= 0 {
+			break
+		}
+	}
+	return tasks, nil
+}
+
+// datasetCoverage computes the coverage of the dataset by recent
+// verifications, and forgets the verifications of objects that no longer
+// exist.
+func (p *profile) datasetCoverage() (*coverage, error) {
+	entries, err := p.fetchEntries()
+	if err != nil {
+		return nil, err
+	}
+	verified, err := store.verifications(p.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &coverage{
+		Window:  p.CoverageWindow.String(),
+		Objects: len(entries),
+	}
+	cutoff := time.Now().Add(-p.CoverageWindow)
+	var oldest time.Time
+	for _, entry := range entries {
+		at, ok := verified[entry.Key]
+		delete(verified, entry.Key)
+		if !ok {
+			c.NeverVerified++
+			continue
+		} else if at.After(cutoff) {
+			c.Verified++
+		}
+		if oldest.IsZero() || at.Before(oldest) {
+			oldest = at
+			c.Oldest = entry.Key
+		}
+	}
+	if c.Objects > 0 {
+		c.VerifiedPct = float64(c.Verified) / float64(c.Objects) * 100
+	}
+	if !oldest.IsZero() {
+		c.OldestVerified = oldest.Format(time.RFC3339)
+	}
+
+	// what's left are the verifications of removed objects
+	if err := store.forgetVerifications(p.Name, verified); err != nil {
+		p.logger.Warnf("failed to forget verifications of removed objects, err: %v", err)
+	}
+	return c, nil
+}
+
+// recordVerified records the successful verification of the object, failing
+// to do so only affects the order of the sweep.
+func (p *profile) recordVerified(key string) {
+	if err := store.recordVerification(p.Name, key, time.Now()); err != nil {
+		p.logger.Warnf("failed to record verification of '%s', err: %v", key, err)
+	}
+}
+
+// moveVerified carries the last verification of the object over to the key
+// it was moved to, so moving an object doesn't reset its place in the sweep.
+func (p *profile) moveVerified(from, to string) {
+	if err := store.moveVerification(p.Name, from, to); err != nil {
+		p.logger.Warnf("failed to move verification of '%s' to '%s', err: %v", from, to, err)
+	}
+}
+
+func (c *coverage) String() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "coverage:           %.2f%% of %d objects verified within %s, %d never verified\n", c.VerifiedPct, c.Objects, c.Window, c.NeverVerified)
+	if c.Oldest != "" {
+		fmt.Fprintf(&out, "oldest verified:    %s at %s\n", c.Oldest, c.OldestVerified)
+	}
+	return out.String()
+}
+
+// verifications returns when the profile's objects were last verified, by key.
+func (st *stateStore) verifications(profile string) (map[string]time.Time, error) {
+	rows, err := st.db.Query(`SELECT key, verified_at FROM verifications WHERE profile = ?`, profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load verifications, err: %v", err)
+	}
+	defer rows.Close()
+
+	verified := make(map[string]time.Time)
+	for rows.Next() {
+		var key string
+		var at int64
+		if err := rows.Scan(&key, &at); err != nil {
+			return nil, err
+		}
+		verified[key] = time.Unix(0, at)
+	}
+	return verified, rows.Err()
+}
+
+func (st *stateStore) recordVerification(profile, key string, at time.Time) error {
+	_, err := st.db.Exec(`INSERT INTO verifications (profile, key, verified_at) VALUES (?, ?, ?)
+ON CONFLICT (profile, key) DO UPDATE SET verified_at = excluded.verified_at`, profile, key, at.UnixNano())
+	return err
+}
+
+func (st *stateStore) moveVerification(profile, from, to string) error {
+	_, err := st.db.Exec(`UPDATE OR REPLACE verifications SET key = ? WHERE profile = ? AND key = ?`, to, profile, from)
+	return err
+}
+
+func (st *stateStore) forgetVerifications(profile string, keys map[string]time.Time) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return st.transaction(func(tx *sql.Tx) error {
+		for key := range keys {
+			if _, err := tx.Exec(`DELETE FROM verifications WHERE profile = ? AND key = ?`, profile, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"go.sia.tech/renterd/api"
+)
+
+func TestSweepBatchOrder(t *testing.T) {
+	prevStore := store
+	t.Cleanup(func() { store = prevStore })
+	store = newTestStore(t)
+
+	// list five objects of 10 bytes
+	var objects []api.ObjectMetadata
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		objects = append(objects, api.ObjectMetadata{Key: "/data/" + key, Size: 10})
+	}
+	p := newTestProfile(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.ObjectsResponse{Objects: objects})
+	})
+
+	// 'b' and 'd' were never verified
+	now := time.Now()
+	for key, ago := range map[string]time.Duration{"c": time.Hour, "a": 3 * time.Hour, "e": 2 * time.Hour} {
+		if err := store.recordVerification(p.Name, "/data/"+key, now.Add(-ago)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := func(tasks []cycleTask) (keys []string) {
+		for _, task := range tasks {
+			keys = append(keys, task.Key)
+		}
+		return
+	}
+	for i := 0; i < 10; i++ {
+		tasks, err := p.sweepBatch(50)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(tasks) != 5 {
+			t.Fatalf("expected 5 objects, got %v", keys(tasks))
+		}
+
+		// never verified objects come first in random order, then the least
+		// recently verified ones
+		got := keys(tasks)
+		never := append([]string(nil), got[:2]...)
+		sort.Strings(never)
+		if never[0] != "/data/b" || never[1] != "/data/d" {
+			t.Fatalf("expected never verified objects first, got %v", got)
+		} else if got[2] != "/data/a" || got[3] != "/data/e" || got[4] != "/data/c" {
+			t.Fatalf("expected least recently verified objects next, got %v", got)
+		}
+	}
+
+	// the batch stops once it reaches the size
+	if tasks, err := p.sweepBatch(25); err != nil {
+		t.Fatal(err)
+	} else if len(tasks) != 3 || tasks[2].Key != "/data/a" {
+		t.Fatalf("expected 3 objects ending with '/data/a', got %v", keys(tasks))
+	}
+}
+
+func TestMoveVerification(t *testing.T) {
+	prevStore := store
+	t.Cleanup(func() { store = prevStore })
+	store = newTestStore(t)
+
+	// the object was renamed after it was verified
+	objects := []api.ObjectMetadata{{Key: "/data/renamed/x/a", Size: 10}}
+	p := newTestProfile(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.ObjectsResponse{Objects: objects})
+	})
+	p.CoverageWindow = time.Hour
+	verifiedAt := time.Now().Add(-time.Minute)
+	if err := store.recordVerification(p.Name, "/data/a", verifiedAt); err != nil {
+		t.Fatal(err)
+	}
+	p.moveVerified("/data/a", objects[0].Key)
+
+	// the verification carried over, so it still counts towards the coverage
+	if c, err := p.datasetCoverage(); err != nil {
+		t.Fatal(err)
+	} else if c.Verified != 1 || c.NeverVerified != 0 {
+		t.Fatalf("expected the renamed object to be verified, got %+v", c)
+	} else if verified, err := store.verifications(p.Name); err != nil {
+		t.Fatal(err)
+	} else if len(verified) != 1 || !verified[objects[0].Key].Equal(verifiedAt) {
+		t.Fatalf("expected the verification under the new key, got %v", verified)
+	}
+
+	// moving onto a key that was verified before replaces its verification
+	if err := store.recordVerification(p.Name, "/data/b", verifiedAt.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	p.moveVerified(objects[0].Key, "/data/b")
+	if verified, err := store.verifications(p.Name); err != nil {
+		t.Fatal(err)
+	} else if len(verified) != 1 || !verified["/data/b"].Equal(verifiedAt) {
+		t.Fatalf("expected the moved verification to replace the existing one, got %v", verified)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.sia.tech/renterd/api"
+)
+
+const (
+	transportS3     = "s3"
+	transportWorker = "worker"
+)
+
+type (
+	// transport moves object data to and from renterd, listing and deleting
+	// objects always goes through the bus.
+	transport interface {
+		UploadObject(ctx context.Context, r io.Reader, bucket, key string, opts api.UploadObjectOptions) error
+		DownloadObject(ctx context.Context, w io.Writer, bucket, key string, opts api.DownloadObjectOptions) error
+		HeadObject(ctx context.Context, bucket, key string) (*api.HeadObjectResponse, error)
+	}
+
+	// countingTransport counts the bytes transferred through the transport,
+	// without redundancy, for the cost per TB.
+	countingTransport struct {
+		transport
+	}
+
+	workerTransport struct{}
+
+	s3Transport struct {
+		client   *s3.S3
+		uploader *s3manager.Uploader
+	}
+)
+
+func newTransport(name string) (transport, error) {
+	switch name {
+	case transportWorker:
+		return countingTransport{workerTransport{}}, nil
+	case transportS3:
+		sess, err := session.NewSession(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials(cfg.S3.AccessKeyID, cfg.S3.SecretKey, ""),
+			Endpoint:         aws.String(cfg.S3.Address),
+			Region:           aws.String("us-east-1"),
+			S3ForcePathStyle: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create s3 session, err: %v", err)
+		}
+		client := s3.New(sess)
+		return countingTransport{&s3Transport{
+			client:   client,
+			uploader: s3manager.NewUploaderWithClient(client),
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport '%s'", name)
+	}
+}
+
+func (t countingTransport) UploadObject(ctx context.Context, r io.Reader, bucket, key string, opts api.UploadObjectOptions) error {
+	size := opts.ContentLength
+	if s, ok := r.(io.Seeker); ok {
+		if n, err := remaining(s); err == nil {
+			size = n
+		}
+	}
+	if err := t.transport.UploadObject(ctx, r, bucket, key, opts); err != nil {
+		return err
+	}
+	costs.uploaded.Add(size)
+	return nil
+}
+
+func (t countingTransport) DownloadObject(ctx context.Context, w io.Writer, bucket, key string, opts api.DownloadObjectOptions) error {
+	cw := &countingWriter{w: w}
+	defer func() { costs.downloaded.Add(cw.n) }()
+	return t.transport.DownloadObject(ctx, cw, bucket, key, opts)
+}
+
+func (workerTransport) UploadObject(ctx context.Context, r io.Reader, bucket, key string, opts api.UploadObjectOptions) error {
+	_, err := wc.UploadObject(ctx, r, bucket, key, opts)
+	return err
+}
+
+func (workerTransport) DownloadObject(ctx context.Context, w io.Writer, bucket, key string, opts api.DownloadObjectOptions) error {
+	return wc.DownloadObject(ctx, w, bucket, key, opts)
+}
+
+func (workerTransport) HeadObject(ctx context.Context, bucket, key string) (*api.HeadObjectResponse, error) {
+	return wc.HeadObject(ctx, bucket, key, api.HeadObjectOptions{})
+}
+
+func (t *s3Transport) UploadObject(ctx context.Context, r io.Reader, bucket, key string, opts api.UploadObjectOptions) error {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	}
+	if opts.MimeType != "" {
+		input.ContentType = aws.String(opts.MimeType)
+	}
+	if len(opts.Metadata) > 0 {
+		input.Metadata = aws.StringMap(opts.Metadata)
+	}
+	_, err := t.uploader.UploadWithContext(ctx, input)
+	return err
+}
+
+func (t *s3Transport) DownloadObject(ctx context.Context, w io.Writer, bucket, key string, opts api.DownloadObjectOptions) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if opts.Range != nil {
+		if opts.Range.Length == -1 {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", opts.Range.Offset))
+		} else {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", opts.Range.Offset, opts.Range.Offset+opts.Range.Length-1))
+		}
+	}
+
+	out, err := t.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	_, err = io.Copy(w, out.Body)
+	return err
+}
+
+func (t *s3Transport) HeadObject(ctx context.Context, bucket, key string) (*api.HeadObjectResponse, error) {
+	out, err := t.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.HeadObjectResponse{
+		ContentType: aws.StringValue(out.ContentType),
+		Etag:        aws.StringValue(out.ETag),
+		Size:        aws.Int64Value(out.ContentLength),
+		Metadata:    api.ObjectUserMetadata(aws.StringValueMap(out.Metadata)),
+	}, nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// remaining returns the number of bytes between the seeker's offset and its
+// end, the offset is restored.
+func remaining(s io.Seeker) (int64, error) {
+	offset, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.Seek(offset, io.SeekStart)
+	return end - offset, err
+}
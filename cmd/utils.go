@@ -50,6 +50,11 @@ func mbps(b, ms int64) float64 {
 	return math.Round(bpms*0.008*100) / 100
 }
 
+// pctOf returns the given percentage of n, percentages range from 0 to 100.
+func pctOf(pct float64, n int64) int64 {
+	return int64(pct / 100 * float64(n))
+}
+
 func randomString() string {
 	b := make([]byte, 16)
 	_, _ = frand.Read(b)
@@ -61,3 +66,19 @@ func randomID() types.Hash256 {
 	_, _ = frand.Read(id[:])
 	return id
 }
+
+// waitFor calls fn until it succeeds or the timeout expires.
+func waitFor(timeout time.Duration, fn func(ctx context.Context) error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := fn(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v; %w", timeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}